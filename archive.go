@@ -0,0 +1,144 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+var archiveContentTypes = map[string]string{
+	"zip":    "application/zip",
+	"tar":    "application/x-tar",
+	"tar.gz": "application/gzip",
+}
+
+// ArchiveWriter abstracts the differences between zip and tar archives
+type ArchiveWriter interface {
+	addDir(name string, modTime time.Time) error
+	addFile(name string, modTime time.Time, size int64) (io.Writer, error)
+	Close() error
+}
+
+type zipArchiveWriter struct {
+	*zip.Writer
+}
+
+func (a zipArchiveWriter) addDir(name string, modTime time.Time) error {
+	_, err := a.CreateHeader(&zip.FileHeader{Name: name + "/", Modified: modTime})
+	return err
+}
+
+func (a zipArchiveWriter) addFile(name string, modTime time.Time, size int64) (io.Writer, error) {
+	return a.CreateHeader(&zip.FileHeader{Name: name, Modified: modTime, Method: zip.Deflate})
+}
+
+type tarArchiveWriter struct {
+	*tar.Writer
+	compressor io.Closer // optional
+}
+
+func (a tarArchiveWriter) addDir(name string, modTime time.Time) error {
+	return a.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: name + "/", ModTime: modTime, Mode: 0700, Format: tar.FormatPAX})
+}
+
+func (a tarArchiveWriter) addFile(name string, modTime time.Time, size int64) (io.Writer, error) {
+	return a.Writer, a.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, ModTime: modTime, Size: size, Mode: 0600, Format: tar.FormatPAX})
+}
+
+func (a tarArchiveWriter) Close() error {
+	if err := a.Writer.Close(); err != nil {
+		return err
+	}
+	if a.compressor != nil {
+		return a.compressor.Close()
+	}
+	return nil
+}
+
+func newArchiveWriter(format string, w io.Writer) ArchiveWriter {
+	switch format {
+	case "zip":
+		return zipArchiveWriter{zip.NewWriter(w)}
+	case "tar.gz":
+		compressor := gzip.NewWriter(w)
+		return tarArchiveWriter{tar.NewWriter(compressor), compressor}
+	default:
+		return tarArchiveWriter{tar.NewWriter(w), nil}
+	}
+}
+
+// handleArchiveDownload streams all files below a directory as decrypted archive. files are copied blockwise and never buffered as a whole
+func (app *AppData) handleArchiveDownload(w http.ResponseWriter, r *http.Request, drive *CryDrive, dir string) {
+	format := r.URL.Query().Get("archive")
+	contentType, ok := archiveContentTypes[format]
+	if !ok {
+		http.Error(w, "unsupported archive format, use one of: zip, tar, tar.gz", http.StatusBadRequest)
+		return
+	}
+	if ok, err := drive.isDir(dir); err != nil {
+		http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+		return
+	} else if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	name := path.Base(dir)
+	if dir == "/" {
+		name = "drive"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + "." + format}))
+	if r.Method == "HEAD" {
+		return
+	}
+
+	archive := newArchiveWriter(format, w)
+	err := drive.walk(dir, func(urlPath string, isDir bool) (bool, error) {
+		name := strings.TrimPrefix(strings.TrimPrefix(urlPath, dir), "/")
+		if isDir {
+			stat, err := os.Stat(string(drive.dirIndexFilepath(urlPath)))
+			if errors.Is(err, os.ErrNotExist) {
+				return false, nil
+			} else if err != nil {
+				return false, err
+			}
+			return true, archive.addDir(name, stat.ModTime())
+		}
+
+		fsPath := drive.locate(CryPath(urlPath))
+		lock := fsPath.ReadLock()
+		file, err := NewCryFileReader(fsPath, drive.key)
+		fsPath.ReadUnlock(lock) // files are replaced atomically, so the open file stays valid
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		defer IgnoreErrFunc(file.Close)
+
+		entry, err := archive.addFile(name, file.modTime, file.datasize)
+		if err != nil {
+			return false, err
+		}
+		_, err = io.Copy(entry, file)
+		return false, err
+	})
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		// the status code has already been sent, so abort the connection to signal the client an incomplete archive
+		log.Println("archive download failed:", sanitizeError(err))
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const ARGON2_MEMORY = 64 * 1024 // KiB per hash
+
+const ARGON2_DEFAULT_MEMORY_BUDGET = 1024 * 1024 * 1024 // bytes, 16 hashes at once
+const ARGON2_DEFAULT_QUEUE_LENGTH = 64
+const ARGON2_RETRY_AFTER = time.Second
+
+var errArgon2Busy = errors.New("too many logins at once, try again later")
+
+type argon2Waiter struct {
+	memory int64
+	ready  chan struct{}
+}
+
+type Argon2LimiterStats struct {
+	Running   int
+	Queued    int
+	Memory    int64
+	Budget    int64
+	Completed uint64
+	Rejected  uint64
+	WaitTime  time.Duration
+}
+
+// Argon2Limiter is a weighted semaphore with a bounded FIFO queue. a hash runs when both a slot and its memory are free
+type Argon2Limiter struct {
+	sync.Mutex
+
+	maxRunning int
+	budget     int64 // bytes
+	maxQueued  int
+
+	running int
+	memory  int64
+	queue   *list.List // of *argon2Waiter
+
+	completed uint64
+	rejected  uint64
+	waitTime  time.Duration
+}
+
+func newArgon2Limiter(maxRunning int, budget int64, maxQueued int) *Argon2Limiter {
+	return &Argon2Limiter{maxRunning: max(1, maxRunning), budget: budget, maxQueued: maxQueued, queue: list.New()}
+}
+
+// fits admits a hash larger than the budget when nothing else runs, so it can't wait forever
+func (limiter *Argon2Limiter) fits(memory int64) bool {
+	return limiter.running == 0 || (limiter.running < limiter.maxRunning && limiter.memory+memory <= limiter.budget)
+}
+
+// acquire waits for a slot. it fails with errArgon2Busy when the queue is full or with the error of the context
+func (limiter *Argon2Limiter) acquire(ctx context.Context, memory int64) error {
+	limiter.Lock()
+	if limiter.queue.Len() == 0 && limiter.fits(memory) {
+		limiter.running++
+		limiter.memory += memory
+		limiter.Unlock()
+		return nil
+	}
+	if limiter.queue.Len() >= limiter.maxQueued {
+		limiter.rejected++
+		limiter.Unlock()
+		return errArgon2Busy
+	}
+	waiter := &argon2Waiter{memory: memory, ready: make(chan struct{})}
+	element := limiter.queue.PushBack(waiter)
+	limiter.Unlock()
+
+	start := time.Now()
+	defer func() {
+		limiter.Lock()
+		limiter.waitTime += time.Since(start)
+		limiter.Unlock()
+	}()
+	select {
+	case <-waiter.ready:
+		return nil
+	case <-ctx.Done():
+		limiter.Lock()
+		select {
+		case <-waiter.ready: // granted meanwhile
+			limiter.Unlock()
+			limiter.release(memory, false)
+		default:
+			limiter.queue.Remove(element)
+			limiter.Unlock()
+		}
+		return ctx.Err()
+	}
+}
+
+// release frees a slot and starts the waiting hashes in order
+func (limiter *Argon2Limiter) release(memory int64, completed bool) {
+	limiter.Lock()
+	defer limiter.Unlock()
+	limiter.running--
+	limiter.memory -= memory
+	if completed {
+		limiter.completed++
+	}
+	for limiter.queue.Len() > 0 {
+		waiter := limiter.queue.Front().Value.(*argon2Waiter)
+		if !limiter.fits(waiter.memory) {
+			break
+		}
+		limiter.queue.Remove(limiter.queue.Front())
+		limiter.running++
+		limiter.memory += waiter.memory
+		close(waiter.ready)
+	}
+}
+
+func (limiter *Argon2Limiter) stats() Argon2LimiterStats {
+	limiter.Lock()
+	defer limiter.Unlock()
+	return Argon2LimiterStats{Running: limiter.running, Queued: limiter.queue.Len(), Memory: limiter.memory, Budget: limiter.budget,
+		Completed: limiter.completed, Rejected: limiter.rejected, WaitTime: limiter.waitTime}
+}
+
+// hash runs Password.hash within the limits of the limiter, as every login without cookie runs argon2id
+func (limiter *Argon2Limiter) hash(ctx context.Context, password Password, userSalt UserSalt) (UserKey, error) {
+	const memory = ARGON2_MEMORY * 1024
+	if err := limiter.acquire(ctx, memory); err != nil {
+		return nil, err
+	}
+	defer limiter.release(memory, true)
+	return password.hash(userSalt), nil
+}
+
+func isArgon2Error(err error) bool {
+	return errors.Is(err, errArgon2Busy) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// writeArgon2Error answers requests which couldn't hash a password in time
+func writeArgon2Error(w http.ResponseWriter, err error) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(ARGON2_RETRY_AFTER/time.Second)))
+	http.Error(w, sanitizeError(err), http.StatusServiceUnavailable)
+}
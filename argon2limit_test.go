@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArgon2Limiter(t *testing.T) {
+
+	t.Run("it should admit hashes within the memory budget and queue the rest in order", func(t0 *testing.T) {
+		limiter := newArgon2Limiter(4, 100, 2)
+		ctx := context.Background()
+		Check(limiter.acquire(ctx, 60))
+		granted := make(chan int, 2)
+		for i := range 2 {
+			go func() {
+				Check(limiter.acquire(ctx, 60))
+				granted <- i
+			}()
+			for limiter.stats().Queued != i+1 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		if err := limiter.acquire(ctx, 10); err != errArgon2Busy {
+			t0.Errorf("expected the queue to be full, got %v", err)
+		}
+		limiter.release(60, true)
+		if first := <-granted; first != 0 {
+			t0.Errorf("expected the first waiter to run first, got %d", first)
+		}
+		limiter.release(60, true)
+		<-granted
+		limiter.release(60, true)
+		if stats := limiter.stats(); stats.Running != 0 || stats.Memory != 0 || stats.Completed != 3 || stats.Rejected != 1 {
+			t0.Errorf("unexpected stats: %+v", stats)
+		}
+	})
+
+	t.Run("it should leave the queue when the request ends", func(t0 *testing.T) {
+		limiter := newArgon2Limiter(1, 100, 2)
+		Check(limiter.acquire(context.Background(), 10))
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if err := limiter.acquire(ctx, 10); err != context.DeadlineExceeded {
+			t0.Errorf("expected the deadline to end the wait, got %v", err)
+		}
+		limiter.release(10, true)
+		if stats := limiter.stats(); stats.Queued != 0 || stats.Running != 0 || stats.WaitTime == 0 {
+			t0.Errorf("unexpected stats: %+v", stats)
+		}
+	})
+
+	t.Run("it should answer logins with 503 when the queue is full", func(t0 *testing.T) {
+		t0.Setenv("SECRET_KEY", "q38rcNPrHkxBonj16HTKG95zbq0bzmJ189C9A-EgTxg")
+		t0.Setenv("OPEN_REGISTRATION", "true")
+		app := makeAppData()
+
+		app.argon2Limiter = newArgon2Limiter(1, ARGON2_DEFAULT_MEMORY_BUDGET, 0)
+		Check(app.argon2Limiter.acquire(context.Background(), ARGON2_MEMORY*1024))
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.SetBasicAuth("user1", "passwordpassword")
+		w := httptest.NewRecorder()
+		if app.handleAuth(w, r) != nil || w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+			t0.Errorf("expected 503 with Retry-After, got %v %v", w.Code, w.Header())
+		}
+
+		w = httptest.NewRecorder()
+		app.handleMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+		if !strings.Contains(w.Body.String(), "crydrv_argon2_rejected_total 1\n") {
+			t0.Errorf("unexpected metrics: %s", w.Body.String())
+		}
+	})
+}
@@ -1,15 +1,19 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 )
 
 type AuthData struct {
-	userKey  UserKey
-	userSalt UserSalt
+	username  Username
+	userKey   UserKey
+	userSalt  UserSalt
+	sessionID string // of the cookie, empty for other credentials
 }
 
 const COOKIE_NAME = "crydrv"
@@ -22,70 +26,101 @@ var deleteCookie = &http.Cookie{
 	HttpOnly: true,
 }
 
-func (app *AppData) handleAuth(w http.ResponseWriter, r *http.Request) *AuthData {
-
-	username, password, ok := r.BasicAuth()
-	if ok && strings.Count(username, "") > 0 && strings.Count(password, "") >= int(app.minPasswordLength) {
+func (app *AppData) isRegistered(auth *AuthData) bool {
+	return app.openRegistration || app.usersAllowlist.Contains(auth.userKey.hash(auth.userSalt))
+}
 
-		handleRegistration := func(auth *AuthData) bool {
-			if !app.openRegistration {
-				userFingerprint := auth.userKey.hash(auth.userSalt)
-				if !app.usersAllowlist.Contains(userFingerprint) {
-					http.SetCookie(w, deleteCookie)
-					log.Printf("user '%s' is not allowed to login with the provided password. Add '%s' to USERS_ALLOWLIST to grant permission.\n", username, strEncode(userFingerprint))
-					http.Error(w, "unauthorized account", http.StatusForbidden)
-					return false
-				}
-			}
-			return true
+// handleRegistration admits registered users
+func (app *AppData) handleRegistration(w http.ResponseWriter, auth *AuthData) bool {
+	if !app.isRegistered(auth) {
+		http.SetCookie(w, deleteCookie)
+		// only the first rejection of a username is logged, so guessed passwords don't flood the log with fingerprints
+		if !app.loginLimiter.hasFailures("user:" + string(auth.username)) {
+			log.Printf("user '%s' is not allowed to login with the provided password. Add '%s' to USERS_ALLOWLIST to grant permission.\n", auth.username, strEncode(auth.userKey.hash(auth.userSalt)))
 		}
+		http.Error(w, "unauthorized account", http.StatusForbidden)
+		return false
+	}
+	return true
+}
 
-		if cookie, err := r.Cookie(COOKIE_NAME); err == nil {
-			userKey, err := strDecode(cookie.Value)
-			if err != nil {
-				http.SetCookie(w, deleteCookie)
-				http.Error(w, sanitizeError(err), http.StatusBadRequest)
-				return nil
-			}
-			if len(userKey) != USER_KEY_LENGTH {
-				http.SetCookie(w, deleteCookie)
-				http.Error(w, "invalid key in cookie", http.StatusBadRequest)
-				return nil
-			}
-			auth := new(AuthData)
-			auth.userSalt = makeUserSalt(app.appKey, Username(username))
-			auth.userKey = userKey
+// login derives the user key from the password and starts a session, for basic auth and the login form alike
+func (app *AppData) login(w http.ResponseWriter, r *http.Request, username string, password string, listed bool) *AuthData {
+	if wait := app.loginLimiter.check(loginKeys(r, username)...); wait > 0 {
+		writeLoginLockout(w, wait)
+		return nil
+	}
 
-			if handleRegistration(auth) {
-				return auth
-			} else {
-				return nil // handleRegistration has set the http response
-			}
-		} else {
+	auth := new(AuthData)
+	auth.username = Username(username)
+	auth.userSalt = makeUserSalt(app.appKey, Username(username))
+	userKey, err := app.argon2Limiter.hash(r.Context(), Password(password), auth.userSalt)
+	if err != nil {
+		writeArgon2Error(w, err)
+		return nil
+	}
+	auth.userKey = userKey
+
+	if !app.handleRegistration(w, auth) {
+		app.recordFailedLogin(r, username)
+		return nil // handleRegistration has set the http response
+	}
+	// with open registration any password opens a drive, so logins to a drive without data count as guesses
+	if !app.openRegistration {
+		app.loginLimiter.succeed("user:" + username)
+	} else if hasData, err := app.userDrive(auth).hasData(); err == nil && hasData {
+		app.loginLimiter.succeed("user:" + username)
+	} else if err == nil {
+		app.recordFailedLogin(r, username)
+	}
+	if err := app.startSession(w, r, auth, listed); err != nil {
+		http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+		return nil
+	}
+	// uploads to the drop box are re-encrypted off the request, as that takes a while
+	app.dropImports.Go(func() {
+		if err := app.importDropBox(auth); err != nil {
+			log.Println("drop box import failed:", sanitizeError(err))
+		}
+	})
+	return auth
+}
+
+func (app *AppData) isValidLogin(username string, password string) bool {
+	return strings.Count(username, "") > 0 && strings.Count(password, "") >= int(app.minPasswordLength)
+}
 
-			auth := new(AuthData)
-			auth.userSalt = makeUserSalt(app.appKey, Username(username))
-			auth.userKey = Password(password).hash(auth.userSalt)
+func (app *AppData) handleAuth(w http.ResponseWriter, r *http.Request) *AuthData {
 
-			if handleRegistration(auth) {
-				http.SetCookie(w, &http.Cookie{
-					Name:     COOKIE_NAME,
-					Value:    strEncode(auth.userKey),
-					Expires:  time.Now().Add(app.cookieLifetime),
-					Path:     "/",
-					HttpOnly: true,
-					SameSite: http.SameSiteLaxMode,
-				})
+	username, password, ok := r.BasicAuth()
 
+	if cookie, err := r.Cookie(COOKIE_NAME); err == nil {
+		// expired, revoked and invalid sessions (e.g. cookies of older versions with the raw user key) are replaced via the password.
+		// a cookie alone is enough, basic auth credentials have to belong to the same user
+		if token, err := app.openSession(cookie.Value, time.Now()); err == nil && (!ok || token.isFor(Username(username))) {
+			auth := token.auth(app)
+			switch err := app.checkSession(w, r, auth, token); {
+			case err == nil && app.handleRegistration(w, auth):
 				return auth
-			} else {
+			case err == nil:
 				return nil // handleRegistration has set the http response
+			case !errors.Is(err, errInvalidSession):
+				http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+				return nil
 			}
 		}
-	} else {
-		http.SetCookie(w, deleteCookie)
-		w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}
+
+	if ok && app.isValidLogin(username, password) {
+		return app.login(w, r, username, password, false)
+	}
+
+	http.SetCookie(w, deleteCookie)
+	if !ok && wantsLoginForm(r) {
+		http.Redirect(w, r, LOGIN_PATH+"?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
 		return nil
 	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return nil
 }
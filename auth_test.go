@@ -3,6 +3,7 @@ package main
 import (
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"testing"
 )
 
@@ -47,6 +48,10 @@ func TestClosedRegistrationUserAllowed(t *testing.T) {
 	t.Setenv("USERS_ALLOWLIST", "jOoFNFNR1zZRWylgYRWi3PYnrn65Yc7AaAwUPTy9NyI")
 
 	app := makeAppData()
+
+	app.webBaseDir = "./www-test"
+	defer CheckFunc(func() error { return os.RemoveAll(app.webBaseDir) })
+	Check(os.MkdirAll(app.webBaseDir, 0700))
 	r := httptest.NewRequest(http.MethodGet, "/", nil)
 	r.SetBasicAuth("user1", "passwordpassword")
 	w := httptest.NewRecorder()
@@ -65,6 +70,10 @@ func TestCookieAuth(t *testing.T) {
 	t.Setenv("OPEN_REGISTRATION", "true")
 
 	app := makeAppData()
+
+	app.webBaseDir = "./www-test"
+	defer CheckFunc(func() error { return os.RemoveAll(app.webBaseDir) })
+	Check(os.MkdirAll(app.webBaseDir, 0700))
 	r := httptest.NewRequest(http.MethodGet, "/", nil)
 	r.SetBasicAuth("user1", "passwordpassword")
 	w := httptest.NewRecorder()
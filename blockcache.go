@@ -0,0 +1,152 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+const BLOCK_CACHE_DEFAULT_SIZE = 64 * 1024 * 1024 // bytes of plaintext
+const BLOCK_CACHE_ENTRY_OVERHEAD = 128            // bytes per entry for the key and the bookkeeping
+
+// BlockKey identifies a block of one version of a file. a tag of the key is part of it, so a block is never served to a reader with another key
+type BlockKey struct {
+	fsPath     FsFilepath
+	generation string // modification time and size of the opened file
+	keyTag     string // see UserKey.cacheTag
+	index      int64
+}
+
+type cachedBlock struct {
+	key  BlockKey
+	data Plaintext
+}
+
+type BlockCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+	Bytes     int64
+	Capacity  int64
+}
+
+// DecryptedBlockCache keeps recently decrypted blocks across requests, limited by the size of the plaintext.
+// cached blocks are shared and must not be modified. a nil cache caches nothing
+type DecryptedBlockCache struct {
+	sync.Mutex
+
+	capacity int64
+	size     int64
+	order    *list.List // most recently used first
+	entries  map[BlockKey]*list.Element
+	byPath   map[FsFilepath]map[BlockKey]struct{}
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+func entrySize(data Plaintext) int64 {
+	return int64(len(data)) + BLOCK_CACHE_ENTRY_OVERHEAD
+}
+
+func newDecryptedBlockCache(capacity int64) *DecryptedBlockCache {
+	cache := &DecryptedBlockCache{}
+	cache.setCapacity(capacity)
+	return cache
+}
+
+// setCapacity resizes the cache, 0 disables it
+func (cache *DecryptedBlockCache) setCapacity(capacity int64) {
+	cache.Lock()
+	defer cache.Unlock()
+	if cache.entries == nil {
+		cache.order = list.New()
+		cache.entries = map[BlockKey]*list.Element{}
+		cache.byPath = map[FsFilepath]map[BlockKey]struct{}{}
+	}
+	cache.capacity = capacity
+	cache.evict()
+}
+
+func (cache *DecryptedBlockCache) get(key BlockKey) (Plaintext, bool) {
+	if cache == nil {
+		return nil, false
+	}
+	cache.Lock()
+	defer cache.Unlock()
+	if cache.capacity <= 0 {
+		return nil, false
+	}
+	element, ok := cache.entries[key]
+	if !ok {
+		cache.misses++
+		return nil, false
+	}
+	cache.hits++
+	cache.order.MoveToFront(element)
+	return element.Value.(*cachedBlock).data, true
+}
+
+// put reports whether the block was taken. taken blocks are shared from then on.
+// writes don't know the cache, so the blocks of older versions of the file are dropped here
+func (cache *DecryptedBlockCache) put(key BlockKey, data Plaintext) bool {
+	if cache == nil {
+		return false
+	}
+	cache.Lock()
+	defer cache.Unlock()
+	if cache.capacity <= 0 || entrySize(data) > cache.capacity {
+		return false
+	}
+	for other := range cache.byPath[key.fsPath] {
+		if other.generation != key.generation || other == key {
+			cache.remove(cache.entries[other])
+		}
+	}
+	cache.entries[key] = cache.order.PushFront(&cachedBlock{key: key, data: data})
+	if cache.byPath[key.fsPath] == nil {
+		cache.byPath[key.fsPath] = map[BlockKey]struct{}{}
+	}
+	cache.byPath[key.fsPath][key] = struct{}{}
+	cache.size += entrySize(data)
+	cache.evict()
+	return true
+}
+
+// invalidate drops all blocks of a file after it has been replaced or removed
+func (cache *DecryptedBlockCache) invalidate(fsPath FsFilepath) {
+	if cache == nil {
+		return
+	}
+	cache.Lock()
+	defer cache.Unlock()
+	for key := range cache.byPath[fsPath] {
+		cache.remove(cache.entries[key])
+	}
+}
+
+func (cache *DecryptedBlockCache) evict() {
+	for cache.size > cache.capacity && cache.order.Len() > 0 {
+		cache.remove(cache.order.Back())
+		cache.evictions++
+	}
+}
+
+func (cache *DecryptedBlockCache) remove(element *list.Element) {
+	block := cache.order.Remove(element).(*cachedBlock)
+	delete(cache.entries, block.key)
+	if keys := cache.byPath[block.key.fsPath]; keys != nil {
+		delete(keys, block.key)
+		if len(keys) == 0 {
+			delete(cache.byPath, block.key.fsPath)
+		}
+	}
+	cache.size -= entrySize(block.data)
+}
+
+func (cache *DecryptedBlockCache) stats() BlockCacheStats {
+	cache.Lock()
+	defer cache.Unlock()
+	return BlockCacheStats{Hits: cache.hits, Misses: cache.misses, Evictions: cache.evictions, Entries: len(cache.entries), Bytes: cache.size, Capacity: cache.capacity}
+}
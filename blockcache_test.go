@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBlockCache(t *testing.T) {
+
+	baseDir := "./www-test"
+	defer CheckFunc(func() error { return os.RemoveAll(baseDir) })
+	Check(os.MkdirAll(baseDir, 0700))
+	cache := newDecryptedBlockCache(BLOCK_CACHE_DEFAULT_SIZE)
+
+	key1, key2 := Try(makeAppKey()).deriveKey("1"), Try(makeAppKey()).deriveKey("2")
+	fsPath := FsFilepath(filepath.Join(baseDir, "ab", "cdef"))
+	readAll := func(key UserKey) (string, error) {
+		file, err := NewCryFileReader(fsPath, key)
+		if err != nil {
+			return "", err
+		}
+		defer IgnoreErrFunc(file.Close)
+		file.enableSharedBlocks(cache)
+		data, err := io.ReadAll(file)
+		return string(data), err
+	}
+
+	t.Run("it should serve blocks across readers", func(t0 *testing.T) {
+		Check(WriteCryFile(fsPath, strings.NewReader("first"), 5, key1))
+		before := cache.stats()
+		for range 3 {
+			if content, err := readAll(key1); err != nil || content != "first" {
+				t0.Fatalf("unexpected content: %q %v", content, err)
+			}
+		}
+		after := cache.stats()
+		if after.Misses-before.Misses != 1 || after.Hits-before.Hits != 2 || after.Entries != 1 {
+			t0.Errorf("unexpected stats: %+v", after)
+		}
+	})
+
+	t.Run("it should never serve blocks to another key", func(t0 *testing.T) {
+		if _, err := readAll(key2); err == nil {
+			t0.Errorf("expected the decryption to fail")
+		}
+		cache.Lock()
+		defer cache.Unlock()
+		for key := range cache.entries {
+			if strings.Contains(key.keyTag, string(key1)) || key.keyTag != key1.cacheTag() {
+				t0.Errorf("expected the cache to hold a tag of the key only")
+			}
+		}
+	})
+
+	t.Run("it should drop the blocks of older versions", func(t0 *testing.T) {
+		Check(WriteCryFile(fsPath, strings.NewReader("second"), 6, key1))
+		if content, _ := readAll(key1); content != "second" {
+			t0.Errorf("unexpected content: %q", content)
+		}
+		if cache.stats().Entries != 1 {
+			t0.Errorf("expected the blocks of the old version to be dropped")
+		}
+	})
+
+	t.Run("it should drop the blocks of removed files", func(t0 *testing.T) {
+		drive := &CryDrive{baseDir: baseDir, key: key1, sharedBlocks: cache}
+		crypath := CryPath("/removed.txt")
+		Check(WriteCryFile(drive.locate(crypath), strings.NewReader("removed"), 7, key1))
+		file := Try(NewCryFileReader(drive.locate(crypath), key1))
+		file.enableSharedBlocks(cache)
+		Try(io.ReadAll(file))
+		Check(file.Close())
+		before := cache.stats().Entries
+		Check(drive.removeFile(crypath))
+		if after := cache.stats().Entries; after != before-1 {
+			t0.Errorf("expected the block to be dropped, got %d entries of %d", after, before)
+		}
+	})
+
+	t.Run("it should keep cached blocks out of the buffer pool", func(t0 *testing.T) {
+		Check(WriteCryFile(fsPath, strings.NewReader("third"), 5, key1))
+		file := Try(NewCryFileReader(fsPath, key1))
+		defer CheckFunc(file.Close)
+		file.enableSharedBlocks(cache)
+		block := Try(file.block(0))
+		defer block.release()
+		if block.buf != nil || string(block.data) != "third" {
+			t0.Errorf("expected a shared block, got %q", block.data)
+		}
+
+		cache.setCapacity(0)
+		defer cache.setCapacity(BLOCK_CACHE_DEFAULT_SIZE)
+		other := Try(NewCryFileReader(fsPath, key1))
+		other.enableSharedBlocks(cache)
+		pooled := Try(other.block(0))
+		if pooled.buf == nil || pooled.refs.Load() != 2 {
+			t0.Errorf("expected a pooled block held by the reader and the caller, got %d references", pooled.refs.Load())
+		}
+		pooled.release()
+		Check(other.Close())
+		if pooled.refs.Load() != 0 {
+			t0.Errorf("expected the block to be released on close, got %d references", pooled.refs.Load())
+		}
+	})
+
+	t.Run("it should stay within the capacity", func(t0 *testing.T) {
+		cache.setCapacity(2 * (BLOCK_SIZE_UNENCRYPTED + BLOCK_CACHE_ENTRY_OVERHEAD))
+		content := strings.Repeat("x", 3*BLOCK_SIZE_UNENCRYPTED)
+		Check(WriteCryFile(fsPath, strings.NewReader(content), int64(len(content)), key1))
+		if data, _ := readAll(key1); data != content {
+			t0.Fatalf("unexpected content of %d bytes", len(data))
+		}
+		stats := cache.stats()
+		if stats.Entries != 2 || stats.Bytes > stats.Capacity || stats.Evictions == 0 {
+			t0.Errorf("unexpected stats: %+v", stats)
+		}
+
+		w := httptest.NewRecorder()
+		app := AppData{sharedBlocks: cache, argon2Limiter: newArgon2Limiter(1, ARGON2_DEFAULT_MEMORY_BUDGET, 0)}
+		app.handleMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+		if !strings.Contains(w.Body.String(), "crydrv_block_cache_entries 2\n") {
+			t0.Errorf("unexpected metrics: %s", w.Body.String())
+		}
+	})
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+const CLI_USAGE = `usage: crydrv [command] [flags]
+
+commands:
+  serve        start the web server (default)
+  cat PATH     decrypt a file to stdout or to a local file (-o)
+  put PATH     encrypt stdin or a local file (-i) and store it
+  ls [DIR]     list a directory
+  locate PATH  print the CryFilename and storage location of a path
+  fingerprint  print the user fingerprint for USERS_ALLOWLIST
+  scrub        check the storage for corrupt files, with -user all files of the user are authenticated
+
+SECRET_KEY has to be set as for the web server. The user key is derived from -user and
+the password (env var PASSWORD or -password-file) or given directly via -userkey (or the value of an unexpired login cookie).
+`
+
+type CliOptions struct {
+	flags        *flag.FlagSet
+	username     string
+	passwordFile string
+	userKey      string
+	dataDir      string
+}
+
+func newCliOptions(command string) *CliOptions {
+	opts := &CliOptions{flags: flag.NewFlagSet("crydrv "+command, flag.ContinueOnError)}
+	opts.flags.StringVar(&opts.username, "user", "", "username")
+	opts.flags.StringVar(&opts.passwordFile, "password-file", "", "read the password from this file (- for stdin) instead of env var PASSWORD")
+	opts.flags.StringVar(&opts.userKey, "userkey", "", "base64url encoded user key, replaces the password")
+	opts.flags.StringVar(&opts.dataDir, "data", "./www", "storage directory of the web server")
+	return opts
+}
+
+// auth derives the user credentials exactly like the web server does on login
+func (opts *CliOptions) auth(app *AppData, stdin io.Reader) (*AuthData, error) {
+	if opts.username == "" {
+		return nil, errors.New("missing -user")
+	}
+	auth := &AuthData{username: Username(opts.username)}
+	auth.userSalt = makeUserSalt(app.appKey, auth.username)
+
+	if opts.userKey != "" {
+		userKey, err := strDecode(opts.userKey)
+		if err != nil {
+			return nil, err
+		}
+		if len(userKey) != USER_KEY_LENGTH {
+			token, err := app.openSession(opts.userKey, time.Now())
+			if err != nil || !token.isFor(auth.username) {
+				return nil, errors.New("invalid -userkey: neither a user key nor a valid login cookie")
+			}
+			sessions, err := app.userDrive(&AuthData{username: auth.username, userKey: token.UserKey, userSalt: auth.userSalt}).readSessions()
+			if err != nil {
+				return nil, err
+			} else if !slices.ContainsFunc(sessions, func(session Session) bool { return session.ID == token.ID }) && !token.canBeListed(time.Now()) {
+				return nil, errors.New("invalid -userkey: the login cookie has been revoked")
+			}
+			userKey = token.UserKey
+		}
+		auth.userKey = userKey
+		return auth, nil
+	}
+
+	password := os.Getenv("PASSWORD")
+	if opts.passwordFile != "" {
+		var reader io.Reader = stdin
+		if opts.passwordFile != "-" {
+			file, err := os.Open(opts.passwordFile)
+			if err != nil {
+				return nil, err
+			}
+			defer IgnoreErrFunc(file.Close)
+			reader = file
+		}
+		line, err := bufio.NewReader(reader).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	if password == "" {
+		return nil, errors.New("missing password: set env var PASSWORD or use -password-file or -userkey")
+	}
+	auth.userKey = Password(password).hash(auth.userSalt)
+	return auth, nil
+}
+
+func cliPath(value string) (string, error) {
+	urlPath := path.Clean("/" + value)
+	if isReservedPath(urlPath) {
+		return "", errors.New("path is reserved")
+	}
+	return urlPath, nil
+}
+
+// runCli provides offline access to the storage directory, e.g. to recover data without the web server
+func runCli(args []string, stdin io.Reader, stdout io.Writer) error {
+	command := args[0]
+	if command == "help" || command == "-h" || command == "--help" {
+		_, err := io.WriteString(stdout, CLI_USAGE)
+		return err
+	}
+
+	opts := newCliOptions(command)
+	var outFile, inFile string
+	switch command {
+	case "cat":
+		opts.flags.StringVar(&outFile, "o", "", "write to this local file instead of stdout")
+	case "put":
+		opts.flags.StringVar(&inFile, "i", "", "read from this local file instead of stdin")
+	case "ls", "locate", "fingerprint", "scrub":
+	default:
+		return fmt.Errorf("unknown command %q\n\n%s", command, CLI_USAGE)
+	}
+	if err := opts.flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if opts.passwordFile == "-" && command == "put" && inFile == "" {
+		return errors.New("stdin can't be used for password and file content at the same time")
+	}
+
+	app := AppData{appKey: loadAppKey(), webBaseDir: opts.dataDir}
+	if command == "scrub" && opts.username == "" {
+		return cliScrub(app.webBaseDir, nil, stdout)
+	}
+	auth, err := opts.auth(&app, stdin)
+	if err != nil {
+		return err
+	}
+	drive := app.userDrive(auth)
+
+	if command == "fingerprint" {
+		_, err := fmt.Fprintln(stdout, strEncode(auth.userKey.hash(auth.userSalt)))
+		return err
+	}
+	if command == "scrub" {
+		return cliScrub(app.webBaseDir, drive, stdout)
+	}
+
+	if opts.flags.NArg() == 0 && command != "ls" {
+		return errors.New("missing path argument")
+	}
+	urlPath, err := cliPath(opts.flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "cat":
+		fsPath := drive.locate(CryPath(urlPath))
+		file, err := NewCryFileReader(fsPath, drive.key)
+		if err != nil {
+			return err
+		}
+		defer IgnoreErrFunc(file.Close)
+		if outFile == "" {
+			_, err = io.Copy(stdout, file)
+			return err
+		}
+		out, err := os.OpenFile(outFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, file); err != nil {
+			IgnoreErrFunc(out.Close)
+			return err
+		}
+		return out.Close()
+
+	case "put":
+		if ok, err := drive.isDir(urlPath); err != nil {
+			return err
+		} else if ok {
+			return errors.New("path is a directory")
+		}
+		var reader io.Reader = stdin
+		var size int64 = -1
+		if inFile != "" {
+			file, err := os.Open(inFile)
+			if err != nil {
+				return err
+			}
+			defer IgnoreErrFunc(file.Close)
+			stat, err := file.Stat()
+			if err != nil {
+				return err
+			}
+			reader, size = file, stat.Size()
+		}
+		if err := WriteCryFile(drive.locate(CryPath(urlPath)), reader, size, drive.key); err != nil {
+			return err
+		}
+		return drive.link(urlPath, false)
+
+	case "ls":
+		entries, err := drive.readDir(urlPath)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			name := entry.name
+			if entry.isDir {
+				name += "/"
+			}
+			if _, err := fmt.Fprintln(stdout, name); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	default: // locate
+		cryName := CryPath(urlPath).hash(drive.key, drive.salt)
+		_, err := fmt.Fprintf(stdout, "CryFilename: %s\nfile: %s\ndirectory index: %s\n", cryName, drive.locate(CryPath(urlPath)), drive.dirIndexFilepath(urlPath))
+		return err
+	}
+}
+
+func cliScrub(baseDir string, drive *CryDrive, stdout io.Writer) error {
+	stats, err := scrubStorage(baseDir, drive, func(fsPath FsFilepath, problem string) {
+		_, _ = fmt.Fprintf(stdout, "%s: %s\n", fsPath, problem)
+	})
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(stdout, "checked %d files with %d bytes\n", stats.files, stats.bytes)
+	if stats.problems > 0 {
+		return fmt.Errorf("found %d problems", stats.problems)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCli(t *testing.T) {
+
+	t.Setenv("SECRET_KEY", "q38rcNPrHkxBonj16HTKG95zbq0bzmJ189C9A-EgTxg")
+	t.Setenv("OPEN_REGISTRATION", "true")
+	t.Setenv("PASSWORD", "passwordpassword")
+	app := makeAppData()
+
+	app.webBaseDir = "./www-test"
+	defer CheckFunc(func() error { return os.RemoveAll(app.webBaseDir) })
+	Check(os.MkdirAll(app.webBaseDir, 0700))
+
+	cli := func(stdin string, args ...string) (string, error) {
+		stdout := new(bytes.Buffer)
+		err := runCli(append(args[:1], append([]string{"-user", "user1", "-data", app.webBaseDir}, args[1:]...)...), strings.NewReader(stdin), stdout)
+		return stdout.String(), err
+	}
+
+	t.Run("it should decrypt files written by the server", func(t0 *testing.T) {
+		uploadFile(&app, http.MethodPost, "/dir/server.txt", "from server")
+		if out, err := cli("", "cat", "/dir/server.txt"); err != nil || out != "from server" {
+			t0.Errorf("unexpected output: %q %v", out, err)
+		}
+	})
+
+	t.Run("it should write files readable by the server", func(t0 *testing.T) {
+		if _, err := cli("from cli", "put", "/dir/cli.txt"); err != nil {
+			t0.Fatal(err)
+		}
+		if w := sendRequest(&app, http.MethodGet, "/dir/cli.txt", nil); w.Body.String() != "from cli" {
+			t0.Errorf("unexpected content: %q", w.Body.String())
+		}
+		if out, err := cli("", "ls", "/dir"); err != nil || out != "cli.txt\nserver.txt\n" {
+			t0.Errorf("unexpected listing: %q %v", out, err)
+		}
+	})
+
+	t.Run("it should print the user fingerprint", func(t0 *testing.T) {
+		auth := &AuthData{userSalt: makeUserSalt(app.appKey, "user1")}
+		auth.userKey = Password("passwordpassword").hash(auth.userSalt)
+		if out, _ := cli("", "fingerprint"); out != strEncode(auth.userKey.hash(auth.userSalt))+"\n" {
+			t0.Errorf("unexpected fingerprint: %q", out)
+		}
+		if out, _ := cli("", "locate", "-userkey", strEncode(auth.userKey), "/dir/cli.txt"); !strings.Contains(out, string(app.userDrive(auth).locate("/dir/cli.txt"))) {
+			t0.Errorf("unexpected location: %q", out)
+		}
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.SetBasicAuth("user1", "passwordpassword")
+		w := httptest.NewRecorder()
+		app.handleAuth(w, r)
+		cookie := w.Result().Cookies()[0].Value
+		if out, _ := cli("", "locate", "-userkey", cookie, "/dir/cli.txt"); !strings.Contains(out, string(app.userDrive(auth).locate("/dir/cli.txt"))) {
+			t0.Errorf("unexpected location for the login cookie: %q", out)
+		}
+	})
+
+	t.Run("it should reject wrong keys", func(t0 *testing.T) {
+		if _, err := cli("", "cat", "-userkey", strEncode(make([]byte, USER_KEY_LENGTH)), "/dir/cli.txt"); err == nil {
+			t0.Errorf("expected an error")
+		}
+	})
+}
@@ -3,9 +3,11 @@ package main
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdh"
 	"crypto/rand"
 	"crypto/sha512"
 	"encoding/base64"
+	"errors"
 	"io"
 
 	"golang.org/x/crypto/argon2"
@@ -39,6 +41,67 @@ func makeAppKey() (AppKey, error) {
 	return value, nil
 }
 
+// deriveKey returns a key for a specific purpose, so the app key itself is never used for encryption
+func (appKey AppKey) deriveKey(purpose string) UserKey {
+	hkdf := hkdf.New(hkdfHasher, appKey, nil, []byte(purpose))
+	key := make(UserKey, USER_KEY_LENGTH)
+	Try(io.ReadFull(hkdf, key))
+	return key
+}
+
+// wrapKey encrypts a user key which is stored for others, like recipients of grants or holders of links. with the storage
+// and their own keys they still can't decrypt the drive of the owner without the server, which enforces what they may access
+func (appKey AppKey) wrapKey(userKey UserKey) ([]byte, error) {
+	return appKey.deriveKey("wrapped-user-key").encrypt(Plaintext(userKey))
+}
+
+func (appKey AppKey) unwrapKey(wrapped []byte) (UserKey, error) {
+	userKey, err := appKey.deriveKey("wrapped-user-key").decrypt(wrapped)
+	if err != nil {
+		return nil, err
+	} else if len(userKey) != USER_KEY_LENGTH {
+		return nil, errors.New("invalid wrapped key")
+	}
+	return UserKey(userKey), nil
+}
+
+func sealedKey(sharedSecret []byte, ephemeralKey []byte, publicKey []byte, purpose string) UserKey {
+	hkdf := hkdf.New(hkdfHasher, sharedSecret, append(append([]byte{}, ephemeralKey...), publicKey...), []byte(purpose))
+	key := make(UserKey, USER_KEY_LENGTH)
+	Try(io.ReadFull(hkdf, key))
+	return key
+}
+
+// sealKeyTo derives a key via X25519 with a fresh ephemeral key, which only the owner of the public key can derive again
+func sealKeyTo(publicKey []byte, purpose string) (ephemeralKey []byte, key UserKey, err error) {
+	recipient, err := ecdh.X25519().NewPublicKey(publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	sharedSecret, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, nil, err
+	}
+	ephemeralKey = ephemeral.PublicKey().Bytes()
+	return ephemeralKey, sealedKey(sharedSecret, ephemeralKey, publicKey, purpose), nil
+}
+
+func openSealedKey(privateKey *ecdh.PrivateKey, ephemeralKey []byte, purpose string) (UserKey, error) {
+	ephemeral, err := ecdh.X25519().NewPublicKey(ephemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret, err := privateKey.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	return sealedKey(sharedSecret, ephemeralKey, privateKey.PublicKey().Bytes(), purpose), nil
+}
+
 func makeUserSalt(appKey AppKey, username Username) UserSalt {
 	hkdf := hkdf.New(hkdfHasher, appKey, []byte(username), nil)
 	hash := make(UserSalt, hkdfHasher().Size())
@@ -60,63 +123,79 @@ func (crypath CryPath) hash(userKey UserKey, userSalt UserSalt) CryFilename {
 	return CryFilename(strEncode(hash))
 }
 
+// etag derives a version tag from the nonce of the last block, which is new with every write of a file
+func (userKey UserKey) etag(nonce []byte) string {
+	hkdf := hkdf.New(hkdfHasher, userKey, nonce, []byte("etag"))
+	hash := make([]byte, 18)
+	Try(io.ReadFull(hkdf, hash))
+	return `"` + strEncode(hash) + `"`
+}
+
+// cacheTag tells keys apart in the shared block cache without keeping the key itself in memory
+func (userKey UserKey) cacheTag() string {
+	hkdf := hkdf.New(hkdfHasher, userKey, nil, []byte("block-cache"))
+	hash := make([]byte, 18)
+	Try(io.ReadFull(hkdf, hash))
+	return string(hash)
+}
+
 func (password Password) hash(userSalt UserSalt) UserKey {
 	const iterations = 3
-	const memory = 64 * 1024 // KiB
+	const memory = ARGON2_MEMORY
 	const parallelism = 4
 	return argon2.IDKey([]byte(password), userSalt, iterations, memory, parallelism, USER_KEY_LENGTH)
 }
 
-func (userKey UserKey) encrypt(plaintext Plaintext) (ciphertext Ciphertext, err error) {
-
-	//Create a new Cipher Block from the key
+// aead creates the AES-GCM of a key. it is safe for concurrent use, so files create it once for all of their blocks
+func (userKey UserKey) aead() (cipher.AEAD, error) {
 	block, err := aes.NewCipher(userKey)
 	if err != nil {
 		return nil, err
 	}
+	//https://en.wikipedia.org/wiki/Galois/Counter_Mode
+	return cipher.NewGCM(block)
+}
 
-	//Create a new GCM - https://en.wikipedia.org/wiki/Galois/Counter_Mode
-	//https://golang.org/pkg/crypto/cipher/#NewGCM
-	aesGCM, err := cipher.NewGCM(block)
+func (userKey UserKey) encrypt(plaintext Plaintext) (ciphertext Ciphertext, err error) {
+	aesGCM, err := userKey.aead()
 	if err != nil {
 		return nil, err
 	}
-
-	//Create a nonce. Nonce should be from GCM
+	//Create a nonce and add it as a prefix to the encrypted data. The first nonce argument in Seal is the prefix.
 	nonce := make([]byte, aesGCM.NonceSize())
 	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
 		return nil, err
 	}
-
-	//Encrypt the data using aesGCM.Seal
-	//Since we don't want to save the nonce somewhere else in this case, we add it as a prefix to the encrypted data. The first nonce argument in Seal is the prefix.
 	return aesGCM.Seal(nonce, nonce, plaintext, nil), nil
 }
 
 func (userKey UserKey) decrypt(ciphertext Ciphertext) (plaintext Plaintext, err error) {
-
-	//Create a new Cipher Block from the key
-	block, err := aes.NewCipher(userKey)
+	aesGCM, err := userKey.aead()
 	if err != nil {
 		return nil, err
 	}
+	if len(ciphertext) < aesGCM.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertextWithoutPrefix := ciphertext[:aesGCM.NonceSize()], ciphertext[aesGCM.NonceSize():]
+	return aesGCM.Open(nil, nonce, ciphertextWithoutPrefix, nil)
+}
 
-	//Create a new GCM
-	aesGCM, err := cipher.NewGCM(block)
-	if err != nil {
+// sealInPlace encrypts the plaintext behind the first NONCE_SIZE bytes of buf and puts a fresh nonce in front of it.
+// the ciphertext reuses buf if its capacity has room for the tag
+func sealInPlace(aesGCM cipher.AEAD, buf []byte) (Ciphertext, error) {
+	nonce := buf[:NONCE_SIZE]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return nil, err
 	}
+	return aesGCM.Seal(nonce, nonce, buf[NONCE_SIZE:], nil), nil
+}
 
-	//Get the nonce size
-	nonceSize := aesGCM.NonceSize()
-
-	//Extract the nonce from the encrypted data
-	nonce, ciphertextWithoutPrefix := ciphertext[:nonceSize], ciphertext[nonceSize:]
-
-	//Decrypt the data
-	plaintext, err = aesGCM.Open(nil, nonce, ciphertextWithoutPrefix, nil)
-	if err != nil {
-		return nil, err
+// openInPlace decrypts into the memory of the ciphertext, the plaintext starts behind the nonce
+func openInPlace(aesGCM cipher.AEAD, ciphertext Ciphertext) (Plaintext, error) {
+	if len(ciphertext) < NONCE_SIZE {
+		return nil, errors.New("ciphertext too short")
 	}
-	return plaintext, nil
+	nonce, sealed := ciphertext[:NONCE_SIZE], ciphertext[NONCE_SIZE:]
+	return aesGCM.Open(sealed[:0], nonce, sealed, nil)
 }
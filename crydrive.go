@@ -0,0 +1,444 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// every path of a drive is hashed with the drive key and salt, so the storage itself has no notion of directories.
+// to be able to enumerate a directory, each one gets an encrypted index file listing its children.
+// index files are stored under reserved paths, which can never collide with url paths as those always start with a slash
+const DIR_INDEX_PREFIX = "dir:"
+
+// the storage of a destination is kept under this prefix while it is being replaced
+const OVERWRITTEN_PREFIX = "overwritten:"
+
+// serializes read-modify-write cycles of index and sidecar files
+var metadataLocker = &FileLocker{
+	locks: make(map[FsFilepath]*FileLock),
+}
+
+func lockMetadata(fsPath FsFilepath) (unlock func()) {
+	lock := metadataLocker.acquire(fsPath)
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		metadataLocker.release(fsPath)
+	}
+}
+
+type CryDrive struct {
+	baseDir      string
+	key          UserKey
+	salt         UserSalt
+	sharedBlocks *DecryptedBlockCache // blocks of removed or moved files are dropped from it
+}
+
+type DirEntry struct {
+	name  string
+	isDir bool
+}
+
+func (app *AppData) userDrive(auth *AuthData) *CryDrive {
+	return &CryDrive{baseDir: app.webBaseDir, key: auth.userKey, salt: auth.userSalt, sharedBlocks: app.sharedBlocks}
+}
+
+func (drive *CryDrive) locate(crypath CryPath) FsFilepath {
+	cryName := crypath.hash(drive.key, drive.salt)
+	return cryName.toFilepath(drive.baseDir)
+}
+
+func (drive *CryDrive) dirIndexFilepath(dir string) FsFilepath {
+	return drive.locate(CryPath(DIR_INDEX_PREFIX + dir))
+}
+
+func (drive *CryDrive) isFile(urlPath string) (bool, error) {
+	return IsFile(string(drive.locate(CryPath(urlPath))))
+}
+
+func (drive *CryDrive) isDir(dir string) (bool, error) {
+	if dir == "/" {
+		return true, nil
+	}
+	return IsFile(string(drive.dirIndexFilepath(dir)))
+}
+
+// hasData tells whether the root directory lists anything. as any password opens a drive, this tells a guessed password apart
+func (drive *CryDrive) hasData() (bool, error) {
+	entries, err := drive.readDirIndex("/")
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return len(entries) > 0, err
+}
+
+func (drive *CryDrive) exists(urlPath string) (bool, error) {
+	if ok, err := drive.isFile(urlPath); err != nil || ok {
+		return ok, err
+	}
+	return drive.isDir(urlPath)
+}
+
+func (drive *CryDrive) readDirIndex(dir string) (map[string]bool, error) {
+	fsPath := drive.dirIndexFilepath(dir)
+	lock := fsPath.ReadLock()
+	defer fsPath.ReadUnlock(lock)
+
+	file, err := NewCryFileReader(fsPath, drive.key)
+	if err != nil {
+		return nil, err
+	}
+	defer IgnoreErrFunc(file.Close)
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]bool)
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// readDir lists the children of a directory sorted by name. the root directory always exists
+func (drive *CryDrive) readDir(dir string) ([]DirEntry, error) {
+	entries, err := drive.readDirIndex(dir)
+	if errors.Is(err, os.ErrNotExist) && dir == "/" {
+		entries, err = map[string]bool{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	list := make([]DirEntry, 0, len(entries))
+	for name, isDir := range entries {
+		list = append(list, DirEntry{name: name, isDir: isDir})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list, nil
+}
+
+// walk visits everything below dir in lexicographic order of the paths. visit returns false to skip the content of a directory
+func (drive *CryDrive) walk(dir string, visit func(urlPath string, isDir bool) (descend bool, err error)) error {
+	entries, err := drive.readDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// directories are sorted as if they had their trailing slash, matching the order of the paths inside
+	sortKey := func(entry DirEntry) string {
+		if entry.isDir {
+			return entry.name + "/"
+		}
+		return entry.name
+	}
+	sort.Slice(entries, func(i, j int) bool { return sortKey(entries[i]) < sortKey(entries[j]) })
+
+	for _, entry := range entries {
+		urlPath := path.Join(dir, entry.name)
+		descend, err := visit(urlPath, entry.isDir)
+		if err != nil {
+			return err
+		}
+		if entry.isDir && descend {
+			if err := drive.walk(urlPath, visit); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// updateDir modifies the index of a directory. modify returns false if nothing has changed
+func (drive *CryDrive) updateDir(dir string, create bool, modify func(entries map[string]bool) bool) error {
+	fsPath := drive.dirIndexFilepath(dir)
+	defer lockMetadata(fsPath)()
+
+	entries, err := drive.readDirIndex(dir)
+	exists := true
+	if errors.Is(err, os.ErrNotExist) {
+		if !create {
+			return nil
+		}
+		entries, exists = make(map[string]bool), false
+	} else if err != nil {
+		return err
+	}
+	if !modify(entries) && exists {
+		return nil
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return WriteCryFile(fsPath, strings.NewReader(string(data)), int64(len(data)), drive.key)
+}
+
+// link registers a file or directory in its parent directories
+func (drive *CryDrive) link(urlPath string, isDir bool) error {
+	for urlPath != "/" {
+		dir, name := path.Split(urlPath)
+		dir = path.Clean(dir)
+		added := false
+		err := drive.updateDir(dir, true, func(entries map[string]bool) bool {
+			if wasDir, ok := entries[name]; ok && wasDir == isDir {
+				return false
+			}
+			entries[name] = isDir
+			added = true
+			return true
+		})
+		if err != nil || !added {
+			return err // ancestors are already registered
+		}
+		urlPath = dir
+		isDir = true
+	}
+	return nil
+}
+
+// unlink removes a file or directory from its parent directory
+func (drive *CryDrive) unlink(urlPath string) error {
+	dir, name := path.Split(urlPath)
+	return drive.updateDir(path.Clean(dir), false, func(entries map[string]bool) bool {
+		if _, ok := entries[name]; !ok {
+			return false
+		}
+		delete(entries, name)
+		return true
+	})
+}
+
+func (drive *CryDrive) mkdir(dir string) error {
+	if err := drive.updateDir(dir, true, func(entries map[string]bool) bool { return false }); err != nil {
+		return err
+	}
+	return drive.link(dir, true)
+}
+
+// sidecar files hold additional data of a file or directory (like WebDAV dead properties) and follow it on move, copy and remove
+var sidecarPrefixes = []string{PROPS_PREFIX}
+
+func (drive *CryDrive) removeFile(crypath CryPath) error {
+	fsPath := drive.locate(crypath)
+	lock := fsPath.WriteLock()
+	defer fsPath.WriteUnlock(lock)
+	defer drive.sharedBlocks.invalidate(fsPath)
+	return os.Remove(string(fsPath))
+}
+
+func (drive *CryDrive) renameFile(src, dst CryPath) error {
+	srcFsPath, dstFsPath := drive.locate(src), drive.locate(dst)
+	if err := os.MkdirAll(filepath.Dir(string(dstFsPath)), 0700); err != nil {
+		return err
+	}
+	unlock := WriteLockAll(srcFsPath, dstFsPath)
+	defer unlock()
+	defer drive.sharedBlocks.invalidate(srcFsPath)
+	defer drive.sharedBlocks.invalidate(dstFsPath)
+	return os.Rename(string(srcFsPath), string(dstFsPath))
+}
+
+// copyFile encrypts the content again with fresh nonces, so the storage can't tell that both files are equal
+func (drive *CryDrive) copyFile(src, dst CryPath) error {
+	return drive.copyFileTo(drive, src, dst)
+}
+
+// copyFileTo copies a file into another drive, encrypted with the key of the target
+func (drive *CryDrive) copyFileTo(target *CryDrive, src, dst CryPath) error {
+	srcFsPath := drive.locate(src)
+	lock := srcFsPath.ReadLock()
+	file, err := NewCryFileReader(srcFsPath, drive.key)
+	srcFsPath.ReadUnlock(lock) // files are replaced atomically, so the open file stays valid
+	if err != nil {
+		return err
+	}
+	defer IgnoreErrFunc(file.Close)
+
+	return WriteCryFile(target.locate(dst), file, file.datasize, target.key)
+}
+
+func (drive *CryDrive) forEachSidecar(src, dst string, action func(src, dst CryPath) error) error {
+	for _, prefix := range sidecarPrefixes {
+		if err := action(CryPath(prefix+src), CryPath(prefix+dst)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove deletes a file or a whole directory tree
+func (drive *CryDrive) remove(urlPath string) error {
+	if err := drive.forEachSidecar(urlPath, urlPath, func(src, _ CryPath) error { return drive.removeFile(src) }); err != nil {
+		return err
+	}
+
+	if ok, err := drive.isFile(urlPath); err != nil {
+		return err
+	} else if ok {
+		if err := drive.removeFile(CryPath(urlPath)); err != nil {
+			return err
+		}
+		return drive.unlink(urlPath)
+	}
+
+	if ok, err := drive.isDir(urlPath); err != nil {
+		return err
+	} else if !ok {
+		return os.ErrNotExist
+	}
+	entries, err := drive.readDir(urlPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := drive.remove(path.Join(urlPath, entry.name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := IgnoreNotExist(drive.removeFile(CryPath(DIR_INDEX_PREFIX + urlPath))); err != nil || urlPath == "/" {
+		return err
+	}
+	return drive.unlink(urlPath)
+}
+
+// move renames a file or directory tree. the ciphertext is kept as is, only the file names are derived anew from the destination path
+func (drive *CryDrive) move(src, dst string) error {
+	if err := drive.forEachSidecar(src, dst, drive.renameFile); err != nil {
+		return err
+	}
+
+	if ok, err := drive.isFile(src); err != nil {
+		return err
+	} else if ok {
+		if err := drive.renameFile(CryPath(src), CryPath(dst)); err != nil {
+			return err
+		}
+		if err := drive.link(dst, false); err != nil {
+			return err
+		}
+		return drive.unlink(src)
+	}
+
+	entries, err := drive.readDir(src)
+	if err != nil {
+		return err
+	}
+	if err := drive.mkdir(dst); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := drive.move(path.Join(src, entry.name), path.Join(dst, entry.name)); err != nil {
+			return err
+		}
+	}
+	return drive.remove(src)
+}
+
+// copy duplicates a file or directory. recursive=false copies a directory without its children
+func (drive *CryDrive) copy(src, dst string, recursive bool) error {
+	if err := drive.forEachSidecar(src, dst, drive.copyFile); err != nil {
+		return err
+	}
+
+	if ok, err := drive.isFile(src); err != nil {
+		return err
+	} else if ok {
+		if err := drive.copyFile(CryPath(src), CryPath(dst)); err != nil {
+			return err
+		}
+		return drive.link(dst, false)
+	}
+
+	entries, err := drive.readDir(src)
+	if err != nil {
+		return err
+	}
+	if err := drive.mkdir(dst); err != nil {
+		return err
+	}
+	if recursive {
+		for _, entry := range entries {
+			if err := drive.copy(path.Join(src, entry.name), path.Join(dst, entry.name), true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// storagePaths lists everything stored for a file or directory tree: contents, directory indexes and sidecars
+func (drive *CryDrive) storagePaths(urlPath string) ([]CryPath, error) {
+	var cryPaths []CryPath
+	add := func(urlPath string, isDir bool) (bool, error) {
+		if isDir {
+			cryPaths = append(cryPaths, CryPath(DIR_INDEX_PREFIX+urlPath))
+		} else {
+			cryPaths = append(cryPaths, CryPath(urlPath))
+		}
+		for _, prefix := range sidecarPrefixes {
+			cryPaths = append(cryPaths, CryPath(prefix+urlPath))
+		}
+		return true, nil
+	}
+	isDir, err := drive.isDir(urlPath)
+	if err != nil {
+		return nil, err
+	}
+	_, _ = add(urlPath, isDir)
+	if !isDir {
+		return cryPaths, nil
+	}
+	return cryPaths, drive.walk(urlPath, add)
+}
+
+// replace runs create, which writes urlPath anew, and removes the previous content only once it has succeeded.
+// meanwhile the previous content is moved aside, and it is restored if create fails
+func (drive *CryDrive) replace(urlPath string, create func() error) error {
+	wasDir, err := drive.isDir(urlPath)
+	if err != nil {
+		return err
+	}
+	cryPaths, err := drive.storagePaths(urlPath)
+	if err != nil {
+		return err
+	}
+	var moved []CryPath
+	restore := func() error {
+		for _, cryPath := range moved {
+			if err := drive.renameFile(OVERWRITTEN_PREFIX+cryPath, cryPath); err != nil {
+				return err
+			}
+		}
+		return drive.link(urlPath, wasDir)
+	}
+	for _, cryPath := range cryPaths {
+		if err := drive.renameFile(cryPath, OVERWRITTEN_PREFIX+cryPath); errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return errors.Join(err, restore())
+		}
+		moved = append(moved, cryPath)
+	}
+
+	if err := create(); err != nil {
+		// the partial replacement makes room for the previous content
+		return errors.Join(err, IgnoreNotExist(drive.remove(urlPath)), restore())
+	}
+	for _, cryPath := range moved {
+		if err := IgnoreNotExist(drive.removeFile(OVERWRITTEN_PREFIX + cryPath)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
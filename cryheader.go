@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// files start with a header holding the authenticated plaintext length and content hash, so opening a file doesn't need
+// to decrypt any block. files written before the header existed start directly with the nonce of the first block
+const CRY_HEADER_MAGIC = "CRYDRV\x00\x01"
+const CRY_HEADER_PLAINTEXT_SIZE = 8 + 32 + NONCE_SIZE                                       // length, SHA-256, nonce of the last block
+const CRY_HEADER_SIZE = len(CRY_HEADER_MAGIC) + NONCE_SIZE + CRY_HEADER_PLAINTEXT_SIZE + 16 // magic, nonce, encrypted fields, tag
+
+var errCorruptHeader = errors.New("ciphertext doesn't match its header")
+
+type CryHeader struct {
+	length    int64
+	sha256    []byte
+	lastNonce []byte // binds the header to the version of the content, nil for empty files
+	nonce     []byte // of the header itself, new with every write
+}
+
+// cryFileSize is the size of the ciphertext including the header
+func cryFileSize(length int64) int64 {
+	blocks := (length + BLOCK_SIZE_UNENCRYPTED - 1) / BLOCK_SIZE_UNENCRYPTED
+	return int64(CRY_HEADER_SIZE) + length + blocks*(BLOCK_SIZE_ENCRYPTED-BLOCK_SIZE_UNENCRYPTED)
+}
+
+func (header *CryHeader) encode(userKey UserKey) (Ciphertext, error) {
+	plaintext := make(Plaintext, 0, CRY_HEADER_PLAINTEXT_SIZE)
+	plaintext = binary.BigEndian.AppendUint64(plaintext, uint64(header.length))
+	plaintext = append(plaintext, header.sha256...)
+	plaintext = append(plaintext, header.lastNonce...)
+	plaintext = append(plaintext, make([]byte, CRY_HEADER_PLAINTEXT_SIZE-len(plaintext))...)
+	encrypted, err := userKey.encrypt(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return append(Ciphertext(CRY_HEADER_MAGIC), encrypted...), nil
+}
+
+func hasCryHeader(prefix []byte) bool {
+	return len(prefix) >= CRY_HEADER_SIZE && bytes.HasPrefix(prefix, []byte(CRY_HEADER_MAGIC))
+}
+
+// readCryHeader decrypts the header and checks it against the size and the last block of the file. it returns nil for files without header
+func readCryHeader(file *os.File, size int64, userKey UserKey) (*CryHeader, error) {
+	buf := make([]byte, CRY_HEADER_SIZE)
+	if n, err := file.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return nil, err
+	} else if !hasCryHeader(buf[:n]) {
+		return nil, nil
+	}
+	plaintext, err := userKey.decrypt(buf[len(CRY_HEADER_MAGIC):])
+	if err != nil {
+		return nil, err
+	}
+	header := &CryHeader{
+		length: int64(binary.BigEndian.Uint64(plaintext)),
+		sha256: plaintext[8:40],
+		nonce:  buf[len(CRY_HEADER_MAGIC) : len(CRY_HEADER_MAGIC)+NONCE_SIZE],
+	}
+	if header.length < 0 || cryFileSize(header.length) != size {
+		return nil, errCorruptHeader
+	}
+	if header.length > 0 {
+		header.lastNonce = plaintext[40:]
+		lastBlockIndex := (header.length - 1) / BLOCK_SIZE_UNENCRYPTED
+		nonce := make([]byte, NONCE_SIZE)
+		if _, err := file.ReadAt(nonce, int64(CRY_HEADER_SIZE)+lastBlockIndex*BLOCK_SIZE_ENCRYPTED); err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(nonce, header.lastNonce) {
+			return nil, errCorruptHeader
+		}
+	}
+	return header, nil
+}
+
+// readCryHeaderSize checks for a header without decrypting it, for structural checks without a key
+func readCryHeaderSize(fsPath FsFilepath) (int64, error) {
+	file, err := os.Open(string(fsPath))
+	if err != nil {
+		return 0, err
+	}
+	defer IgnoreErrFunc(file.Close)
+	buf := make([]byte, CRY_HEADER_SIZE)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+	if hasCryHeader(buf[:n]) {
+		return int64(CRY_HEADER_SIZE), nil
+	}
+	return 0, nil
+}
@@ -1,42 +1,82 @@
 package main
 
 import (
+	"crypto/cipher"
+	"crypto/sha256"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const BLOCK_SIZE_UNENCRYPTED = 4 * 1024 * 1024                // 4 MiB
 const BLOCK_SIZE_ENCRYPTED = BLOCK_SIZE_UNENCRYPTED + 12 + 16 // 4 MiB + AES nonce + PKCS#7 padding
+const NONCE_SIZE = 12                                         // bytes in front of every encrypted block
 
-var cipherReadBufferPool = sync.Pool{
+const TEMP_FILE_PATTERN = ".tmp-*"
+
+// blockBufferPool holds buffers of a whole encrypted block. blocks are encrypted and decrypted in place in them
+var blockBufferPool = sync.Pool{
 	New: func() any {
 		b := make(Ciphertext, BLOCK_SIZE_ENCRYPTED)
 		return &b
 	},
 }
 
+// PlaintextBlock is a decrypted block. a block decrypted into a pooled buffer returns it to the pool with the last release.
+// blocks of the shared cache are handed out untracked, so their buffers are left to the garbage collector
+type PlaintextBlock struct {
+	data Plaintext
+	buf  *Ciphertext // nil if not pooled
+	refs atomic.Int32
+}
+
+func (block *PlaintextBlock) retain() *PlaintextBlock {
+	if block != nil && block.buf != nil {
+		block.refs.Add(1)
+	}
+	return block
+}
+
+func (block *PlaintextBlock) release() {
+	if block != nil && block.buf != nil && block.refs.Add(-1) == 0 {
+		blockBufferPool.Put(block.buf)
+	}
+}
+
 type BlockCache struct {
 	sync.Mutex
 
 	index int64
-	data  Plaintext
+	block *PlaintextBlock
 }
 
 type CryFileReader struct {
 	io.ReadSeeker
+	io.ReaderAt
 
 	filepath FsFilepath
 	datasize int64
 	blocks   int64
 	position int64
 	userKey  UserKey
+	aead     cipher.AEAD
 	modTime  time.Time
+	etag     string
+	digest   []byte // SHA-256 of the content from the header, nil for files without header
+
+	dataOffset int64 // size of the header in front of the first block
 
-	blockCache *BlockCache
+	generation string // identifies the version in the shared cache of decrypted blocks
+	keyTag     string // identifies the key in the shared cache of decrypted blocks
+
+	blockCache   *BlockCache
+	sharedBlocks *DecryptedBlockCache // see enableSharedBlocks
+	readAhead    *ReadAhead
 
 	file *os.File
 }
@@ -47,96 +87,167 @@ func NewCryFileReader(filepath FsFilepath, userKey UserKey) (*CryFileReader, err
 	f.filepath = filepath
 	f.position = 0
 
-	stat, err := os.Stat(string(f.filepath))
+	var err error
+	if f.aead, err = userKey.aead(); err != nil {
+		return nil, err
+	}
+	f.file, err = os.Open(string(f.filepath))
+	if err != nil {
+		return nil, err
+	}
+	// stat the opened file, as the path may already point to a newer version
+	stat, err := f.file.Stat()
 	if err != nil {
+		defer IgnoreErrFunc(f.file.Close)
 		return nil, err
 	}
 
-	f.blocks = (stat.Size() + BLOCK_SIZE_ENCRYPTED - 1) / BLOCK_SIZE_ENCRYPTED
 	f.modTime = stat.ModTime()
+	f.keyTag = userKey.cacheTag()
+	f.generation = fmt.Sprintf("%d-%d", stat.ModTime().UnixNano(), stat.Size())
 
-	f.file, err = os.Open(string(f.filepath))
+	header, err := readCryHeader(f.file, stat.Size(), userKey)
 	if err != nil {
+		defer IgnoreErrFunc(f.file.Close)
 		return nil, err
 	}
+	if header != nil {
+		f.dataOffset = int64(CRY_HEADER_SIZE)
+		f.datasize = header.length
+		f.blocks = (header.length + BLOCK_SIZE_UNENCRYPTED - 1) / BLOCK_SIZE_UNENCRYPTED
+		f.digest = header.sha256
+		f.etag = f.userKey.etag(header.nonce)
+		f.blockCache = &BlockCache{index: -1}
+		return f, nil
+	}
 
+	// files without header: the length is only known after decrypting the last block
+	f.blocks = (stat.Size() + BLOCK_SIZE_ENCRYPTED - 1) / BLOCK_SIZE_ENCRYPTED
 	if f.blocks > 0 {
 		lastBlockIndex := int64(f.blocks - 1)
-		buf := make(Ciphertext, BLOCK_SIZE_ENCRYPTED)
-		_, err = f.file.Seek((lastBlockIndex * int64(BLOCK_SIZE_ENCRYPTED)), io.SeekStart)
-		if err != nil {
-			defer IgnoreErrFunc(f.file.Close)
-			return nil, err
-		}
-		n, err := f.file.Read(buf)
-		if err != nil {
+		nonce := make([]byte, NONCE_SIZE)
+		if _, err := f.file.ReadAt(nonce, lastBlockIndex*BLOCK_SIZE_ENCRYPTED); err != nil {
 			defer IgnoreErrFunc(f.file.Close)
 			return nil, err
 		}
-		decrypted, err := f.userKey.decrypt(buf[:n])
+		decrypted, err := f.loadBlock(lastBlockIndex)
 		if err != nil {
 			defer IgnoreErrFunc(f.file.Close)
 			return nil, err
 		}
-		f.blockCache = &BlockCache{index: lastBlockIndex, data: decrypted}
-		f.datasize = (lastBlockIndex * int64(BLOCK_SIZE_UNENCRYPTED)) + int64(len(decrypted))
+		f.blockCache = &BlockCache{index: lastBlockIndex, block: decrypted}
+		f.etag = f.userKey.etag(nonce)
+		f.datasize = (lastBlockIndex * int64(BLOCK_SIZE_UNENCRYPTED)) + int64(len(decrypted.data))
 	} else { // empty file
-		f.blockCache = &BlockCache{index: 0, data: []byte{}}
+		f.blockCache = &BlockCache{index: -1}
+		f.etag = f.userKey.etag(nil)
 		f.datasize = 0
 	}
 	return f, nil
 }
 
-func (f *CryFileReader) Read(p []byte) (int, error) {
+// loadBlock decrypts a block in place into a pooled buffer or takes it from the cache shared by all readers.
+// the caller owns one reference of the returned block
+func (f *CryFileReader) loadBlock(index int64) (*PlaintextBlock, error) {
+	key := BlockKey{fsPath: f.filepath, generation: f.generation, keyTag: f.keyTag, index: index}
+	if data, ok := f.sharedBlocks.get(key); ok {
+		return &PlaintextBlock{data: data}, nil
+	}
+
+	buf := blockBufferPool.Get().(*Ciphertext)
+	n, err := f.file.ReadAt(*buf, f.dataOffset+index*BLOCK_SIZE_ENCRYPTED)
+	if err == nil || err == io.EOF {
+		if n <= NONCE_SIZE {
+			err = io.ErrUnexpectedEOF
+		} else {
+			var decrypted Plaintext
+			if decrypted, err = openInPlace(f.aead, (*buf)[:n]); err == nil {
+				if f.sharedBlocks.put(key, decrypted) {
+					return &PlaintextBlock{data: decrypted}, nil // the buffer belongs to the cache now
+				}
+				block := &PlaintextBlock{data: decrypted, buf: buf}
+				block.refs.Store(1)
+				return block, nil
+			}
+		}
+	}
+	blockBufferPool.Put(buf)
+	return nil, err
+}
+
+// enableSharedBlocks serves blocks from the cache shared by all readers and adds the decrypted ones to it
+func (f *CryFileReader) enableSharedBlocks(cache *DecryptedBlockCache) {
+	f.sharedBlocks = cache
+}
 
+func (f *CryFileReader) Read(p []byte) (int, error) {
 	if f.position >= f.datasize {
 		return 0, io.EOF
 	}
+	n, err := f.ReadAt(p, f.position)
+	f.position += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil // the next call reports the end
+	}
+	return n, err
+}
 
-	blockIndex := int64(f.position) / int64(BLOCK_SIZE_UNENCRYPTED)
-	blockOffset := f.position - blockIndex*int64(BLOCK_SIZE_UNENCRYPTED)
-
+// block returns a decrypted block, which the caller has to release. the last used block is kept per reader,
+// as sequential reads mostly hit it again
+func (f *CryFileReader) block(index int64) (*PlaintextBlock, error) {
 	f.blockCache.Lock()
-	cacheIndex := f.blockCache.index
+	if f.blockCache.index == index {
+		defer f.blockCache.Unlock()
+		return f.blockCache.block.retain(), nil
+	}
 	f.blockCache.Unlock()
-	if cacheIndex != blockIndex {
 
-		_, err := f.file.Seek(blockIndex*int64(BLOCK_SIZE_ENCRYPTED), io.SeekStart)
-		if err != nil {
-			defer IgnoreErrFunc(f.file.Close)
-			return 0, err
-		}
+	var decrypted *PlaintextBlock
+	var err error
+	if f.readAhead != nil {
+		decrypted, err = f.readAhead.take(f, index)
+	} else {
+		decrypted, err = f.loadBlock(index)
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.blockCache.Lock()
+	previous := f.blockCache.block
+	f.blockCache.index = index
+	f.blockCache.block = decrypted.retain()
+	f.blockCache.Unlock()
+	previous.release()
+	return decrypted, nil
+}
 
-		buf := cipherReadBufferPool.Get().(*Ciphertext)
-		defer cipherReadBufferPool.Put(buf)
-		n, err := f.file.Read(*buf)
+// ReadAt reads with positional file reads and doesn't touch the position of Read and Seek,
+// so multiple goroutines can read one open file concurrently
+func (f *CryFileReader) ReadAt(p []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	for n < len(p) && offset < f.datasize {
+		blockIndex := offset / BLOCK_SIZE_UNENCRYPTED
+		blockOffset := offset - blockIndex*BLOCK_SIZE_UNENCRYPTED
+		decrypted, err := f.block(blockIndex)
 		if err != nil {
-			return 0, err
+			return n, err
 		}
-		decrypted, err := f.userKey.decrypt((*buf)[:n])
-		if err != nil {
-			return 0, err
+		if blockOffset >= int64(len(decrypted.data)) {
+			decrypted.release()
+			return n, io.ErrUnexpectedEOF // only the last block may be shorter
 		}
-		f.blockCache.Lock()
-		f.blockCache.index = blockIndex
-		f.blockCache.data = decrypted
-		f.blockCache.Unlock()
+		copied := copy(p[n:], decrypted.data[blockOffset:])
+		decrypted.release()
+		n += copied
+		offset += int64(copied)
 	}
-	f.blockCache.Lock()
-	decrypted := f.blockCache.data
-	f.blockCache.Unlock()
-
-	remainingBlockSize := int64(len(decrypted)) - blockOffset
-	readableByteSize := Min(int64(len(p)), remainingBlockSize)
-
-	if readableByteSize > 0 {
-		f.position += readableByteSize
-
-		copy(p, decrypted[blockOffset:blockOffset+readableByteSize])
-		return int(readableByteSize), nil
-	} else {
-		return 0, io.EOF
+	if n < len(p) {
+		return n, io.EOF
 	}
+	return n, nil
 }
 
 func (f *CryFileReader) Seek(offset int64, whence int) (int64, error) {
@@ -155,52 +266,179 @@ func (f *CryFileReader) Seek(offset int64, whence int) (int64, error) {
 }
 
 func (f *CryFileReader) Close() error {
+	if f.readAhead != nil {
+		f.readAhead.stop()
+	}
+	f.blockCache.Lock()
+	f.blockCache.block.release()
+	f.blockCache.index, f.blockCache.block = -1, nil
+	f.blockCache.Unlock()
 	return f.file.Close()
 }
 
-func WriteCryFile(outFilepath FsFilepath, inFile io.Reader, inFileSize int64, userKey UserKey) error {
+// encryptInFlightBlocks bounds the memory of an upload: blocks being encrypted in parallel plus the one being read
+var encryptInFlightBlocks = 4
 
-	outDir := filepath.Dir(string(outFilepath))
-	if err := os.MkdirAll(outDir, 0700); err != nil {
-		return err
-	}
+type encryptedBlock struct {
+	done       chan struct{}
+	buf        *Ciphertext // pooled, holds the plaintext behind the nonce until it is encrypted in place
+	length     int
+	ciphertext Ciphertext
+	err        error
+}
 
-	lock := outFilepath.WriteLock()
-	defer outFilepath.WriteUnlock(lock)
+func (block *encryptedBlock) encrypt(aesGCM cipher.AEAD) {
+	block.ciphertext, block.err = sealInPlace(aesGCM, (*block.buf)[:NONCE_SIZE+block.length])
+}
 
-	outFile, err := os.Create(string(outFilepath))
+// encryptBlocks reads, encrypts and writes blocks in a pipeline: blocks are encrypted concurrently and written in order.
+// files of a single block are encrypted directly. the returned header describes the written content
+func encryptBlocks(out io.Writer, in io.Reader, inFileSize int64, userKey UserKey) (*CryHeader, error) {
+	aesGCM, err := userKey.aead()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	bufSize := int64(BLOCK_SIZE_UNENCRYPTED)
+	if inFileSize >= 0 && inFileSize < bufSize {
+		bufSize = inFileSize + 1 // one byte more to detect input exceeding the announced size
+	}
+	header := &CryHeader{}
+	checksum := sha256.New()
+	// readBlock returns the buffer to the pool on errors, so only returned blocks have to be put back
+	readBlock := func() (*encryptedBlock, bool, error) {
+		block := &encryptedBlock{done: make(chan struct{}), buf: blockBufferPool.Get().(*Ciphertext)}
+		plaintext := (*block.buf)[NONCE_SIZE : NONCE_SIZE+bufSize]
+		n, err := io.ReadFull(in, plaintext) // every block except the last one must be complete
+		block.length = n
+		header.length += int64(n)
+		checksum.Write(plaintext[:n])
+		if n == len(plaintext) && n < BLOCK_SIZE_UNENCRYPTED {
+			err = errors.New("input exceeds announced size")
+		} else if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return block, true, nil
+		}
+		if err != nil {
+			blockBufferPool.Put(block.buf)
+			return nil, false, err
+		}
+		return block, false, nil
+	}
+	writeBlock := func(block *encryptedBlock) error {
+		defer blockBufferPool.Put(block.buf)
+		if _, err := out.Write(block.ciphertext); err != nil {
+			return err
+		}
+		header.lastNonce = append(header.lastNonce[:0], block.ciphertext[:NONCE_SIZE]...)
+		return nil
 	}
-	defer IgnoreErrFunc(outFile.Close)
 
-	buf := make(Plaintext, Min(int64(BLOCK_SIZE_UNENCRYPTED), inFileSize))
-	for {
-		n, err := inFile.Read(buf)
+	block, last, err := readBlock()
+	if err != nil {
+		return nil, err
+	}
+	if last {
+		header.sha256 = checksum.Sum(nil)
+		if block.length == 0 {
+			blockBufferPool.Put(block.buf)
+			return header, nil
+		}
+		if block.encrypt(aesGCM); block.err != nil {
+			blockBufferPool.Put(block.buf)
+			return nil, block.err
+		}
+		return header, writeBlock(block)
+	}
 
-		if n > 0 {
-			encrypted, err := userKey.encrypt(buf[:n])
-			if err != nil {
-				return err
+	ordered := make(chan *encryptedBlock, encryptInFlightBlocks-1)
+	writeErr := make(chan error, 1)
+	var failed atomic.Bool
+	go func() {
+		var err error
+		for block := range ordered {
+			<-block.done
+			if err == nil {
+				err = block.err
 			}
-
-			if _, err := outFile.Write(encrypted); err != nil {
-				return err
+			if err == nil {
+				err = writeBlock(block)
+			} else {
+				blockBufferPool.Put(block.buf) // blocks after a failure are dropped
+			}
+			if err != nil {
+				failed.Store(true)
 			}
 		}
+		writeErr <- err
+	}()
 
-		if err == io.EOF {
+	var readErr error
+	for {
+		if block.length > 0 {
+			go func(block *encryptedBlock) {
+				defer close(block.done)
+				block.encrypt(aesGCM)
+			}(block)
+			ordered <- block // blocks while too many blocks are in flight
+		} else {
+			blockBufferPool.Put(block.buf)
+		}
+		if last || failed.Load() {
+			break
+		}
+		if block, last, readErr = readBlock(); readErr != nil {
 			break
-		} else if err != nil {
-			return err
 		}
 	}
+	close(ordered)
+	if err := <-writeErr; readErr == nil {
+		readErr = err
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	header.sha256 = checksum.Sum(nil)
+	return header, nil
+}
+
+func WriteCryFile(outFilepath FsFilepath, inFile io.Reader, inFileSize int64, userKey UserKey) error {
+
+	outDir := filepath.Dir(string(outFilepath))
+	if err := os.MkdirAll(outDir, 0700); err != nil {
+		return err
+	}
+
+	// write into a temporary file first and replace the target atomically, so readers never see a partially written file
+	outFile, err := os.CreateTemp(outDir, TEMP_FILE_PATTERN)
+	if err != nil {
+		return err
+	}
+	defer IgnoreErrFunc(func() error { return os.Remove(outFile.Name()) })
+	defer IgnoreErrFunc(outFile.Close)
+
+	// the header is only known after the content, so space is reserved and it is filled in at the end
+	if _, err := outFile.Write(make([]byte, CRY_HEADER_SIZE)); err != nil {
+		return err
+	}
+	header, err := encryptBlocks(outFile, inFile, inFileSize, userKey)
+	if err != nil {
+		return err
+	}
+	encodedHeader, err := header.encode(userKey)
+	if err != nil {
+		return err
+	}
+	if _, err := outFile.WriteAt(encodedHeader, 0); err != nil {
+		return err
+	}
 
 	if err := outFile.Close(); err != nil {
 		return err
 	}
 
-	return nil
+	lock := outFilepath.WriteLock()
+	defer outFilepath.WriteUnlock(lock)
+
+	return os.Rename(outFile.Name(), string(outFilepath))
 }
 
 func (cryFilename *CryFilename) toFilepath(basedir string) FsFilepath {
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"testing/iotest"
+)
+
+func TestCryFileReaderAt(t *testing.T) {
+
+	baseDir := "./www-test"
+	defer CheckFunc(func() error { return os.RemoveAll(baseDir) })
+	Check(os.MkdirAll(baseDir, 0700))
+
+	key := Try(makeAppKey()).deriveKey("test")
+	content := make([]byte, 2*BLOCK_SIZE_UNENCRYPTED+1000)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	fsPath := FsFilepath(filepath.Join(baseDir, "ab", "cdef"))
+	Check(WriteCryFile(fsPath, bytes.NewReader(content), int64(len(content)), key))
+	file := Try(NewCryFileReader(fsPath, key))
+	defer CheckFunc(file.Close)
+
+	t.Run("it should read across blocks and report the end", func(t0 *testing.T) {
+		p := make([]byte, 3000)
+		offset := int64(2*BLOCK_SIZE_UNENCRYPTED - 1000)
+		if n, err := file.ReadAt(p, offset); n != 2000 || err != io.EOF || !bytes.Equal(p[:n], content[offset:]) {
+			t0.Errorf("unexpected read: %d %v", n, err)
+		}
+		if n, err := file.ReadAt(p, int64(len(content))); n != 0 || err != io.EOF {
+			t0.Errorf("expected EOF, got %d %v", n, err)
+		}
+		if _, err := file.ReadAt(p, -1); err == nil {
+			t0.Errorf("expected an error for a negative offset")
+		}
+	})
+
+	t.Run("it should read concurrently without touching the position", func(t0 *testing.T) {
+		Try(file.Seek(10, io.SeekStart))
+		var wg sync.WaitGroup
+		for range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				p := make([]byte, 100_000)
+				for range 20 {
+					offset := rand.Int64N(int64(len(content) - len(p)))
+					if n, err := file.ReadAt(p, offset); err != nil || !bytes.Equal(p[:n], content[offset:offset+int64(n)]) {
+						t0.Errorf("unexpected read at %d: %d %v", offset, n, err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		rest := Try(io.ReadAll(file))
+		if !bytes.Equal(rest, content[10:]) {
+			t0.Errorf("unexpected content after concurrent reads")
+		}
+	})
+}
+
+func TestCryFileHeader(t *testing.T) {
+
+	baseDir := "./www-test"
+	defer CheckFunc(func() error { return os.RemoveAll(baseDir) })
+	Check(os.MkdirAll(baseDir, 0700))
+
+	key := Try(makeAppKey()).deriveKey("test")
+	content := make([]byte, 2*BLOCK_SIZE_UNENCRYPTED+1000)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	fsPath := FsFilepath(filepath.Join(baseDir, "ab", "cdef"))
+
+	t.Run("it should open files without decrypting a block", func(t0 *testing.T) {
+		Check(WriteCryFile(fsPath, bytes.NewReader(content), int64(len(content)), key))
+		file := Try(NewCryFileReader(fsPath, key))
+		defer CheckFunc(file.Close)
+		sum := sha256.Sum256(content)
+		if file.datasize != int64(len(content)) || file.blockCache.index != -1 || !bytes.Equal(file.digest, sum[:]) {
+			t0.Errorf("unexpected header: %d %d %x", file.datasize, file.blockCache.index, file.digest)
+		}
+		if etag := Try(readETag(fsPath, key)); etag != file.etag {
+			t0.Errorf("unexpected etag: %s, expected %s", etag, file.etag)
+		}
+		if data := Try(io.ReadAll(file)); !bytes.Equal(data, content) {
+			t0.Errorf("unexpected content")
+		}
+	})
+
+	t.Run("it should detect a header of another version", func(t0 *testing.T) {
+		Check(WriteCryFile(fsPath, bytes.NewReader(content), int64(len(content)), key))
+		header := Try(os.ReadFile(string(fsPath)))[:CRY_HEADER_SIZE]
+		Check(WriteCryFile(fsPath, bytes.NewReader(content), int64(len(content)), key))
+		file := Try(os.OpenFile(string(fsPath), os.O_WRONLY, 0))
+		Try(file.WriteAt(header, 0))
+		Check(file.Close())
+		if _, err := NewCryFileReader(fsPath, key); err != errCorruptHeader {
+			t0.Errorf("expected a corrupt header, got %v", err)
+		}
+		Check(os.Truncate(string(fsPath), int64(CRY_HEADER_SIZE)+BLOCK_SIZE_ENCRYPTED))
+		if _, err := readETag(fsPath, key); err != errCorruptHeader {
+			t0.Errorf("expected a corrupt header, got %v", err)
+		}
+	})
+
+	t.Run("it should read files without header", func(t0 *testing.T) {
+		var ciphertext []byte
+		for i := 0; i < len(content); i += BLOCK_SIZE_UNENCRYPTED {
+			ciphertext = append(ciphertext, Try(key.encrypt(content[i:min(i+BLOCK_SIZE_UNENCRYPTED, len(content))]))...)
+		}
+		Check(os.WriteFile(string(fsPath), ciphertext, 0600))
+		file := Try(NewCryFileReader(fsPath, key))
+		defer CheckFunc(file.Close)
+		if file.datasize != int64(len(content)) || file.digest != nil {
+			t0.Errorf("unexpected length %d or digest %x", file.datasize, file.digest)
+		}
+		if etag := Try(readETag(fsPath, key)); etag != file.etag {
+			t0.Errorf("unexpected etag: %s, expected %s", etag, file.etag)
+		}
+		if data := Try(io.ReadAll(file)); !bytes.Equal(data, content) {
+			t0.Errorf("unexpected content")
+		}
+		if !belongsTo(fsPath, key) || Try(readCryHeaderSize(fsPath)) != 0 {
+			t0.Errorf("expected a file of the key without header")
+		}
+	})
+}
+
+func TestCryFileReadAhead(t *testing.T) {
+
+	baseDir := "./www-test"
+	defer CheckFunc(func() error { return os.RemoveAll(baseDir) })
+	Check(os.MkdirAll(baseDir, 0700))
+
+	key := Try(makeAppKey()).deriveKey("test")
+	content := make([]byte, 5*BLOCK_SIZE_UNENCRYPTED+1000)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	fsPath := FsFilepath(filepath.Join(baseDir, "ab", "cdef"))
+	Check(WriteCryFile(fsPath, bytes.NewReader(content), int64(len(content)), key))
+
+	t.Run("it should prefetch the following blocks", func(t0 *testing.T) {
+		file := Try(NewCryFileReader(fsPath, key))
+		defer CheckFunc(file.Close)
+		file.enableReadAhead(context.Background(), 2)
+
+		p := make([]byte, 1000)
+		Try(file.Read(p))
+		if len(file.readAhead.pending) != 2 || file.readAhead.pending[1] == nil || file.readAhead.pending[2] == nil {
+			t0.Errorf("unexpected pending blocks: %v", file.readAhead.pending)
+		}
+		// seeking drops the prefetched blocks outside of the new window
+		Try(file.Seek(4*BLOCK_SIZE_UNENCRYPTED, io.SeekStart))
+		Try(file.Read(p))
+		if len(file.readAhead.pending) != 1 || file.readAhead.pending[5] == nil {
+			t0.Errorf("unexpected pending blocks after seeking: %v", file.readAhead.pending)
+		}
+		Try(file.Seek(0, io.SeekStart))
+		if data := Try(io.ReadAll(file)); !bytes.Equal(data, content) {
+			t0.Errorf("unexpected content")
+		}
+	})
+
+	t.Run("it should stop when the context ends", func(t0 *testing.T) {
+		file := Try(NewCryFileReader(fsPath, key))
+		defer CheckFunc(file.Close)
+		ctx, cancel := context.WithCancel(context.Background())
+		file.enableReadAhead(ctx, 2)
+
+		p := make([]byte, BLOCK_SIZE_UNENCRYPTED)
+		Try(file.Read(p))
+		cancel()
+		if _, err := io.ReadAll(file); err != context.Canceled {
+			t0.Errorf("expected the read to be cancelled, got %v", err)
+		}
+	})
+
+	t.Run("it should release the pending blocks on close", func(t0 *testing.T) {
+		file := Try(NewCryFileReader(fsPath, key))
+		file.enableReadAhead(context.Background(), 2)
+
+		p := make([]byte, 1000)
+		Try(file.Read(p))
+		pending := []*pendingBlock{file.readAhead.pending[1], file.readAhead.pending[2]}
+		Check(file.Close())
+		for i, block := range pending {
+			select {
+			case <-block.done:
+			default:
+				t0.Errorf("block %d: expected the worker to be done after close", i+1)
+			}
+			if block.block != nil && block.block.refs.Load() != 0 {
+				t0.Errorf("block %d: expected the buffer to be released, got %d references", i+1, block.block.refs.Load())
+			}
+		}
+		if _, err := file.ReadAt(p, BLOCK_SIZE_UNENCRYPTED); err == nil {
+			t0.Errorf("expected reads after close to fail")
+		}
+	})
+}
+
+func TestWriteCryFilePipeline(t *testing.T) {
+
+	baseDir := "./www-test"
+	defer CheckFunc(func() error { return os.RemoveAll(baseDir) })
+	Check(os.MkdirAll(baseDir, 0700))
+
+	key := Try(makeAppKey()).deriveKey("test")
+	content := make([]byte, 6*BLOCK_SIZE_UNENCRYPTED+1)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	fsPath := FsFilepath(filepath.Join(baseDir, "ab", "cdef"))
+
+	t.Run("it should write the blocks in order", func(t0 *testing.T) {
+		for _, size := range []int64{int64(len(content)), -1} {
+			Check(WriteCryFile(fsPath, bytes.NewReader(content), size, key))
+			file := Try(NewCryFileReader(fsPath, key))
+			if data := Try(io.ReadAll(file)); !bytes.Equal(data, content) {
+				t0.Errorf("unexpected content for size %d", size)
+			}
+			Check(file.Close())
+		}
+	})
+
+	t.Run("it should abort on read errors", func(t0 *testing.T) {
+		failing := io.MultiReader(bytes.NewReader(content[:3*BLOCK_SIZE_UNENCRYPTED]), iotest.ErrReader(io.ErrClosedPipe))
+		if err := WriteCryFile(fsPath, failing, -1, key); err != io.ErrClosedPipe {
+			t0.Errorf("expected the read error, got %v", err)
+		}
+		if data := Try(io.ReadAll(Try(NewCryFileReader(fsPath, key)))); !bytes.Equal(data, content) {
+			t0.Errorf("expected the previous version to be kept")
+		}
+	})
+
+	t.Run("it should abort on write errors and oversized input", func(t0 *testing.T) {
+		if _, err := encryptBlocks(failingWriter{}, bytes.NewReader(content), -1, key); err != io.ErrShortWrite {
+			t0.Errorf("expected the write error, got %v", err)
+		}
+		if _, err := encryptBlocks(io.Discard, bytes.NewReader(content), 100, key); err == nil || err.Error() != "input exceeds announced size" {
+			t0.Errorf("expected oversized input to be rejected, got %v", err)
+		}
+	})
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, io.ErrShortWrite
+}
+
+func BenchmarkWriteCryFile(b *testing.B) {
+	baseDir := "./www-test"
+	defer CheckFunc(func() error { return os.RemoveAll(baseDir) })
+	Check(os.MkdirAll(baseDir, 0700))
+
+	key := Try(makeAppKey()).deriveKey("test")
+	content := make([]byte, 16*BLOCK_SIZE_UNENCRYPTED)
+	fsPath := FsFilepath(filepath.Join(baseDir, "ab", "cdef"))
+	defer func(inFlight int) { encryptInFlightBlocks = inFlight }(encryptInFlightBlocks)
+
+	for _, inFlight := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("in-flight=%d", inFlight), func(b *testing.B) {
+			encryptInFlightBlocks = inFlight
+			b.SetBytes(int64(len(content)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				Check(WriteCryFile(fsPath, bytes.NewReader(content), int64(len(content)), key))
+			}
+		})
+	}
+}
+
+// BenchmarkCryFileDownload reads files concurrently with the shared cache disabled, so every block is decrypted
+func BenchmarkCryFileDownload(b *testing.B) {
+	baseDir := "./www-test"
+	defer CheckFunc(func() error { return os.RemoveAll(baseDir) })
+	Check(os.MkdirAll(baseDir, 0700))
+
+	key := Try(makeAppKey()).deriveKey("test")
+	content := make([]byte, 8*BLOCK_SIZE_UNENCRYPTED)
+	fsPath := FsFilepath(filepath.Join(baseDir, "ab", "cdef"))
+	Check(WriteCryFile(fsPath, bytes.NewReader(content), int64(len(content)), key))
+
+	b.SetBytes(int64(len(content)))
+	b.ReportAllocs()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	b.RunParallel(func(pb *testing.PB) {
+		p := make([]byte, 32*1024)
+		for pb.Next() {
+			file := Try(NewCryFileReader(fsPath, key))
+			for _, err := file.Read(p); err != io.EOF; _, err = file.Read(p) {
+				Check(err)
+			}
+			Check(file.Close())
+		}
+	})
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.NumGC-before.NumGC)/float64(b.N), "gc/op")
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"sort"
 	"sync"
 	"time"
 )
@@ -77,3 +78,18 @@ func (filepath FsFilepath) WriteUnlock(l *FileLock) {
 	l.Unlock()
 	fileLocker.release(filepath)
 }
+
+// WriteLockAll locks multiple files at once. the locks are always acquired in the same order to prevent deadlocks
+func WriteLockAll(filepaths ...FsFilepath) (unlock func()) {
+	sorted := append([]FsFilepath{}, filepaths...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	locks := make([]*FileLock, len(sorted))
+	for i, filepath := range sorted {
+		locks[i] = filepath.WriteLock()
+	}
+	return func() {
+		for i := len(sorted) - 1; i >= 0; i-- {
+			sorted[i].WriteUnlock(locks[i])
+		}
+	}
+}
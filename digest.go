@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var errInvalidDigest = errors.New("invalid digest header")
+
+// parseDigestHeader reads the dictionary of Content-Digest and Repr-Digest (RFC 9530), e.g. "sha-256=:BASE64:, sha-512=:BASE64:"
+func parseDigestHeader(value string) (map[string][]byte, error) {
+	digests := map[string][]byte{}
+	for _, member := range strings.Split(value, ",") {
+		algorithm, encoded, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok || len(encoded) < 2 || !strings.HasPrefix(encoded, ":") || !strings.HasSuffix(encoded, ":") {
+			return nil, errInvalidDigest
+		}
+		digest, err := base64.StdEncoding.DecodeString(encoded[1 : len(encoded)-1])
+		if err != nil {
+			return nil, errInvalidDigest
+		}
+		digests[strings.ToLower(algorithm)] = digest
+	}
+	return digests, nil
+}
+
+// verifyingReader checks the content against the digest headers given by name. unsupported algorithms are ignored,
+// a mismatch fails the last read with ErrDigestMismatch
+func verifyingReader(reader io.Reader, header http.Header, names ...string) (io.Reader, error) {
+	for _, name := range names {
+		value := header.Get(name)
+		if value == "" {
+			continue
+		}
+		var checksum hash.Hash
+		var expected []byte
+		if http.CanonicalHeaderKey(name) == "Content-Md5" {
+			digest, err := base64.StdEncoding.DecodeString(value)
+			if err != nil || len(digest) != md5.Size {
+				return nil, errInvalidDigest
+			}
+			checksum, expected = md5.New(), digest
+		} else {
+			digests, err := parseDigestHeader(value)
+			if err != nil {
+				return nil, err
+			}
+			digest, ok := digests["sha-256"]
+			if !ok {
+				continue
+			}
+			checksum, expected = sha256.New(), digest
+		}
+		reader = &HashVerifyingReader{reader: reader, hash: checksum, expected: expected}
+	}
+	return reader, nil
+}
+
+func formatDigest(sum []byte) string {
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+}
+
+// reprDigest returns the Repr-Digest of a file from its header, files written before the header existed have none
+func (f *CryFileReader) reprDigest() string {
+	if f.digest == nil {
+		return ""
+	}
+	return formatDigest(f.digest)
+}
+
+func isDigestError(err error) bool {
+	return errors.Is(err, ErrDigestMismatch) || errors.Is(err, errInvalidDigest)
+}
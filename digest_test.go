@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"testing"
+)
+
+func uploadFileWithDigest(app *AppData, urlPath string, content string, partHeaders map[string]string, headers map[string]func(body []byte) string) *httptest.ResponseRecorder {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="file"; filename="upload"`)
+	for key, value := range partHeaders {
+		header.Set(key, value)
+	}
+	part := Try(writer.CreatePart(header))
+	Try(part.Write([]byte(content)))
+	Check(writer.Close())
+
+	r := httptest.NewRequest(http.MethodPut, urlPath, body)
+	r.Header.Add("Content-Type", writer.FormDataContentType())
+	for key, value := range headers {
+		r.Header.Set(key, value(body.Bytes()))
+	}
+	r.SetBasicAuth("user1", "passwordpassword")
+	w := httptest.NewRecorder()
+	app.handleRequest(w, r)
+	return w
+}
+
+func TestDigests(t *testing.T) {
+
+	t.Setenv("SECRET_KEY", "q38rcNPrHkxBonj16HTKG95zbq0bzmJ189C9A-EgTxg")
+	t.Setenv("OPEN_REGISTRATION", "true")
+	app := makeAppData()
+
+	app.webBaseDir = "./www-test"
+	defer CheckFunc(func() error { return os.RemoveAll(app.webBaseDir) })
+	Check(os.MkdirAll(app.webBaseDir, 0700))
+
+	sha := sha256.Sum256([]byte("content"))
+	md := md5.Sum([]byte("content"))
+
+	t.Run("it should verify digests of the file part", func(t0 *testing.T) {
+		if w := uploadFileWithDigest(&app, "/a.txt", "content", map[string]string{"Content-Digest": formatDigest(sha[:])}, nil); w.Code != http.StatusNoContent {
+			t0.Errorf("expected 204, got %v %s", w.Code, w.Body.String())
+		}
+		if w := uploadFileWithDigest(&app, "/b.txt", "truncated", map[string]string{"Content-MD5": base64.StdEncoding.EncodeToString(md[:])}, nil); w.Code != http.StatusBadRequest {
+			t0.Errorf("expected 400, got %v", w.Code)
+		}
+		if w := sendRequest(&app, http.MethodGet, "/b.txt", nil); w.Code != http.StatusNotFound {
+			t0.Errorf("expected the failed upload not to be stored, got %v", w.Code)
+		}
+		if w := uploadFileWithDigest(&app, "/b.txt", "content", map[string]string{"Repr-Digest": "sha-256=invalid"}, nil); w.Code != http.StatusBadRequest {
+			t0.Errorf("expected 400 for an invalid header, got %v", w.Code)
+		}
+	})
+
+	t.Run("it should return the stored digest", func(t0 *testing.T) {
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			if w := sendRequest(&app, method, "/a.txt", nil); w.Header().Get("Repr-Digest") != formatDigest(sha[:]) {
+				t0.Errorf("unexpected digest for %s: %q", method, w.Header().Get("Repr-Digest"))
+			}
+		}
+		// every write records the digest in the file header
+		auth := &AuthData{username: "user1", userSalt: makeUserSalt(app.appKey, "user1")}
+		auth.userKey = Password("passwordpassword").hash(auth.userSalt)
+		drive := app.userDrive(auth)
+		Check(WriteCryFile(drive.locate("/a.txt"), bytes.NewReader([]byte("other")), 5, drive.key))
+		other := sha256.Sum256([]byte("other"))
+		if w := sendRequest(&app, http.MethodGet, "/a.txt", nil); w.Header().Get("Repr-Digest") != formatDigest(other[:]) {
+			t0.Errorf("unexpected digest for another version: %q", w.Header().Get("Repr-Digest"))
+		}
+	})
+
+	t.Run("it should verify digests of the request body", func(t0 *testing.T) {
+		bodyDigest := func(body []byte) string {
+			sum := sha256.Sum256(body)
+			return formatDigest(sum[:])
+		}
+		if w := uploadFileWithDigest(&app, "/c.txt", "content", nil, map[string]func([]byte) string{"Content-Digest": bodyDigest}); w.Code != http.StatusNoContent {
+			t0.Errorf("expected 204, got %v %s", w.Code, w.Body.String())
+		}
+		wrongDigest := func(body []byte) string { return formatDigest(sha[:]) }
+		if w := uploadFileWithDigest(&app, "/c.txt", "content", nil, map[string]func([]byte) string{"Content-Digest": wrongDigest}); w.Code != http.StatusBadRequest {
+			t0.Errorf("expected 400, got %v", w.Code)
+		}
+	})
+
+	t.Run("it should verify digests via WebDAV", func(t0 *testing.T) {
+		if w := sendDavRequest(&app, http.MethodPut, "/d.txt", "conten", map[string]string{"Repr-Digest": formatDigest(sha[:])}); w.Code != http.StatusBadRequest {
+			t0.Errorf("expected 400, got %v", w.Code)
+		}
+		sendDavRequest(&app, http.MethodPut, "/d.txt", "content", nil)
+		if w := sendDavRequest(&app, http.MethodGet, "/d.txt", "", nil); w.Header().Get("Repr-Digest") != formatDigest(sha[:]) {
+			t0.Errorf("unexpected digest: %q", w.Header().Get("Repr-Digest"))
+		}
+	})
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const DROP_PREFIX = SYSTEM_PATH_PREFIX + "/drop"
+const KEYPAIR_CRYPATH = "keypair:" // private key of a user, stored in the drive of the user
+const DROP_DEFAULT_LIFETIME = 30 * 24 * time.Hour
+const DROP_FORM_OVERHEAD = 1 << 20 // room for the multipart headers of an upload
+
+var errDropLimit = errors.New("upload limit of the link reached")
+
+// DropRecord describes a drop box link. it contains no user key, so uploads can only be encrypted to the public key of the owner
+type DropRecord struct {
+	Username    Username        `json:"username"`
+	Fingerprint UserFingerprint `json:"fingerprint"` // locates the inbox of the owner
+	PublicKey   []byte          `json:"publicKey"`
+	Dir         string          `json:"dir"`
+	Created     time.Time       `json:"created"`
+	Expires     time.Time       `json:"expires"`
+	Files       int             `json:"files"` // uploads so far, limited by DROP_MAX_FILES
+	Bytes       int64           `json:"bytes"` // limited by DROP_MAX_SIZE
+}
+
+type DropInfo struct {
+	Link    string    `json:"link"`
+	Dir     string    `json:"dir"`
+	Expires time.Time `json:"expires"`
+}
+
+// DropUpload is an entry of the inbox of a user. the file key is derived from the ephemeral key and the private key of the owner
+type DropUpload struct {
+	ID           string `json:"id"`
+	EphemeralKey []byte `json:"ephemeralKey"`
+}
+
+// DropMeta is stored next to the content of an upload, encrypted with the same file key
+type DropMeta struct {
+	Dir  string `json:"dir"`
+	Name string `json:"name"`
+}
+
+const DROP_FORM_HTML = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width"><title>Upload files</title></head>
+<body>
+<form method="post" enctype="multipart/form-data">
+<input type="file" name="file" multiple required>
+<button type="submit">Upload</button>
+</form>
+</body>
+</html>
+`
+
+// keyPair loads the X25519 key of a user and creates it on first use
+func (drive *CryDrive) keyPair() (*ecdh.PrivateKey, error) {
+	fsPath := drive.locate(KEYPAIR_CRYPATH)
+	defer lockMetadata(fsPath)()
+
+	lock := fsPath.ReadLock()
+	file, err := NewCryFileReader(fsPath, drive.key)
+	fsPath.ReadUnlock(lock)
+	if err == nil {
+		defer IgnoreErrFunc(file.Close)
+		data, err := io.ReadAll(file)
+		if err != nil {
+			return nil, err
+		}
+		return ecdh.X25519().NewPrivateKey(data)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	data := privateKey.Bytes()
+	return privateKey, WriteCryFile(fsPath, bytes.NewReader(data), int64(len(data)), drive.key)
+}
+
+// dropLocations hides records and pending uploads in the storage. the server can find them, but can't decrypt their content
+func (app *AppData) dropLocations() *CryDrive {
+	return &CryDrive{baseDir: app.webBaseDir, key: app.appKey.deriveKey("drop-box")}
+}
+
+func (app *AppData) dropRecordFilepath(id []byte) FsFilepath {
+	return app.dropLocations().locate(CryPath("drop:" + strEncode(id)))
+}
+
+// the inbox index only holds random ids and ephemeral public keys, so it is encrypted with a server key
+func (app *AppData) dropInboxFilepath(fingerprint UserFingerprint) FsFilepath {
+	return app.dropLocations().locate(CryPath("inbox:" + strEncode(fingerprint)))
+}
+
+func (app *AppData) readDropInbox(fingerprint UserFingerprint) ([]DropUpload, error) {
+	uploads := []DropUpload{}
+	err := readLinkRecord(app.dropInboxFilepath(fingerprint), app.appKey.deriveKey("drop-inbox"), &uploads)
+	if errors.Is(err, os.ErrNotExist) {
+		return []DropUpload{}, nil
+	}
+	return uploads, err
+}
+
+func (app *AppData) writeDropInbox(fingerprint UserFingerprint, uploads []DropUpload) error {
+	fsPath := app.dropInboxFilepath(fingerprint)
+	if len(uploads) == 0 {
+		lock := fsPath.WriteLock()
+		defer fsPath.WriteUnlock(lock)
+		return IgnoreNotExist(os.Remove(string(fsPath)))
+	}
+	return writeLinkRecord(fsPath, uploads, app.appKey.deriveKey("drop-inbox"))
+}
+
+func (app *AppData) createDrop(auth *AuthData, dir string, expires time.Time) (token string, record *DropRecord, err error) {
+	drive := app.userDrive(auth)
+	privateKey, err := drive.keyPair()
+	if err != nil {
+		return "", nil, err
+	}
+	if err := drive.mkdir(dir); err != nil {
+		return "", nil, err
+	}
+	token, id, linkKey, err := newLinkToken()
+	if err != nil {
+		return "", nil, err
+	}
+	record = &DropRecord{
+		Username:    auth.username,
+		Fingerprint: auth.userKey.hash(auth.userSalt),
+		PublicKey:   privateKey.PublicKey().Bytes(),
+		Dir:         dir,
+		Created:     time.Now().UTC().Truncate(time.Second),
+		Expires:     expires.UTC().Truncate(time.Second),
+	}
+	return token, record, writeLinkRecord(app.dropRecordFilepath(id), record, linkKey)
+}
+
+// readDrop decrypts the record of a token. unknown, invalid and expired tokens are reported as not existing
+func (app *AppData) readDrop(token string) (*DropRecord, error) {
+	id, linkKey, err := parseLinkToken(token)
+	if err != nil {
+		return nil, err
+	}
+	record := new(DropRecord)
+	if err := readLinkRecord(app.dropRecordFilepath(id), linkKey, record); err != nil {
+		return nil, err
+	}
+	if time.Now().After(record.Expires) {
+		IgnoreErrFunc(func() error { return app.removeDrop(id) })
+		return nil, os.ErrNotExist
+	}
+	return record, nil
+}
+
+func (app *AppData) removeDrop(id []byte) error {
+	fsPath := app.dropRecordFilepath(id)
+	lock := fsPath.WriteLock()
+	defer fsPath.WriteUnlock(lock)
+	return os.Remove(string(fsPath))
+}
+
+// reserveDrop counts uploads against the limits of the link before they are stored, so concurrent uploads can't exceed them
+func (app *AppData) reserveDrop(token string, files int, size int64) error {
+	id, linkKey, err := parseLinkToken(token)
+	if err != nil {
+		return err
+	}
+	fsPath := app.dropRecordFilepath(id)
+	defer lockMetadata(fsPath)()
+
+	record, err := app.readDrop(token)
+	if err != nil {
+		return err
+	}
+	if record.Files+files > app.dropMaxFiles || record.Bytes+size > app.dropMaxSize {
+		return errDropLimit
+	}
+	record.Files += files
+	record.Bytes += size
+	return writeLinkRecord(fsPath, record, linkKey)
+}
+
+func (app *AppData) writeDropLimitError(w http.ResponseWriter) {
+	http.Error(w, fmt.Sprintf("%s (max %d files, max %d bytes)", errDropLimit.Error(), app.dropMaxFiles, app.dropMaxSize), http.StatusRequestEntityTooLarge)
+}
+
+// dropFile encrypts an upload to the public key of the owner and registers it in the inbox
+func (app *AppData) dropFile(record *DropRecord, name string, file io.Reader, size int64) error {
+	ephemeralKey, fileKey, err := sealKeyTo(record.PublicKey, "drop-box")
+	if err != nil {
+		return err
+	}
+
+	id := make([]byte, LINK_ID_LENGTH)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	upload := DropUpload{ID: strEncode(id), EphemeralKey: ephemeralKey}
+	locations := app.dropLocations()
+	if err := WriteCryFile(locations.locate(CryPath("dropfile:"+upload.ID)), file, size, fileKey); err != nil {
+		return err
+	}
+	if err := writeLinkRecord(locations.locate(CryPath("dropmeta:"+upload.ID)), DropMeta{Dir: record.Dir, Name: name}, fileKey); err != nil {
+		return err
+	}
+
+	inbox := app.dropInboxFilepath(record.Fingerprint)
+	defer lockMetadata(inbox)()
+	uploads, err := app.readDropInbox(record.Fingerprint)
+	if err != nil {
+		return err
+	}
+	return app.writeDropInbox(record.Fingerprint, append(uploads, upload))
+}
+
+// availableName appends a counter to the name, so existing files are never overwritten by uploads
+func (drive *CryDrive) availableName(dir string, name string) (string, error) {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		urlPath := path.Join(dir, name)
+		if ok, err := drive.exists(urlPath); err != nil || !ok {
+			return urlPath, err
+		}
+		name = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+}
+
+// importDropBox moves the pending uploads of a user into the drive, re-encrypted with the user key
+func (app *AppData) importDropBox(auth *AuthData) error {
+	fingerprint := auth.userKey.hash(auth.userSalt)
+	inbox := app.dropInboxFilepath(fingerprint)
+	if ok, err := IsFile(string(inbox)); err != nil || !ok {
+		return err
+	}
+	defer lockMetadata(inbox)()
+	uploads, err := app.readDropInbox(fingerprint)
+	if err != nil || len(uploads) == 0 {
+		return err
+	}
+
+	drive := app.userDrive(auth)
+	privateKey, err := drive.keyPair()
+	if err != nil {
+		return err
+	}
+	locations := app.dropLocations()
+	pending := []DropUpload{}
+	for _, upload := range uploads {
+		if err := app.importDrop(drive, privateKey, locations, upload); err != nil {
+			log.Println("drop box import failed:", sanitizeError(err))
+			pending = append(pending, upload)
+		}
+	}
+	return app.writeDropInbox(fingerprint, pending)
+}
+
+func (app *AppData) importDrop(drive *CryDrive, privateKey *ecdh.PrivateKey, locations *CryDrive, upload DropUpload) error {
+	fileKey, err := openSealedKey(privateKey, upload.EphemeralKey, "drop-box")
+	if err != nil {
+		return err
+	}
+
+	var meta DropMeta
+	metaPath := locations.locate(CryPath("dropmeta:" + upload.ID))
+	if err := readLinkRecord(metaPath, fileKey, &meta); err != nil {
+		return err
+	}
+	contentPath := locations.locate(CryPath("dropfile:" + upload.ID))
+	content, err := NewCryFileReader(contentPath, fileKey)
+	if err != nil {
+		return err
+	}
+	defer IgnoreErrFunc(content.Close)
+
+	if err := drive.mkdir(meta.Dir); err != nil {
+		return err
+	}
+	urlPath, err := drive.availableName(meta.Dir, meta.Name)
+	if err != nil {
+		return err
+	}
+	if err := WriteCryFile(drive.locate(CryPath(urlPath)), content, content.datasize, drive.key); err != nil {
+		return err
+	}
+	if err := drive.link(urlPath, false); err != nil {
+		return err
+	}
+	return errors.Join(os.Remove(string(contentPath)), os.Remove(string(metaPath)))
+}
+
+func dropFileName(header *multipart.FileHeader) (string, error) {
+	name := path.Base(path.Clean("/" + strings.ReplaceAll(header.Filename, "\\", "/")))
+	if name == "/" || name == SYSTEM_PATH_PREFIX[1:] {
+		return "", fmt.Errorf("invalid filename %q", header.Filename)
+	}
+	return name, nil
+}
+
+// handleDrop manages drop box links of the owner (POST, DELETE) and accepts uploads from everyone with the link (GET form, POST)
+func (app *AppData) handleDrop(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, DROP_PREFIX), "/")
+
+	switch {
+	case r.Method == "POST" && token == "":
+		auth := app.handleAuth(w, r)
+		if auth == nil {
+			// handleAuth has already set the http response
+			return
+		}
+		dir := path.Clean("/" + r.FormValue("path"))
+		if isReservedPath(dir) {
+			http.Error(w, "path is reserved", http.StatusBadRequest)
+			return
+		}
+		expires := time.Now().Add(DROP_DEFAULT_LIFETIME)
+		if value := r.FormValue("expires"); value != "" {
+			lifetime, err := time.ParseDuration(value)
+			if err != nil || lifetime <= 0 {
+				http.Error(w, "invalid expires duration", http.StatusBadRequest)
+				return
+			}
+			expires = time.Now().Add(lifetime)
+		}
+		if ok, err := app.userDrive(auth).isFile(dir); err != nil {
+			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+			return
+		} else if ok {
+			http.Error(w, "path is a file", http.StatusConflict)
+			return
+		}
+
+		token, record, err := app.createDrop(auth, dir, expires)
+		if err != nil {
+			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+			return
+		}
+		link := DROP_PREFIX + "/" + token
+		w.Header().Set("Location", link)
+		writeJSON(w, http.StatusCreated, DropInfo{Link: link, Dir: record.Dir, Expires: record.Expires})
+
+	case token == "":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+	case r.Method == "GET" || r.Method == "HEAD":
+		if _, err := app.readDrop(token); err != nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("X-Robots-Tag", "noindex")
+		_, _ = io.WriteString(w, DROP_FORM_HTML)
+
+	case r.Method == "POST":
+		record, err := app.readDrop(token)
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, max(0, app.dropMaxSize-record.Bytes)+DROP_FORM_OVERHEAD)
+		if err := r.ParseMultipartForm(32 << 20); err != nil { // read first 32MiB into memory and spool to disk on overflow
+			var maxBytesError *http.MaxBytesError
+			if errors.As(err, &maxBytesError) {
+				app.writeDropLimitError(w)
+				return
+			}
+			http.Error(w, sanitizeError(err), http.StatusBadRequest)
+			return
+		}
+		headers := r.MultipartForm.File["file"]
+		if len(headers) == 0 {
+			http.Error(w, "no file uploaded", http.StatusBadRequest)
+			return
+		}
+		size := int64(0)
+		for _, header := range headers {
+			size += header.Size
+		}
+		if err := app.reserveDrop(token, len(headers), size); errors.Is(err, errDropLimit) {
+			app.writeDropLimitError(w)
+			return
+		} else if errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+			return
+		}
+		for _, header := range headers {
+			name, err := dropFileName(header)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			file, err := header.Open()
+			if err != nil {
+				http.Error(w, sanitizeError(err), http.StatusBadRequest)
+				return
+			}
+			err = app.dropFile(record, name, file, header.Size)
+			IgnoreErrFunc(file.Close)
+			if err != nil {
+				http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+				return
+			}
+		}
+		writeJSON(w, http.StatusCreated, map[string]int{"files": len(headers)})
+
+	case r.Method == "DELETE":
+		auth := app.handleAuth(w, r)
+		if auth == nil {
+			// handleAuth has already set the http response
+			return
+		}
+		record, err := app.readDrop(token)
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+			return
+		}
+		if record.Username != auth.username {
+			http.Error(w, "not found", http.StatusNotFound) // only the owner may revoke a link
+			return
+		}
+		// the owner is the only one who can open the private key of the link
+		privateKey, err := app.userDrive(auth).keyPair()
+		if err != nil {
+			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+			return
+		}
+		if !bytes.Equal(privateKey.PublicKey().Bytes(), record.PublicKey) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		id, _, _ := parseLinkToken(token)
+		if err := IgnoreNotExist(app.removeDrop(id)); err != nil {
+			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
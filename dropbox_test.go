@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func sendDropRequest(app *AppData, method string, target string, form url.Values, user string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if user != "" {
+		r.SetBasicAuth(user, "passwordpassword")
+	}
+	w := httptest.NewRecorder()
+	app.handleDrop(w, r)
+	return w
+}
+
+func dropFiles(app *AppData, link string, files map[string]string) *httptest.ResponseRecorder {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	for name, content := range files {
+		Try(Try(writer.CreateFormFile("file", name)).Write([]byte(content)))
+	}
+	Check(writer.Close())
+	r := httptest.NewRequest(http.MethodPost, link, body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	w := httptest.NewRecorder()
+	app.handleDrop(w, r)
+	return w
+}
+
+func TestDropBox(t *testing.T) {
+
+	t.Setenv("SECRET_KEY", "q38rcNPrHkxBonj16HTKG95zbq0bzmJ189C9A-EgTxg")
+	t.Setenv("OPEN_REGISTRATION", "true")
+	app := makeAppData()
+
+	app.webBaseDir = "./www-test"
+	defer CheckFunc(func() error { return os.RemoveAll(app.webBaseDir) })
+	defer app.dropImports.Wait() // logins import uploads in the background
+	Check(os.MkdirAll(app.webBaseDir, 0700))
+
+	uploadFile(&app, http.MethodPost, "/inbox/a.txt", "existing")
+	w := sendDropRequest(&app, http.MethodPost, DROP_PREFIX, url.Values{"path": {"/inbox"}}, "user1")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %v %s", w.Code, w.Body.String())
+	}
+	var info DropInfo
+	Check(json.Unmarshal(w.Body.Bytes(), &info))
+	app.dropImports.Wait()
+
+	t.Run("it should accept uploads without read access", func(t0 *testing.T) {
+		if w := sendDropRequest(&app, http.MethodGet, info.Link, nil, ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<form") {
+			t0.Errorf("unexpected form: %v", w.Code)
+		}
+		if w := dropFiles(&app, info.Link, map[string]string{"a.txt": "dropped a", "../b.txt": "dropped b"}); w.Code != http.StatusCreated {
+			t0.Fatalf("expected 201, got %v %s", w.Code, w.Body.String())
+		}
+		// nothing of the upload can be read by the server with the app key alone
+		auth := &AuthData{userSalt: makeUserSalt(app.appKey, "user1")}
+		auth.userKey = Password("passwordpassword").hash(auth.userSalt)
+		uploads := Try(app.readDropInbox(auth.userKey.hash(auth.userSalt)))
+		if len(uploads) != 2 || belongsTo(app.dropLocations().locate(CryPath("dropfile:"+uploads[0].ID)), auth.userKey) {
+			t0.Errorf("unexpected inbox: %v", uploads)
+		}
+	})
+
+	t.Run("it should import uploads on the next login of the owner", func(t0 *testing.T) {
+		auth := &AuthData{userSalt: makeUserSalt(app.appKey, "user1")}
+		auth.userKey = Password("passwordpassword").hash(auth.userSalt)
+		inbox := app.dropInboxFilepath(auth.userKey.hash(auth.userSalt))
+		sendRequest(&app, http.MethodGet, "/", nil)
+		app.dropImports.Wait() // imported in the background
+		if ok := Try(IsFile(string(inbox))); ok {
+			t0.Errorf("inbox should be empty")
+		}
+		for name, content := range map[string]string{"/inbox/a.txt": "existing", "/inbox/a%20(1).txt": "dropped a", "/inbox/b.txt": "dropped b"} {
+			if w := sendRequest(&app, http.MethodGet, name, nil); w.Body.String() != content {
+				t0.Errorf("unexpected content of %s: %q", name, w.Body.String())
+			}
+		}
+	})
+
+	t.Run("it should limit the uploads of a link", func(t0 *testing.T) {
+		defer func() { app.dropMaxFiles, app.dropMaxSize = 1000, 1<<30 }()
+		app.dropMaxFiles, app.dropMaxSize = 2, 10
+		w := sendDropRequest(&app, http.MethodPost, DROP_PREFIX, url.Values{"path": {"/limited"}}, "user1")
+		var limited DropInfo
+		Check(json.Unmarshal(w.Body.Bytes(), &limited))
+		if w := dropFiles(&app, limited.Link, map[string]string{"a.txt": "aaa", "b.txt": "bbb"}); w.Code != http.StatusCreated {
+			t0.Errorf("expected 201, got %v %s", w.Code, w.Body.String())
+		}
+		if w := dropFiles(&app, limited.Link, map[string]string{"c.txt": "ccc"}); w.Code != http.StatusRequestEntityTooLarge {
+			t0.Errorf("expected 413 for too many files, got %v", w.Code)
+		}
+		app.dropMaxFiles = 10
+		if w := dropFiles(&app, limited.Link, map[string]string{"c.txt": "ccccc"}); w.Code != http.StatusRequestEntityTooLarge {
+			t0.Errorf("expected 413 for too many bytes, got %v", w.Code)
+		}
+		if w := dropFiles(&app, limited.Link, map[string]string{"c.txt": strings.Repeat("c", 2*DROP_FORM_OVERHEAD)}); w.Code != http.StatusRequestEntityTooLarge {
+			t0.Errorf("expected 413 for a too large request, got %v", w.Code)
+		}
+		if w := dropFiles(&app, limited.Link, map[string]string{"c.txt": "cccc"}); w.Code != http.StatusCreated {
+			t0.Errorf("expected 201 within the limits, got %v %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("it should let only the owner revoke a link", func(t0 *testing.T) {
+		if w := sendDropRequest(&app, http.MethodDelete, info.Link, nil, "user2"); w.Code != http.StatusNotFound {
+			t0.Errorf("expected 404, got %v", w.Code)
+		}
+		if w := sendDropRequest(&app, http.MethodDelete, info.Link, nil, "user1"); w.Code != http.StatusNoContent {
+			t0.Errorf("expected 204, got %v", w.Code)
+		}
+		if w := dropFiles(&app, info.Link, map[string]string{"c.txt": "too late"}); w.Code != http.StatusNotFound {
+			t0.Errorf("expected 404, got %v", w.Code)
+		}
+	})
+}
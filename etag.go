@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// readETag reads only the header or the nonce of the last block, so the version of a file is known without decrypting its content
+func readETag(fsPath FsFilepath, userKey UserKey) (string, error) {
+	lock := fsPath.ReadLock()
+	defer fsPath.ReadUnlock(lock)
+	file, err := os.Open(string(fsPath))
+	if err != nil {
+		return "", err
+	}
+	defer IgnoreErrFunc(file.Close)
+	stat, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	if header, err := readCryHeader(file, stat.Size(), userKey); err != nil {
+		return "", err
+	} else if header != nil {
+		return userKey.etag(header.nonce), nil
+	}
+	if stat.Size() == 0 {
+		return userKey.etag(nil), nil
+	}
+	lastBlockIndex := (stat.Size() - 1) / BLOCK_SIZE_ENCRYPTED
+	nonce := make([]byte, NONCE_SIZE)
+	if _, err := file.ReadAt(nonce, lastBlockIndex*BLOCK_SIZE_ENCRYPTED); err != nil && err != io.EOF {
+		return "", err
+	}
+	return userKey.etag(nonce), nil
+}
+
+// matchETag checks a comma separated list of entity tags. If-Match compares strongly, so weak tags never match there
+func matchETag(header string, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func hasPreconditions(r *http.Request) bool {
+	return r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != ""
+}
+
+// checkPreconditions evaluates If-Match and If-None-Match of a write against the current version of a file.
+// "If-None-Match: *" only allows creating a new file
+func checkPreconditions(r *http.Request, fsPath FsFilepath, userKey UserKey) (bool, error) {
+	etag, err := readETag(fsPath, userKey)
+	exists := err == nil
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	if header := r.Header.Get("If-Match"); header != "" && (!exists || !matchETag(header, etag, false)) {
+		return false, nil
+	}
+	if header := r.Header.Get("If-None-Match"); header != "" && exists && matchETag(header, etag, true) {
+		return false, nil
+	}
+	return true, nil
+}
+
+// handlePreconditions answers failed preconditions with 412. the returned unlock keeps other writes of the file
+// waiting until the write is done, so no write can sneak in between the check and the write
+func handlePreconditions(w http.ResponseWriter, r *http.Request, fsPath FsFilepath, userKey UserKey) (unlock func(), ok bool) {
+	unlock = lockMetadata(fsPath)
+	if !hasPreconditions(r) {
+		return unlock, true
+	}
+	if ok, err := checkPreconditions(r, fsPath, userKey); err != nil {
+		unlock()
+		http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+		return nil, false
+	} else if !ok {
+		unlock()
+		http.Error(w, "precondition failed", http.StatusPreconditionFailed)
+		return nil, false
+	}
+	return unlock, true
+}
+
+// setETag announces the version of a file after a write
+func setETag(w http.ResponseWriter, fsPath FsFilepath, userKey UserKey) {
+	if etag, err := readETag(fsPath, userKey); err == nil {
+		w.Header().Set("ETag", etag)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func uploadFileIf(app *AppData, method string, urlPath string, content string, headers map[string]string) *httptest.ResponseRecorder {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	part := Try(writer.CreateFormFile("file", "upload"))
+	Try(part.Write([]byte(content)))
+	Check(writer.Close())
+
+	r := httptest.NewRequest(method, urlPath, body)
+	r.Header.Add("Content-Type", writer.FormDataContentType())
+	for key, value := range headers {
+		r.Header.Set(key, value)
+	}
+	r.SetBasicAuth("user1", "passwordpassword")
+	w := httptest.NewRecorder()
+	app.handleRequest(w, r)
+	return w
+}
+
+func TestETags(t *testing.T) {
+
+	t.Setenv("SECRET_KEY", "q38rcNPrHkxBonj16HTKG95zbq0bzmJ189C9A-EgTxg")
+	t.Setenv("OPEN_REGISTRATION", "true")
+	app := makeAppData()
+
+	app.webBaseDir = "./www-test"
+	defer CheckFunc(func() error { return os.RemoveAll(app.webBaseDir) })
+	Check(os.MkdirAll(app.webBaseDir, 0700))
+
+	t.Run("it should create files only once with If-None-Match", func(t0 *testing.T) {
+		w := uploadFileIf(&app, http.MethodPost, "/a.txt", "first", map[string]string{"If-None-Match": "*"})
+		if w.Code != http.StatusCreated || w.Header().Get("ETag") == "" {
+			t0.Errorf("expected 201 with ETag, got %v %v", w.Code, w.Header())
+		}
+		if w := uploadFileIf(&app, http.MethodPost, "/a.txt", "second", map[string]string{"If-None-Match": "*"}); w.Code != http.StatusPreconditionFailed {
+			t0.Errorf("expected 412, got %v", w.Code)
+		}
+		if w := sendRequest(&app, http.MethodGet, "/a.txt", nil); w.Body.String() != "first" {
+			t0.Errorf("unexpected content: %q", w.Body.String())
+		}
+	})
+
+	t.Run("it should reject writes based on an outdated version", func(t0 *testing.T) {
+		etag := sendRequest(&app, http.MethodGet, "/a.txt", nil).Header().Get("ETag")
+		if w := sendRequest(&app, http.MethodGet, "/a.txt", map[string]string{"If-None-Match": etag}); w.Code != http.StatusNotModified {
+			t0.Errorf("expected 304, got %v", w.Code)
+		}
+		w := uploadFileIf(&app, http.MethodPut, "/a.txt", "first tab", map[string]string{"If-Match": etag})
+		if w.Code != http.StatusNoContent || w.Header().Get("ETag") == etag {
+			t0.Errorf("expected 204 with a new ETag, got %v %v", w.Code, w.Header())
+		}
+		if w := uploadFileIf(&app, http.MethodPut, "/a.txt", "second tab", map[string]string{"If-Match": etag}); w.Code != http.StatusPreconditionFailed {
+			t0.Errorf("expected 412, got %v", w.Code)
+		}
+		if w := sendRequest(&app, http.MethodDelete, "/a.txt", map[string]string{"If-Match": etag}); w.Code != http.StatusPreconditionFailed {
+			t0.Errorf("expected 412, got %v", w.Code)
+		}
+		if w := sendRequest(&app, http.MethodDelete, "/a.txt", map[string]string{"If-Match": w.Header().Get("ETag")}); w.Code != http.StatusNoContent {
+			t0.Errorf("expected 204, got %v", w.Code)
+		}
+		if w := uploadFileIf(&app, http.MethodPut, "/a.txt", "again", map[string]string{"If-Match": "*"}); w.Code != http.StatusPreconditionFailed {
+			t0.Errorf("expected 412 for a missing file, got %v", w.Code)
+		}
+	})
+
+	t.Run("it should tell the version via WebDAV", func(t0 *testing.T) {
+		uploadFile(&app, http.MethodPost, "/b.txt", "content")
+		etag := sendRequest(&app, http.MethodGet, "/b.txt", nil).Header().Get("ETag")
+		if w := sendDavRequest(&app, http.MethodPut, "/b.txt", "other", map[string]string{"If-Match": `"outdated"`}); w.Code != http.StatusPreconditionFailed {
+			t0.Errorf("expected 412, got %v", w.Code)
+		}
+		if w := sendDavRequest(&app, "PROPFIND", "/b.txt", "", map[string]string{"Depth": "0"}); !bytes.Contains(w.Body.Bytes(), []byte(xmlEscape(etag))) {
+			t0.Errorf("expected getetag in %s", w.Body.String())
+		}
+	})
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+)
+
+type ArchiveEntry struct {
+	name   string
+	isDir  bool
+	isFile bool
+	size   int64
+	open   func() (io.ReadCloser, error) // the reader is closed after the entry
+}
+
+type ExtractSummary struct {
+	Files       int            `json:"files"`
+	Directories int            `json:"directories"`
+	Bytes       int64          `json:"bytes"`
+	Skipped     []SkippedEntry `json:"skipped"`
+	Error       string         `json:"error,omitempty"`
+	status      int
+}
+
+type SkippedEntry struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+var errExtractLimit = errors.New("archive exceeds the extraction limits")
+
+func detectArchiveFormat(file io.ReaderAt) string {
+	header := make([]byte, 512)
+	n, _ := file.ReadAt(header, 0)
+	header = header[:n]
+	switch {
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")) || bytes.HasPrefix(header, []byte("PK\x05\x06")):
+		return "zip"
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return "tar.gz"
+	case len(header) >= 262 && string(header[257:262]) == "ustar":
+		return "tar"
+	}
+	return ""
+}
+
+func walkArchive(format string, file multipart.File, size int64, visit func(entry ArchiveEntry) error) error {
+	if format == "zip" {
+		archive, err := zip.NewReader(file, size)
+		if err != nil {
+			return err
+		}
+		for _, f := range archive.File {
+			entry := ArchiveEntry{
+				name:   f.Name,
+				isDir:  f.Mode().IsDir(),
+				isFile: f.Mode().IsRegular(),
+				size:   int64(f.UncompressedSize64),
+				open:   f.Open,
+			}
+			if err := visit(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var reader io.Reader = file
+	if format == "tar.gz" {
+		decompressor, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer IgnoreErrFunc(decompressor.Close)
+		reader = decompressor
+	}
+	archive := tar.NewReader(reader)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		entry := ArchiveEntry{
+			name:   header.Name,
+			isDir:  header.Typeflag == tar.TypeDir,
+			isFile: header.Typeflag == tar.TypeReg,
+			size:   header.Size,
+			open:   func() (io.ReadCloser, error) { return io.NopCloser(archive), nil },
+		}
+		if err := visit(entry); err != nil {
+			return err
+		}
+	}
+}
+
+// archiveEntryPath maps an archive entry to a drive path below dir. only entries inside of subdir are extracted
+func archiveEntryPath(dir string, subdir string, name string) (string, string) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(name, "/") {
+		return "", "absolute path"
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." {
+			return "", "path traversal"
+		}
+	}
+	name = path.Clean("/" + name)
+	if subdir != "/" {
+		if !strings.HasPrefix(name, subdir+"/") {
+			return "", ""
+		}
+		name = strings.TrimPrefix(name, subdir)
+	}
+	if name == "/" {
+		return "", ""
+	}
+	urlPath := path.Join(dir, name)
+	if isReservedPath(urlPath) {
+		return "", "reserved path"
+	}
+	return urlPath, ""
+}
+
+// extractArchive unpacks every entry of an uploaded archive into dir as individual encrypted files
+func (app *AppData) extractArchive(drive *CryDrive, dir string, subdir string, file multipart.File, size int64) *ExtractSummary {
+	summary := &ExtractSummary{Skipped: []SkippedEntry{}, status: http.StatusOK}
+	format := detectArchiveFormat(file)
+	if format == "" {
+		summary.Error, summary.status = "unsupported archive format, use one of: zip, tar, tar.gz", http.StatusUnsupportedMediaType
+		return summary
+	}
+
+	err := walkArchive(format, file, size, func(entry ArchiveEntry) error {
+		urlPath, reason := archiveEntryPath(dir, subdir, entry.name)
+		if urlPath == "" {
+			if reason != "" {
+				summary.Skipped = append(summary.Skipped, SkippedEntry{entry.name, reason})
+			}
+			return nil
+		}
+		if !entry.isDir && !entry.isFile {
+			summary.Skipped = append(summary.Skipped, SkippedEntry{entry.name, "unsupported entry type"})
+			return nil
+		}
+		if summary.Files+summary.Directories >= app.extractMaxFiles || summary.Bytes+entry.size > app.extractMaxSize {
+			return errExtractLimit
+		}
+
+		if entry.isDir {
+			summary.Directories++
+			return drive.mkdir(urlPath)
+		}
+		reader, err := entry.open()
+		if err != nil {
+			return err
+		}
+		defer IgnoreErrFunc(reader.Close)
+		// the announced size has been checked against the limits, so never read more than that
+		if err := WriteCryFile(drive.locate(CryPath(urlPath)), io.LimitReader(reader, entry.size), entry.size, drive.key); err != nil {
+			return err
+		}
+		if err := drive.link(urlPath, false); err != nil {
+			return err
+		}
+		summary.Files++
+		summary.Bytes += entry.size
+		return nil
+	})
+
+	if errors.Is(err, errExtractLimit) {
+		summary.Error = fmt.Sprintf("%s (max %d entries, max %d bytes)", err.Error(), app.extractMaxFiles, app.extractMaxSize)
+		summary.status = http.StatusRequestEntityTooLarge
+	} else if err != nil {
+		summary.Error, summary.status = sanitizeError(err), http.StatusBadRequest
+	}
+	return summary
+}
+
+func (app *AppData) handleExtract(w http.ResponseWriter, r *http.Request, drive *CryDrive, dir string, file multipart.File, size int64) {
+	subdir := r.URL.Query().Get("extract")
+	if subdir == "" || subdir == "true" {
+		subdir = r.FormValue("extract")
+	}
+	if subdir == "" || subdir == "true" {
+		subdir = "/"
+	}
+	subdir = path.Clean("/" + subdir)
+
+	if ok, err := drive.isFile(dir); err != nil {
+		http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+		return
+	} else if ok {
+		http.Error(w, "target of the extraction is a file", http.StatusConflict)
+		return
+	}
+
+	summary := app.extractArchive(drive, dir, subdir, file, size)
+	if summary.status == http.StatusOK && r.Method == "POST" {
+		summary.status = http.StatusCreated
+		w.Header().Set("Location", r.URL.Path)
+	}
+	data, err := json.Marshal(summary)
+	Check(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(summary.status)
+	_, _ = w.Write(data)
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+const GRANTS_PREFIX = SYSTEM_PATH_PREFIX + "/grants"
+const ACCOUNT_PATH = SYSTEM_PATH_PREFIX + "/account"
+const SHARED_MOUNT_PREFIX = "/~shared"    // grants of other users are mounted below this path
+const OUTGOING_GRANTS_CRYPATH = "grants:" // grants a user has given, stored in the drive of the user
+
+// Grant gives another account access to a file or directory. files have no keys of their own, so the grant holds the user key
+// of the owner, wrapped with a key of the server. the recipient can't decrypt the drive of the owner with it, the server only
+// serves the granted path. unlike share links, grants are live and may be writable, so they can't get a copy with a key of their own.
+// whoever holds both the SECRET_KEY and the private key of the recipient can decrypt the whole drive of the owner
+type Grant struct {
+	Owner           Username  `json:"owner"`
+	WrappedOwnerKey []byte    `json:"wrappedOwnerKey"`
+	Path            string    `json:"path"`
+	IsDir           bool      `json:"isDir"`
+	Writable        bool      `json:"writable"`
+	Name            string    `json:"name"`
+	Created         time.Time `json:"created"`
+}
+
+// SealedGrant is an entry of the grant list of a recipient. the grant is encrypted to the public key of the recipient
+type SealedGrant struct {
+	ID           string `json:"id"`
+	EphemeralKey []byte `json:"ephemeralKey"`
+	Sealed       []byte `json:"sealed"`
+}
+
+// OutgoingGrant is the view of a grant for its owner
+type OutgoingGrant struct {
+	ID        string `json:"id"`
+	Recipient string `json:"recipient"`
+	Path      string `json:"path"`
+	Writable  bool   `json:"writable"`
+}
+
+type IncomingGrant struct {
+	ID       string   `json:"id"`
+	Owner    Username `json:"owner"`
+	Mount    string   `json:"mount"`
+	Writable bool     `json:"writable"`
+}
+
+type AccountInfo struct {
+	Username    Username `json:"username"`
+	Fingerprint string   `json:"fingerprint"`
+	PublicKey   string   `json:"publicKey"`
+}
+
+// isMountPath reports paths which belong to the drive of another user or a group
+func isMountPath(urlPath string) bool {
+	return urlPath == SHARED_MOUNT_PREFIX || strings.HasPrefix(urlPath, SHARED_MOUNT_PREFIX+"/") || isGroupPath(urlPath)
+}
+
+// the grant list of a recipient is located via the public key, as the server must be able to add grants while the recipient is offline
+func (app *AppData) grantListFilepath(publicKey []byte) FsFilepath {
+	locations := &CryDrive{baseDir: app.webBaseDir, key: app.appKey.deriveKey("grants")}
+	return locations.locate(CryPath("incoming:" + strEncode(publicKey)))
+}
+
+func (app *AppData) readGrantList(publicKey []byte) ([]SealedGrant, error) {
+	grants := []SealedGrant{}
+	err := readLinkRecord(app.grantListFilepath(publicKey), app.appKey.deriveKey("grant-list"), &grants)
+	if errors.Is(err, os.ErrNotExist) {
+		return []SealedGrant{}, nil
+	}
+	return grants, err
+}
+
+func (app *AppData) updateGrantList(publicKey []byte, modify func(grants []SealedGrant) []SealedGrant) error {
+	fsPath := app.grantListFilepath(publicKey)
+	defer lockMetadata(fsPath)()
+	grants, err := app.readGrantList(publicKey)
+	if err != nil {
+		return err
+	}
+	return writeLinkRecord(fsPath, modify(grants), app.appKey.deriveKey("grant-list"))
+}
+
+func (drive *CryDrive) readOutgoingGrants() ([]OutgoingGrant, error) {
+	grants := []OutgoingGrant{}
+	err := readLinkRecord(drive.locate(OUTGOING_GRANTS_CRYPATH), drive.key, &grants)
+	if errors.Is(err, os.ErrNotExist) {
+		return []OutgoingGrant{}, nil
+	}
+	return grants, err
+}
+
+func (drive *CryDrive) updateOutgoingGrants(modify func(grants []OutgoingGrant) []OutgoingGrant) error {
+	fsPath := drive.locate(OUTGOING_GRANTS_CRYPATH)
+	defer lockMetadata(fsPath)()
+	grants, err := drive.readOutgoingGrants()
+	if err != nil {
+		return err
+	}
+	return writeLinkRecord(fsPath, modify(grants), drive.key)
+}
+
+func (app *AppData) createGrant(auth *AuthData, urlPath string, recipient []byte, writable bool, name string) (string, error) {
+	drive := app.userDrive(auth)
+	isDir, err := drive.isDir(urlPath)
+	if err != nil {
+		return "", err
+	}
+	if !isDir {
+		if ok, err := drive.isFile(urlPath); err != nil {
+			return "", err
+		} else if !ok {
+			return "", os.ErrNotExist
+		}
+	}
+	if name == "" {
+		name = string(auth.username) + "-" + path.Base(urlPath)
+		if urlPath == "/" {
+			name = string(auth.username)
+		}
+	}
+
+	wrappedKey, err := app.appKey.wrapKey(auth.userKey)
+	if err != nil {
+		return "", err
+	}
+	grant := Grant{Owner: auth.username, WrappedOwnerKey: wrappedKey, Path: urlPath, IsDir: isDir, Writable: writable, Name: name, Created: time.Now().UTC().Truncate(time.Second)}
+	data, err := json.Marshal(grant)
+	if err != nil {
+		return "", err
+	}
+	ephemeralKey, key, err := sealKeyTo(recipient, "grant")
+	if err != nil {
+		return "", err
+	}
+	sealed, err := key.encrypt(data)
+	if err != nil {
+		return "", err
+	}
+	id := make([]byte, LINK_ID_LENGTH)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	entry := SealedGrant{ID: strEncode(id), EphemeralKey: ephemeralKey, Sealed: sealed}
+
+	if err := app.updateGrantList(recipient, func(grants []SealedGrant) []SealedGrant { return append(grants, entry) }); err != nil {
+		return "", err
+	}
+	return entry.ID, drive.updateOutgoingGrants(func(grants []OutgoingGrant) []OutgoingGrant {
+		return append(grants, OutgoingGrant{ID: entry.ID, Recipient: strEncode(recipient), Path: urlPath, Writable: writable})
+	})
+}
+
+// incomingGrants opens all grants given to a user. mount names are made unique in the order the grants were given
+func (app *AppData) incomingGrants(auth *AuthData) (map[string]*Grant, []IncomingGrant, error) {
+	privateKey, err := app.userDrive(auth).keyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+	sealedGrants, err := app.readGrantList(privateKey.PublicKey().Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	mounts := map[string]*Grant{}
+	infos := []IncomingGrant{}
+	for _, entry := range sealedGrants {
+		key, err := openSealedKey(privateKey, entry.EphemeralKey, "grant")
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := key.decrypt(entry.Sealed)
+		if err != nil {
+			return nil, nil, err
+		}
+		grant := new(Grant)
+		if err := json.Unmarshal(data, grant); err != nil {
+			return nil, nil, err
+		}
+		name := strings.ReplaceAll(grant.Name, "/", "-")
+		for i := 2; mounts[name] != nil; i++ {
+			name = fmt.Sprintf("%s-%d", strings.ReplaceAll(grant.Name, "/", "-"), i)
+		}
+		mounts[name] = grant
+		infos = append(infos, IncomingGrant{ID: entry.ID, Owner: grant.Owner, Mount: SHARED_MOUNT_PREFIX + "/" + name, Writable: grant.Writable})
+	}
+	return mounts, infos, nil
+}
+
+// resolveMount maps a path below the shared mount prefix to the drive of the owner and the path inside of it
+func (app *AppData) resolveMount(auth *AuthData, urlPath string) (drive *CryDrive, ownerPath string, writable bool, err error) {
+	if isGroupPath(urlPath) {
+		return app.resolveGroup(auth, urlPath)
+	}
+	name, rest, _ := strings.Cut(strings.TrimPrefix(urlPath, SHARED_MOUNT_PREFIX+"/"), "/")
+	mounts, _, err := app.incomingGrants(auth)
+	if err != nil {
+		return nil, "", false, err
+	}
+	grant := mounts[name]
+	if grant == nil || (!grant.IsDir && rest != "") {
+		return nil, "", false, os.ErrNotExist
+	}
+	ownerKey, err := app.appKey.unwrapKey(grant.WrappedOwnerKey)
+	if err != nil {
+		return nil, "", false, os.ErrNotExist
+	}
+	owner := &AuthData{username: grant.Owner, userKey: ownerKey, userSalt: makeUserSalt(app.appKey, grant.Owner)}
+	if !app.isRegistered(owner) {
+		return nil, "", false, os.ErrNotExist // the owner has lost access
+	}
+	return app.userDrive(owner), path.Join(grant.Path, "/"+rest), grant.Writable, nil
+}
+
+// handleAccount shows the public key, which other users need to grant access
+func (app *AppData) handleAccount(w http.ResponseWriter, r *http.Request) {
+	auth := app.handleAuth(w, r)
+	if auth == nil {
+		// handleAuth has already set the http response
+		return
+	}
+	privateKey, err := app.userDrive(auth).keyPair()
+	if err != nil {
+		http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, AccountInfo{
+		Username:    auth.username,
+		Fingerprint: strEncode(auth.userKey.hash(auth.userSalt)),
+		PublicKey:   strEncode(privateKey.PublicKey().Bytes()),
+	})
+}
+
+// handleGrants lists (GET), creates (POST) and revokes (DELETE) grants between accounts
+func (app *AppData) handleGrants(w http.ResponseWriter, r *http.Request) {
+	auth := app.handleAuth(w, r)
+	if auth == nil {
+		// handleAuth has already set the http response
+		return
+	}
+	drive := app.userDrive(auth)
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, GRANTS_PREFIX), "/")
+
+	switch {
+	case r.Method == "GET" && id == "":
+		_, incoming, err := app.incomingGrants(auth)
+		if err != nil {
+			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+			return
+		}
+		outgoing, err := drive.readOutgoingGrants()
+		if err != nil {
+			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"incoming": incoming, "outgoing": outgoing})
+
+	case r.Method == "POST" && id == "":
+		urlPath := path.Clean("/" + r.FormValue("path"))
+		recipient, err := strDecode(r.FormValue("to"))
+		if err != nil || len(recipient) != 32 {
+			http.Error(w, "invalid public key of the recipient", http.StatusBadRequest)
+			return
+		}
+		if isReservedPath(urlPath) {
+			http.Error(w, "path is reserved", http.StatusBadRequest)
+			return
+		}
+		id, err := app.createGrant(auth, urlPath, recipient, r.FormValue("writable") == "true", r.FormValue("name"))
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Location", GRANTS_PREFIX+"/"+id)
+		writeJSON(w, http.StatusCreated, map[string]string{"id": id})
+
+	case r.Method == "DELETE" && id != "":
+		isGrant := func(entryID string) bool { return entryID == id }
+		outgoing, err := drive.readOutgoingGrants()
+		if err != nil {
+			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+			return
+		}
+		var recipient []byte
+		index := slices.IndexFunc(outgoing, func(grant OutgoingGrant) bool { return isGrant(grant.ID) })
+		if index >= 0 {
+			// the owner revokes a given grant
+			recipient, _ = strDecode(outgoing[index].Recipient)
+			err = drive.updateOutgoingGrants(func(grants []OutgoingGrant) []OutgoingGrant {
+				return slices.DeleteFunc(grants, func(grant OutgoingGrant) bool { return isGrant(grant.ID) })
+			})
+		} else {
+			// the recipient declines a received grant
+			privateKey, err := drive.keyPair()
+			if err != nil {
+				http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+				return
+			}
+			recipient = privateKey.PublicKey().Bytes()
+		}
+		found := false
+		if err == nil {
+			err = app.updateGrantList(recipient, func(grants []SealedGrant) []SealedGrant {
+				remaining := slices.DeleteFunc(grants, func(grant SealedGrant) bool { return isGrant(grant.ID) })
+				found = len(remaining) != len(grants)
+				return remaining
+			})
+		}
+		if err != nil {
+			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+			return
+		} else if !found && index < 0 {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func sendGrantRequest(app *AppData, handler func(http.ResponseWriter, *http.Request), method string, target string, body io.Reader, user string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, body)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth(user, "passwordpassword")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestGrants(t *testing.T) {
+
+	t.Setenv("SECRET_KEY", "q38rcNPrHkxBonj16HTKG95zbq0bzmJ189C9A-EgTxg")
+	t.Setenv("OPEN_REGISTRATION", "true")
+	app := makeAppData()
+
+	app.webBaseDir = "./www-test"
+	defer CheckFunc(func() error { return os.RemoveAll(app.webBaseDir) })
+	Check(os.MkdirAll(app.webBaseDir, 0700))
+
+	uploadFile(&app, http.MethodPost, "/docs/report.txt", "0123456789")
+	uploadFile(&app, http.MethodPost, "/notes.txt", "notes")
+	createHome(&app, "user2") // the login limiter counts logins to drives without data as guesses
+
+	w := sendGrantRequest(&app, app.handleAccount, http.MethodGet, ACCOUNT_PATH, nil, "user2")
+	var account AccountInfo
+	Check(json.Unmarshal(w.Body.Bytes(), &account))
+	if w.Code != http.StatusOK || account.Username != "user2" || account.PublicKey == "" {
+		t.Fatalf("unexpected account: %v %s", w.Code, w.Body.String())
+	}
+	grant := func(form url.Values) string {
+		w := sendGrantRequest(&app, app.handleGrants, http.MethodPost, GRANTS_PREFIX, strings.NewReader(form.Encode()), "user1")
+		if w.Code != http.StatusCreated {
+			t.Fatalf("expected 201, got %v %s", w.Code, w.Body.String())
+		}
+		var created map[string]string
+		Check(json.Unmarshal(w.Body.Bytes(), &created))
+		return created["id"]
+	}
+	readOnly := grant(url.Values{"path": {"/docs"}, "to": {account.PublicKey}})
+	writable := grant(url.Values{"path": {"/notes.txt"}, "to": {account.PublicKey}, "writable": {"true"}, "name": {"notes"}})
+
+	t.Run("it should mount grants below the shared prefix", func(t0 *testing.T) {
+		if w := sendGrantRequest(&app, app.handleRequest, http.MethodGet, "/~shared/user1-docs/report.txt", nil, "user2"); w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+			t0.Errorf("unexpected response: %v %q", w.Code, w.Body.String())
+		}
+		if w := sendGrantRequest(&app, app.handleRequest, http.MethodGet, "/~shared/notes/other.txt", nil, "user2"); w.Code != http.StatusNotFound {
+			t0.Errorf("expected 404 below a file grant, got %v", w.Code)
+		}
+		if w := sendGrantRequest(&app, app.handleRequest, http.MethodGet, "/~shared/user1-docs/report.txt", nil, "user3"); w.Code != http.StatusNotFound {
+			t0.Errorf("expected 404 for other users, got %v", w.Code)
+		}
+		w := sendGrantRequest(&app, app.handleGrants, http.MethodGet, GRANTS_PREFIX, nil, "user2")
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"mount":"/~shared/notes"`) {
+			t0.Errorf("unexpected grant list: %v %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("it should enforce read-only grants", func(t0 *testing.T) {
+		if w := sendGrantRequest(&app, app.handleRequest, http.MethodDelete, "/~shared/user1-docs/report.txt", nil, "user2"); w.Code != http.StatusForbidden {
+			t0.Errorf("expected 403, got %v", w.Code)
+		}
+		if w := sendGrantRequest(&app, app.handleRequest, "MOVE", "/~shared/notes", nil, "user2"); w.Code != http.StatusForbidden {
+			t0.Errorf("expected 403 for move, got %v", w.Code)
+		}
+	})
+
+	t.Run("it should write to the drive of the owner with writable grants", func(t0 *testing.T) {
+		auth := &AuthData{username: "user1", userSalt: makeUserSalt(app.appKey, "user1")}
+		auth.userKey = Password("passwordpassword").hash(auth.userSalt)
+		if err := app.userDrive(auth).remove("/notes.txt"); err != nil {
+			t0.Fatal(err)
+		}
+		if w := sendGrantRequest(&app, app.handleRequest, http.MethodGet, "/~shared/notes", nil, "user2"); w.Code != http.StatusNotFound {
+			t0.Errorf("expected 404 after removal, got %v", w.Code)
+		}
+		uploadFile(&app, http.MethodPut, "/notes.txt", "notes")
+		if w := sendGrantRequest(&app, app.handleRequest, http.MethodDelete, "/~shared/notes", nil, "user2"); w.Code != http.StatusNoContent {
+			t0.Errorf("expected 204, got %v %s", w.Code, w.Body.String())
+		}
+		if w := sendRequest(&app, http.MethodGet, "/notes.txt", nil); w.Code != http.StatusNotFound {
+			t0.Errorf("expected the file of the owner to be removed, got %v", w.Code)
+		}
+	})
+
+	t.Run("it should revoke and decline grants", func(t0 *testing.T) {
+		if w := sendGrantRequest(&app, app.handleGrants, http.MethodDelete, GRANTS_PREFIX+"/"+readOnly, nil, "user1"); w.Code != http.StatusNoContent {
+			t0.Errorf("expected 204, got %v", w.Code)
+		}
+		if w := sendGrantRequest(&app, app.handleRequest, http.MethodGet, "/~shared/user1-docs/report.txt", nil, "user2"); w.Code != http.StatusNotFound {
+			t0.Errorf("expected 404 after revocation, got %v", w.Code)
+		}
+		if w := sendGrantRequest(&app, app.handleGrants, http.MethodDelete, GRANTS_PREFIX+"/"+writable, nil, "user2"); w.Code != http.StatusNoContent {
+			t0.Errorf("expected 204, got %v", w.Code)
+		}
+		if w := sendGrantRequest(&app, app.handleGrants, http.MethodDelete, GRANTS_PREFIX+"/"+writable, nil, "user2"); w.Code != http.StatusNotFound {
+			t0.Errorf("expected 404, got %v", w.Code)
+		}
+	})
+
+	t.Run("it should hide the shared prefix from the drive", func(t0 *testing.T) {
+		if w := uploadFile(&app, http.MethodPost, "/~shared/x.txt", "x"); w.Code != http.StatusNotFound {
+			t0.Errorf("expected 404, got %v", w.Code)
+		}
+	})
+}
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+const GROUPS_PREFIX = SYSTEM_PATH_PREFIX + "/groups"
+const GROUP_MOUNT_PREFIX = "/~group" // group drives are mounted below this path
+
+const GROUP_ROLE_READ = "read"
+const GROUP_ROLE_WRITE = "write"
+const GROUP_ROLE_ADMIN = "admin" // can write and manage the members
+
+var groupNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// serializes writes to group drives with key rotations. writes share the lock of a group, rotations hold it exclusively
+var groupWriteLocker = &FileLocker{
+	locks: make(map[FsFilepath]*FileLock),
+}
+
+const GROUP_ROTATION_RETRY_AFTER = 5 * time.Second
+
+var errGroupRotating = errors.New("the group key is being rotated, try again later")
+var errGroupForbidden = errors.New("only admins of the group can do this")
+var errGroupLastAdmin = errors.New("the last admin can't leave a group with other members")
+
+// GroupMember holds the group key wrapped to the public key of a member, so members can be added while they are offline
+type GroupMember struct {
+	PublicKey    string `json:"publicKey"`
+	Username     string `json:"username,omitempty"`
+	Role         string `json:"role"`
+	EphemeralKey []byte `json:"ephemeralKey"`
+	WrappedKey   []byte `json:"wrappedKey"`
+}
+
+type GroupRecord struct {
+	Name            string        `json:"name"`
+	Generation      int           `json:"generation"`                // counts the key rotations
+	RotationPending bool          `json:"rotationPending,omitempty"` // a removed member still knows the group key
+	Created         time.Time     `json:"created"`
+	Members         []GroupMember `json:"members"`
+}
+
+type GroupMemberInfo struct {
+	PublicKey string `json:"publicKey"`
+	Username  string `json:"username,omitempty"`
+	Role      string `json:"role"`
+}
+
+type GroupInfo struct {
+	Name            string            `json:"name"`
+	Mount           string            `json:"mount"`
+	Role            string            `json:"role"`
+	Generation      int               `json:"generation"`
+	RotationPending bool              `json:"rotationPending"`
+	Members         []GroupMemberInfo `json:"members"`
+}
+
+func isGroupPath(urlPath string) bool {
+	return urlPath == GROUP_MOUNT_PREFIX || strings.HasPrefix(urlPath, GROUP_MOUNT_PREFIX+"/")
+}
+
+func isGroupRole(role string) bool {
+	return role == GROUP_ROLE_READ || role == GROUP_ROLE_WRITE || role == GROUP_ROLE_ADMIN
+}
+
+// groupLocations hides group records and the group lists of the members in the storage
+func (app *AppData) groupLocations() *CryDrive {
+	return &CryDrive{baseDir: app.webBaseDir, key: app.appKey.deriveKey("groups")}
+}
+
+func (app *AppData) groupRecordFilepath(name string) FsFilepath {
+	return app.groupLocations().locate(CryPath("group:" + name))
+}
+
+func (app *AppData) readGroup(name string) (*GroupRecord, error) {
+	record := new(GroupRecord)
+	if err := readLinkRecord(app.groupRecordFilepath(name), app.appKey.deriveKey("group-record"), record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (app *AppData) writeGroup(record *GroupRecord) error {
+	return writeLinkRecord(app.groupRecordFilepath(record.Name), record, app.appKey.deriveKey("group-record"))
+}
+
+// groupDrive is a drive of its own. a new key after a rotation results in new storage locations for all files
+func (app *AppData) groupDrive(name string, groupKey UserKey) *CryDrive {
+	return &CryDrive{baseDir: app.webBaseDir, key: groupKey, salt: makeUserSalt(app.appKey, Username(GROUP_MOUNT_PREFIX+"/"+name)),
+		sharedBlocks: app.sharedBlocks}
+}
+
+func (app *AppData) readMemberGroups(publicKey string) ([]string, error) {
+	names := []string{}
+	err := readLinkRecord(app.groupLocations().locate(CryPath("member:"+publicKey)), app.appKey.deriveKey("group-record"), &names)
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	}
+	return names, err
+}
+
+func (app *AppData) updateMemberGroups(publicKey string, modify func(names []string) []string) error {
+	fsPath := app.groupLocations().locate(CryPath("member:" + publicKey))
+	defer lockMetadata(fsPath)()
+	names, err := app.readMemberGroups(publicKey)
+	if err != nil {
+		return err
+	}
+	if names = modify(names); len(names) == 0 {
+		return IgnoreNotExist(os.Remove(string(fsPath)))
+	}
+	return writeLinkRecord(fsPath, names, app.appKey.deriveKey("group-record"))
+}
+
+func (record *GroupRecord) member(publicKey string) *GroupMember {
+	index := slices.IndexFunc(record.Members, func(member GroupMember) bool { return member.PublicKey == publicKey })
+	if index < 0 {
+		return nil
+	}
+	return &record.Members[index]
+}
+
+func (record *GroupRecord) info(role string) GroupInfo {
+	info := GroupInfo{Name: record.Name, Mount: GROUP_MOUNT_PREFIX + "/" + record.Name, Role: role, Generation: record.Generation,
+		RotationPending: record.RotationPending, Members: []GroupMemberInfo{}}
+	for _, member := range record.Members {
+		info.Members = append(info.Members, GroupMemberInfo{PublicKey: member.PublicKey, Username: member.Username, Role: member.Role})
+	}
+	return info
+}
+
+func wrapGroupKey(member *GroupMember, groupKey UserKey) error {
+	publicKey, err := strDecode(member.PublicKey)
+	if err != nil {
+		return err
+	}
+	ephemeralKey, key, err := sealKeyTo(publicKey, "group-key")
+	if err != nil {
+		return err
+	}
+	if member.WrappedKey, err = key.encrypt(Plaintext(groupKey)); err != nil {
+		return err
+	}
+	member.EphemeralKey = ephemeralKey
+	return nil
+}
+
+// openGroup unwraps the group key for a member. groups of which the user isn't a member don't exist for them
+func (app *AppData) openGroup(auth *AuthData, name string) (*GroupRecord, *GroupMember, UserKey, error) {
+	record, err := app.readGroup(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	privateKey, err := app.userDrive(auth).keyPair()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	member := record.member(strEncode(privateKey.PublicKey().Bytes()))
+	if member == nil {
+		return nil, nil, nil, os.ErrNotExist
+	}
+	key, err := openSealedKey(privateKey, member.EphemeralKey, "group-key")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	groupKey, err := key.decrypt(member.WrappedKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return record, member, UserKey(groupKey), nil
+}
+
+func (app *AppData) createGroup(auth *AuthData, name string) (*GroupRecord, error) {
+	privateKey, err := app.userDrive(auth).keyPair()
+	if err != nil {
+		return nil, err
+	}
+	fsPath := app.groupRecordFilepath(name)
+	defer lockMetadata(fsPath)()
+	if ok, err := IsFile(string(fsPath)); err != nil {
+		return nil, err
+	} else if ok {
+		return nil, os.ErrExist
+	}
+
+	groupKey := make(UserKey, USER_KEY_LENGTH)
+	if _, err := rand.Read(groupKey); err != nil {
+		return nil, err
+	}
+	record := &GroupRecord{Name: name, Created: time.Now().UTC().Truncate(time.Second)}
+	member := GroupMember{PublicKey: strEncode(privateKey.PublicKey().Bytes()), Username: string(auth.username), Role: GROUP_ROLE_ADMIN}
+	if err := wrapGroupKey(&member, groupKey); err != nil {
+		return nil, err
+	}
+	record.Members = append(record.Members, member)
+	if err := app.groupDrive(name, groupKey).mkdir("/"); err != nil {
+		return nil, err
+	}
+	if err := app.writeGroup(record); err != nil {
+		return nil, err
+	}
+	return record, app.updateMemberGroups(member.PublicKey, func(names []string) []string { return append(names, name) })
+}
+
+// setGroupMember adds a member or changes the role of an existing one
+func (app *AppData) setGroupMember(auth *AuthData, name string, publicKey string, username string, role string) (*GroupRecord, error) {
+	defer lockMetadata(app.groupRecordFilepath(name))()
+	record, self, groupKey, err := app.openGroup(auth, name)
+	if err != nil {
+		return nil, err
+	}
+	if self.Role != GROUP_ROLE_ADMIN {
+		return nil, errGroupForbidden
+	}
+
+	if member := record.member(publicKey); member != nil {
+		if member.Role == GROUP_ROLE_ADMIN && role != GROUP_ROLE_ADMIN && !record.hasOtherAdmin(publicKey) {
+			return nil, errGroupLastAdmin
+		}
+		member.Role = role
+		if username != "" {
+			member.Username = username
+		}
+		return record, app.writeGroup(record)
+	}
+
+	member := GroupMember{PublicKey: publicKey, Username: username, Role: role}
+	if err := wrapGroupKey(&member, groupKey); err != nil {
+		return nil, err
+	}
+	record.Members = append(record.Members, member)
+	if err := app.writeGroup(record); err != nil {
+		return nil, err
+	}
+	return record, app.updateMemberGroups(publicKey, func(names []string) []string { return append(names, name) })
+}
+
+func (record *GroupRecord) hasOtherAdmin(publicKey string) bool {
+	return slices.ContainsFunc(record.Members, func(member GroupMember) bool {
+		return member.Role == GROUP_ROLE_ADMIN && member.PublicKey != publicKey
+	})
+}
+
+// lockGroupWrites waits for running writes to a group drive and rejects further ones until unlocked
+func (app *AppData) lockGroupWrites(name string) (unlock func()) {
+	fsPath := app.groupRecordFilepath(name)
+	lock := groupWriteLocker.acquire(fsPath)
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		groupWriteLocker.release(fsPath)
+	}
+}
+
+// tryLockGroupWrites admits a write to the group drive of a path unless its key is being rotated. the group key has to be
+// resolved after the lock is taken, so writes never end up in a drive which is about to be removed
+func (app *AppData) tryLockGroupWrites(urlPath string) (unlock func(), ok bool) {
+	name, _, _ := strings.Cut(strings.TrimPrefix(urlPath, GROUP_MOUNT_PREFIX+"/"), "/")
+	fsPath := app.groupRecordFilepath(name)
+	lock := groupWriteLocker.acquire(fsPath)
+	if !lock.TryRLock() {
+		groupWriteLocker.release(fsPath)
+		return nil, false
+	}
+	return func() {
+		lock.RUnlock()
+		groupWriteLocker.release(fsPath)
+	}, true
+}
+
+// isGroupBusy tells whether a rotation or a write holds the group right now
+func (app *AppData) isGroupBusy(name string) bool {
+	fsPath := app.groupRecordFilepath(name)
+	lock := groupWriteLocker.acquire(fsPath)
+	defer groupWriteLocker.release(fsPath)
+	if !lock.TryLock() {
+		return true
+	}
+	lock.Unlock()
+	return false
+}
+
+// removeGroupMember removes a member (admins) or leaves the group (everyone). the member loses access right away, the group key
+// is rotated in the background, so the removed member can't decrypt new content with a key they kept. the last member leaving
+// deletes the group with all its files
+func (app *AppData) removeGroupMember(auth *AuthData, name string, publicKey string) (rotating bool, err error) {
+	unlockRecord := lockMetadata(app.groupRecordFilepath(name))
+	defer func() {
+		if unlockRecord != nil {
+			unlockRecord()
+		}
+	}()
+	record, self, groupKey, err := app.openGroup(auth, name)
+	if err != nil {
+		return false, err
+	}
+	if self.Role != GROUP_ROLE_ADMIN && self.PublicKey != publicKey {
+		return false, errGroupForbidden
+	}
+	removed := record.member(publicKey)
+	if removed == nil {
+		return false, os.ErrNotExist
+	}
+	if len(record.Members) == 1 {
+		return false, app.deleteGroup(record, groupKey)
+	}
+	if removed.Role == GROUP_ROLE_ADMIN && !record.hasOtherAdmin(publicKey) {
+		return false, errGroupLastAdmin
+	}
+
+	record.Members = slices.DeleteFunc(record.Members, func(member GroupMember) bool { return member.PublicKey == publicKey })
+	record.RotationPending = true // cleared by the rotation, so a failed or interrupted one is retried
+	if err := app.writeGroup(record); err != nil {
+		return false, err
+	}
+	err = app.updateMemberGroups(publicKey, func(names []string) []string {
+		return slices.DeleteFunc(names, func(entry string) bool { return entry == name })
+	})
+	if err != nil {
+		return false, err
+	}
+
+	app.startGroupRotation(record, groupKey, unlockRecord)
+	unlockRecord = nil
+	return true, nil
+}
+
+// retryGroupRotation starts a pending rotation again on behalf of an admin, unless one is running
+func (app *AppData) retryGroupRotation(auth *AuthData, name string) error {
+	if app.isGroupBusy(name) {
+		return nil
+	}
+	unlockRecord := lockMetadata(app.groupRecordFilepath(name))
+	record, member, groupKey, err := app.openGroup(auth, name)
+	if err != nil || !record.RotationPending || member.Role != GROUP_ROLE_ADMIN {
+		unlockRecord()
+		return err
+	}
+	app.startGroupRotation(record, groupKey, unlockRecord)
+	return nil
+}
+
+// startGroupRotation rotates the group key in the background. the record stays locked until the rotation is done,
+// so no member gets the old key wrapped meanwhile
+func (app *AppData) startGroupRotation(record *GroupRecord, groupKey UserKey, unlockRecord func()) {
+	unlockWrites := app.lockGroupWrites(record.Name)
+	go func() {
+		defer unlockRecord()
+		defer unlockWrites()
+		if err := app.rotateGroupKey(record, groupKey); err != nil {
+			log.Printf("group %s: key rotation failed, an admin retries it by requesting the group: %s\n", record.Name, sanitizeError(err))
+		}
+	}()
+}
+
+// rotateGroupKey encrypts all files of the group again with a new key and wraps it for the remaining members.
+// the record is switched to the new key before the old files are removed, so readers always find a complete drive.
+// a failure before the switch removes the new drive and leaves the rotation pending.
+// writes to the group have to be locked, as they would end up in the old drive
+func (app *AppData) rotateGroupKey(record *GroupRecord, oldKey UserKey) error {
+	newKey := make(UserKey, USER_KEY_LENGTH)
+	if _, err := rand.Read(newKey); err != nil {
+		return err
+	}
+	oldDrive, newDrive := app.groupDrive(record.Name, oldKey), app.groupDrive(record.Name, newKey)
+
+	copyEntry := func(urlPath string, isDir bool) error {
+		if err := oldDrive.forEachSidecar(urlPath, urlPath, func(src, dst CryPath) error { return oldDrive.copyFileTo(newDrive, src, dst) }); err != nil {
+			return err
+		}
+		if isDir {
+			return newDrive.mkdir(urlPath)
+		}
+		if err := oldDrive.copyFileTo(newDrive, CryPath(urlPath), CryPath(urlPath)); err != nil {
+			return err
+		}
+		return newDrive.link(urlPath, false)
+	}
+	switchKey := func() error {
+		if err := copyEntry("/", true); err != nil {
+			return err
+		}
+		err := oldDrive.walk("/", func(urlPath string, isDir bool) (bool, error) {
+			return true, IgnoreNotExist(copyEntry(urlPath, isDir)) // removed meanwhile
+		})
+		if err != nil {
+			return err
+		}
+
+		rotated := *record
+		rotated.Members = slices.Clone(record.Members)
+		for i := range rotated.Members {
+			if err := wrapGroupKey(&rotated.Members[i], newKey); err != nil {
+				return err
+			}
+		}
+		rotated.Generation++
+		rotated.RotationPending = false
+		if err := app.writeGroup(&rotated); err != nil {
+			return err
+		}
+		*record = rotated
+		return nil
+	}
+	if err := switchKey(); err != nil {
+		return errors.Join(err, IgnoreNotExist(newDrive.remove("/")))
+	}
+	return oldDrive.remove("/")
+}
+
+func (app *AppData) deleteGroup(record *GroupRecord, groupKey UserKey) error {
+	defer app.lockGroupWrites(record.Name)()
+	if err := app.groupDrive(record.Name, groupKey).remove("/"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := IgnoreNotExist(os.Remove(string(app.groupRecordFilepath(record.Name)))); err != nil {
+		return err
+	}
+	for _, member := range record.Members {
+		err := app.updateMemberGroups(member.PublicKey, func(names []string) []string {
+			return slices.DeleteFunc(names, func(entry string) bool { return entry == record.Name })
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveGroup maps a path below the group prefix to the group drive and the path inside of it
+func (app *AppData) resolveGroup(auth *AuthData, urlPath string) (drive *CryDrive, groupPath string, writable bool, err error) {
+	name, rest, _ := strings.Cut(strings.TrimPrefix(urlPath, GROUP_MOUNT_PREFIX+"/"), "/")
+	if !groupNamePattern.MatchString(name) {
+		return nil, "", false, os.ErrNotExist
+	}
+	_, member, groupKey, err := app.openGroup(auth, name)
+	if err != nil {
+		return nil, "", false, err
+	}
+	return app.groupDrive(name, groupKey), path.Join("/", rest), member.Role != GROUP_ROLE_READ, nil
+}
+
+func writeGroupError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		http.Error(w, "not found", http.StatusNotFound)
+	case errors.Is(err, os.ErrExist):
+		http.Error(w, "group exists already", http.StatusConflict)
+	case errors.Is(err, errGroupLastAdmin):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, errGroupForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+	}
+}
+
+// handleGroups creates, lists and deletes groups and manages their members:
+// /.crydrv/groups, /.crydrv/groups/NAME and /.crydrv/groups/NAME/members/PUBLIC_KEY
+func (app *AppData) handleGroups(w http.ResponseWriter, r *http.Request) {
+	auth := app.handleAuth(w, r)
+	if auth == nil {
+		// handleAuth has already set the http response
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, GROUPS_PREFIX), "/"), "/")
+	name := parts[0]
+	if name != "" && !groupNamePattern.MatchString(name) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	membersPath := len(parts) >= 2 && parts[1] == "members"
+	if len(parts) > 3 || (len(parts) >= 2 && !membersPath) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && name == "":
+		privateKey, err := app.userDrive(auth).keyPair()
+		if err != nil {
+			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+			return
+		}
+		names, err := app.readMemberGroups(strEncode(privateKey.PublicKey().Bytes()))
+		if err != nil {
+			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+			return
+		}
+		groups := []GroupInfo{}
+		for _, name := range names {
+			if record, member, _, err := app.openGroup(auth, name); err == nil {
+				groups = append(groups, record.info(member.Role))
+			}
+		}
+		writeJSON(w, http.StatusOK, groups)
+
+	case r.Method == "POST" && name == "":
+		name := r.FormValue("name")
+		if !groupNamePattern.MatchString(name) {
+			http.Error(w, "invalid group name", http.StatusBadRequest)
+			return
+		}
+		record, err := app.createGroup(auth, name)
+		if err != nil {
+			writeGroupError(w, err)
+			return
+		}
+		w.Header().Set("Location", GROUPS_PREFIX+"/"+name)
+		writeJSON(w, http.StatusCreated, record.info(GROUP_ROLE_ADMIN))
+
+	case r.Method == "GET" && !membersPath:
+		record, member, _, err := app.openGroup(auth, name)
+		if err != nil {
+			writeGroupError(w, err)
+			return
+		}
+		if record.RotationPending && member.Role == GROUP_ROLE_ADMIN {
+			if err := app.retryGroupRotation(auth, name); err != nil {
+				writeGroupError(w, err)
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, record.info(member.Role))
+
+	case r.Method == "DELETE" && !membersPath:
+		err := func() error {
+			defer lockMetadata(app.groupRecordFilepath(name))()
+			record, member, groupKey, err := app.openGroup(auth, name)
+			if err != nil {
+				return err
+			} else if member.Role != GROUP_ROLE_ADMIN {
+				return errGroupForbidden
+			}
+			return app.deleteGroup(record, groupKey)
+		}()
+		if err != nil {
+			writeGroupError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == "POST" && membersPath && len(parts) == 2:
+		publicKey, err := strDecode(r.FormValue("to"))
+		if err != nil || len(publicKey) != 32 {
+			http.Error(w, "invalid public key of the member", http.StatusBadRequest)
+			return
+		}
+		role := r.FormValue("role")
+		if role == "" {
+			role = GROUP_ROLE_READ
+		} else if !isGroupRole(role) {
+			http.Error(w, "invalid role, use read, write or admin", http.StatusBadRequest)
+			return
+		}
+		record, err := app.setGroupMember(auth, name, strEncode(publicKey), r.FormValue("username"), role)
+		if err != nil {
+			writeGroupError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, record.info(GROUP_ROLE_ADMIN))
+
+	case r.Method == "DELETE" && membersPath && len(parts) == 3:
+		rotating, err := app.removeGroupMember(auth, name, parts[2])
+		if err != nil {
+			writeGroupError(w, err)
+			return
+		} else if rotating {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGroups(t *testing.T) {
+
+	t.Setenv("SECRET_KEY", "q38rcNPrHkxBonj16HTKG95zbq0bzmJ189C9A-EgTxg")
+	t.Setenv("OPEN_REGISTRATION", "true")
+	app := makeAppData()
+
+	app.webBaseDir = "./www-test"
+	defer CheckFunc(func() error { return os.RemoveAll(app.webBaseDir) })
+	Check(os.MkdirAll(app.webBaseDir, 0700))
+	// the login limiter counts logins to drives without data as guesses
+	createHome(&app, "user1")
+	createHome(&app, "user2")
+
+	publicKey := func(user string) string {
+		var account AccountInfo
+		Check(json.Unmarshal(sendGrantRequest(&app, app.handleAccount, http.MethodGet, ACCOUNT_PATH, nil, user).Body.Bytes(), &account))
+		return account.PublicKey
+	}
+	member2 := publicKey("user2")
+	send := func(method string, target string, form url.Values, user string) *httptest.ResponseRecorder {
+		return sendGrantRequest(&app, app.handleGroups, method, target, strings.NewReader(form.Encode()), user)
+	}
+
+	if w := send(http.MethodPost, GROUPS_PREFIX, url.Values{"name": {"team"}}, "user1"); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %v %s", w.Code, w.Body.String())
+	}
+	if w := send(http.MethodPost, GROUPS_PREFIX, url.Values{"name": {"team"}}, "user2"); w.Code != http.StatusConflict {
+		t.Errorf("expected 409 for an existing group, got %v", w.Code)
+	}
+	if w := uploadFile(&app, http.MethodPost, "/~group/team/docs/a.txt", "group content"); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %v %s", w.Code, w.Body.String())
+	}
+
+	t.Run("it should give members access by role", func(t0 *testing.T) {
+		if w := sendGrantRequest(&app, app.handleRequest, http.MethodGet, "/~group/team/docs/a.txt", nil, "user2"); w.Code != http.StatusNotFound {
+			t0.Errorf("expected 404 before joining, got %v", w.Code)
+		}
+		if w := send(http.MethodPost, GROUPS_PREFIX+"/team/members", url.Values{"to": {member2}, "username": {"user2"}}, "user1"); w.Code != http.StatusOK {
+			t0.Fatalf("expected 200, got %v %s", w.Code, w.Body.String())
+		}
+		if w := sendGrantRequest(&app, app.handleRequest, http.MethodGet, "/~group/team/docs/a.txt", nil, "user2"); w.Code != http.StatusOK || w.Body.String() != "group content" {
+			t0.Errorf("unexpected response: %v %q", w.Code, w.Body.String())
+		}
+		if w := sendGrantRequest(&app, app.handleRequest, http.MethodDelete, "/~group/team/docs/a.txt", nil, "user2"); w.Code != http.StatusForbidden {
+			t0.Errorf("expected 403 for readers, got %v", w.Code)
+		}
+		if w := send(http.MethodPost, GROUPS_PREFIX+"/team/members", url.Values{"to": {member2}, "role": {"admin"}}, "user2"); w.Code != http.StatusForbidden {
+			t0.Errorf("expected 403 for readers, got %v", w.Code)
+		}
+		send(http.MethodPost, GROUPS_PREFIX+"/team/members", url.Values{"to": {member2}, "role": {"write"}}, "user1")
+		if w := sendGrantRequest(&app, app.handleRequest, http.MethodDelete, "/~group/team/docs/a.txt", nil, "user2"); w.Code != http.StatusNoContent {
+			t0.Errorf("expected 204 for writers, got %v", w.Code)
+		}
+		uploadFile(&app, http.MethodPut, "/~group/team/docs/a.txt", "group content")
+
+		var groups []GroupInfo
+		Check(json.Unmarshal(send(http.MethodGet, GROUPS_PREFIX, nil, "user2").Body.Bytes(), &groups))
+		if len(groups) != 1 || groups[0].Mount != "/~group/team" || groups[0].Role != GROUP_ROLE_WRITE || len(groups[0].Members) != 2 {
+			t0.Errorf("unexpected groups: %v", groups)
+		}
+	})
+
+	t.Run("it should rotate the group key on removal", func(t0 *testing.T) {
+		auth := &AuthData{username: "user1", userSalt: makeUserSalt(app.appKey, "user1")}
+		auth.userKey = Password("passwordpassword").hash(auth.userSalt)
+		_, _, oldKey, err := app.openGroup(auth, "team")
+		if err != nil {
+			t0.Fatal(err)
+		}
+		if w := send(http.MethodDelete, GROUPS_PREFIX+"/team/members/"+member2, nil, "user1"); w.Code != http.StatusAccepted {
+			t0.Fatalf("expected 202, got %v %s", w.Code, w.Body.String())
+		}
+		app.lockGroupWrites("team")() // waits for the rotation
+		if w := sendGrantRequest(&app, app.handleRequest, http.MethodGet, "/~group/team/docs/a.txt", nil, "user2"); w.Code != http.StatusNotFound {
+			t0.Errorf("expected 404 after removal, got %v", w.Code)
+		}
+		if w := sendRequest(&app, http.MethodGet, "/~group/team/docs/a.txt", nil); w.Body.String() != "group content" {
+			t0.Errorf("unexpected content after rotation: %v %q", w.Code, w.Body.String())
+		}
+		if ok, err := IsFile(string(app.groupDrive("team", oldKey).locate("/docs/a.txt"))); err != nil || ok {
+			t0.Errorf("expected the old ciphertext to be removed")
+		}
+		record, _, newKey, _ := app.openGroup(auth, "team")
+		if record.Generation != 1 || string(newKey) == string(oldKey) {
+			t0.Errorf("expected a new group key, got generation %d", record.Generation)
+		}
+	})
+
+	t.Run("it should reject writes during a rotation", func(t0 *testing.T) {
+		unlock := app.lockGroupWrites("team")
+		if w := uploadFile(&app, http.MethodPost, "/~group/team/docs/b.txt", "lost?"); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+			t0.Errorf("expected 503 with Retry-After, got %v", w.Code)
+		}
+		if w := sendRequest(&app, http.MethodGet, "/~group/team/docs/a.txt", nil); w.Code != http.StatusOK {
+			t0.Errorf("expected reads to go on, got %v", w.Code)
+		}
+		unlock()
+		if w := uploadFile(&app, http.MethodPost, "/~group/team/docs/b.txt", "kept"); w.Code != http.StatusCreated {
+			t0.Errorf("expected 201, got %v", w.Code)
+		}
+	})
+
+	t.Run("it should retry a failed rotation", func(t0 *testing.T) {
+		countFiles := func() (count int) {
+			Check(filepath.WalkDir(app.webBaseDir, func(_ string, entry fs.DirEntry, err error) error {
+				if err == nil && !entry.IsDir() {
+					count++
+				}
+				return err
+			}))
+			return count
+		}
+		auth := &AuthData{username: "user1", userSalt: makeUserSalt(app.appKey, "user1")}
+		auth.userKey = Password("passwordpassword").hash(auth.userSalt)
+		files := countFiles()
+		send(http.MethodPost, GROUPS_PREFIX+"/team/members", url.Values{"to": {member2}}, "user1")
+		_, _, oldKey, _ := app.openGroup(auth, "team")
+		fsPath := string(app.groupDrive("team", oldKey).locate("/docs/b.txt"))
+		ciphertext := Try(os.ReadFile(fsPath))
+		Check(os.WriteFile(fsPath, []byte(strings.Repeat("x", len(ciphertext))), 0600)) // fails the copy
+
+		if w := send(http.MethodDelete, GROUPS_PREFIX+"/team/members/"+member2, nil, "user1"); w.Code != http.StatusAccepted {
+			t0.Fatalf("expected 202, got %v %s", w.Code, w.Body.String())
+		}
+		app.lockGroupWrites("team")() // waits for the rotation
+		record, _, groupKey, _ := app.openGroup(auth, "team")
+		if !record.RotationPending || record.Generation != 1 || string(groupKey) != string(oldKey) {
+			t0.Errorf("expected the old key with a pending rotation, got generation %d", record.Generation)
+		}
+		if count := countFiles(); count != files {
+			t0.Errorf("expected the partial new drive to be removed, got %d files instead of %d", count, files)
+		}
+		if w := sendRequest(&app, http.MethodGet, "/~group/team/docs/a.txt", nil); w.Body.String() != "group content" {
+			t0.Errorf("unexpected content after the failed rotation: %v %q", w.Code, w.Body.String())
+		}
+
+		Check(os.WriteFile(fsPath, ciphertext, 0600))
+		var info GroupInfo
+		Check(json.Unmarshal(send(http.MethodGet, GROUPS_PREFIX+"/team", nil, "user1").Body.Bytes(), &info))
+		if !info.RotationPending {
+			t0.Errorf("expected the admin to see the pending rotation: %+v", info)
+		}
+		app.lockGroupWrites("team")()
+		record, _, groupKey, _ = app.openGroup(auth, "team")
+		if record.RotationPending || record.Generation != 2 || string(groupKey) == string(oldKey) {
+			t0.Errorf("expected the retry to rotate the key, got generation %d", record.Generation)
+		}
+		if w := sendRequest(&app, http.MethodGet, "/~group/team/docs/b.txt", nil); w.Body.String() != "kept" {
+			t0.Errorf("unexpected content after the retry: %v %q", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("it should delete the group with the last member", func(t0 *testing.T) {
+		if w := send(http.MethodPost, GROUPS_PREFIX+"/team/members", url.Values{"to": {"invalid"}}, "user1"); w.Code != http.StatusBadRequest {
+			t0.Errorf("expected 400, got %v", w.Code)
+		}
+		if w := send(http.MethodDelete, GROUPS_PREFIX+"/team/members/"+publicKey("user1"), nil, "user1"); w.Code != http.StatusNoContent {
+			t0.Errorf("expected 204, got %v %s", w.Code, w.Body.String())
+		}
+		if w := send(http.MethodGet, GROUPS_PREFIX+"/team", nil, "user1"); w.Code != http.StatusNotFound {
+			t0.Errorf("expected 404, got %v", w.Code)
+		}
+		if w := send(http.MethodPost, GROUPS_PREFIX, url.Values{"name": {"team"}}, "user2"); w.Code != http.StatusCreated {
+			t0.Errorf("expected the name to be free again, got %v", w.Code)
+		}
+	})
+}
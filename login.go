@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const LOGIN_PATH = SYSTEM_PATH_PREFIX + "/login"
+const LOGOUT_PATH = SYSTEM_PATH_PREFIX + "/logout"
+const LOGIN_FORM_MAX_SIZE = 64 * 1024 // bytes
+
+// the form posts to its own url, so the next page of the query string survives a login
+const LOGIN_FORM_HTML = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width"><title>Login</title></head>
+<body>
+<form method="post">
+<input name="username" autocomplete="username" placeholder="Username" required autofocus>
+<input name="password" type="password" autocomplete="current-password" placeholder="Password" required>
+<button type="submit">Login</button>
+</form>
+</body>
+</html>
+`
+
+// wantsLoginForm tells browser navigations, which get the login form instead of the basic auth dialog
+func wantsLoginForm(r *http.Request) bool {
+	return (r.Method == "GET" || r.Method == "HEAD") && r.Header.Get("Authorization") == "" &&
+		strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// nextPage only redirects to paths of this server
+func nextPage(r *http.Request) string {
+	next := r.URL.Query().Get("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// isSameOrigin rejects logins posted by other sites. browsers send Origin with every form POST
+func isSameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// handleLogin shows the login form (GET) and starts a session with its credentials (POST)
+func (app *AppData) handleLogin(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-Robots-Tag", "noindex")
+		_, _ = io.WriteString(w, LOGIN_FORM_HTML)
+
+	case "POST":
+		if !isSameOrigin(r) {
+			http.Error(w, "cross-origin login", http.StatusForbidden)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, LOGIN_FORM_MAX_SIZE)
+		username, password := r.PostFormValue("username"), r.PostFormValue("password")
+		if !app.isValidLogin(username, password) {
+			http.Error(w, "invalid username or password too short", http.StatusBadRequest)
+			return
+		}
+		if app.login(w, r, username, password, true) == nil {
+			// login has already set the http response
+			return
+		}
+		http.Redirect(w, r, nextPage(r), http.StatusSeeOther)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleLogout ends the session of the cookie and deletes it. it doesn't need a valid session, so it always succeeds
+func (app *AppData) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if cookie, err := r.Cookie(COOKIE_NAME); err == nil {
+		if token, err := app.openSession(cookie.Value, time.Now()); err == nil {
+			err := app.userDrive(token.auth(app)).updateSessions(func(sessions []Session) []Session {
+				return slices.DeleteFunc(sessions, func(session Session) bool { return session.ID == token.ID })
+			})
+			if err != nil {
+				http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	http.SetCookie(w, deleteCookie)
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, LOGIN_PATH, http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
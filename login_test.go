@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLoginForm(t *testing.T) {
+
+	t.Setenv("SECRET_KEY", "q38rcNPrHkxBonj16HTKG95zbq0bzmJ189C9A-EgTxg")
+	t.Setenv("OPEN_REGISTRATION", "true")
+	app := makeAppData()
+
+	app.webBaseDir = "./www-test"
+	defer CheckFunc(func() error { return os.RemoveAll(app.webBaseDir) })
+	Check(os.MkdirAll(app.webBaseDir, 0700))
+
+	login := func(target string, username string, password string) *httptest.ResponseRecorder {
+		form := url.Values{"username": {username}, "password": {password}}
+		r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		app.handleLogin(w, r)
+		return w
+	}
+
+	t.Run("it should send browsers without credentials to the login form", func(t0 *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/docs/?sort=name", nil)
+		r.Header.Set("Accept", "text/html,application/xhtml+xml")
+		w := httptest.NewRecorder()
+		if app.handleAuth(w, r) != nil || w.Code != http.StatusSeeOther || w.Header().Get("Location") != LOGIN_PATH+"?next=%2Fdocs%2F%3Fsort%3Dname" {
+			t0.Errorf("expected a redirect to the login form, got %v %v", w.Code, w.Header())
+		}
+		w = httptest.NewRecorder()
+		app.handleLogin(w, httptest.NewRequest(http.MethodGet, LOGIN_PATH, nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `type="password"`) {
+			t0.Errorf("expected the login form, got %v", w.Code)
+		}
+	})
+
+	t.Run("it should start a session which needs no basic auth", func(t0 *testing.T) {
+		w := login(LOGIN_PATH+"?next=%2Fdocs%2F", "user1", "passwordpassword")
+		if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/docs/" {
+			t0.Fatalf("expected a redirect to the next page, got %v %v", w.Code, w.Header())
+		}
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(w.Result().Cookies()[0])
+		if auth := app.handleAuth(httptest.NewRecorder(), r); auth == nil || auth.username != "user1" || auth.sessionID == "" {
+			t0.Errorf("expected the cookie to authenticate, got %+v", auth)
+		}
+		// basic auth of another user isn't mixed up with the cookie
+		r.SetBasicAuth("user2", "passwordpassword")
+		if auth := app.handleAuth(httptest.NewRecorder(), r); auth == nil || auth.username != "user2" {
+			t0.Errorf("expected a login of the other user, got %+v", auth)
+		}
+	})
+
+	t.Run("it should only redirect to pages of this server", func(t0 *testing.T) {
+		for _, next := range []string{"https://example.com/", "//example.com/", "/\\example.com/", ""} {
+			if w := login(LOGIN_PATH+"?next="+url.QueryEscape(next), "user1", "passwordpassword"); w.Header().Get("Location") != "/" {
+				t0.Errorf("unexpected redirect for %q: %v", next, w.Header().Get("Location"))
+			}
+		}
+	})
+
+	t.Run("it should reject short passwords and logins of other sites", func(t0 *testing.T) {
+		if w := login(LOGIN_PATH, "user1", "short"); w.Code != http.StatusBadRequest || len(w.Result().Cookies()) != 0 {
+			t0.Errorf("expected 400, got %v", w.Code)
+		}
+		r := httptest.NewRequest(http.MethodPost, LOGIN_PATH, strings.NewReader("username=user1&password=passwordpassword"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Origin", "https://attacker.test")
+		w := httptest.NewRecorder()
+		app.handleLogin(w, r)
+		if w.Code != http.StatusForbidden || len(w.Result().Cookies()) != 0 {
+			t0.Errorf("expected 403, got %v", w.Code)
+		}
+	})
+
+	t.Run("it should end the session on logout", func(t0 *testing.T) {
+		cookie := login(LOGIN_PATH, "user1", "passwordpassword").Result().Cookies()[0]
+		r := httptest.NewRequest(http.MethodPost, LOGOUT_PATH, nil)
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		app.handleLogout(w, r)
+		if w.Code != http.StatusNoContent || w.Result().Cookies()[0].Value != "" {
+			t0.Fatalf("expected 204 and the cookie to be deleted, got %v", w.Code)
+		}
+		// a copy of the cookie is useless now
+		r = httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(cookie)
+		w = httptest.NewRecorder()
+		if app.handleAuth(w, r) != nil || w.Code != http.StatusUnauthorized {
+			t0.Errorf("expected the session to be invalid, got %v", w.Code)
+		}
+		w = httptest.NewRecorder()
+		app.handleLogout(w, httptest.NewRequest(http.MethodGet, LOGOUT_PATH, nil))
+		if w.Code != http.StatusMethodNotAllowed {
+			t0.Errorf("expected 405, got %v", w.Code)
+		}
+	})
+}
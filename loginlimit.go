@@ -0,0 +1,163 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const LOGIN_DEFAULT_BURST = 10            // failed logins before the first lockout
+const LOGIN_DEFAULT_RATE = 5              // failed logins per minute which are forgiven again
+const LOGIN_DEFAULT_LOCKOUT = time.Minute // doubled with every further lockout
+const LOGIN_DEFAULT_MAX_LOCKOUT = time.Hour
+
+type loginBucket struct {
+	tokens      float64
+	updated     time.Time
+	lockouts    int
+	lockedUntil time.Time
+}
+
+// LoginLimiter throttles password guessing per client IP and per username. failed logins take a token from a bucket,
+// an empty bucket locks the key out for a time that doubles with every lockout until the bucket has been refilled
+type LoginLimiter struct {
+	sync.Mutex
+
+	burst      float64
+	rate       float64 // tokens per second
+	lockout    time.Duration
+	maxLockout time.Duration
+
+	buckets   map[string]*loginBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newLoginLimiter(burst int, perMinute float64, lockout time.Duration, maxLockout time.Duration) *LoginLimiter {
+	return &LoginLimiter{burst: float64(burst), rate: perMinute / 60, lockout: lockout, maxLockout: maxLockout,
+		buckets: map[string]*loginBucket{}, now: time.Now}
+}
+
+// loginKeys identifies a login by client and account. IPv6 clients are grouped by their /64 network, which they usually own completely
+func loginKeys(r *http.Request, username string) []string {
+	return []string{clientKey(r), "user:" + username}
+}
+
+// shareLoginKeys identifies a password guess for a share link by client and link
+func shareLoginKeys(r *http.Request, id []byte) []string {
+	return []string{clientKey(r), "share:" + strEncode(id)}
+}
+
+func clientKey(r *http.Request) string {
+	host := clientIP(r)
+	if addr, err := netip.ParseAddr(host); err == nil && addr.Is6() && !addr.Is4In6() {
+		host = netip.PrefixFrom(addr, 64).Masked().String()
+	}
+	return "ip:" + host
+}
+
+// refill brings the bucket up to date. it refills only after a lockout, so the next failure right after it locks out for longer.
+// a full bucket has forgiven all lockouts
+func (limiter *LoginLimiter) refill(bucket *loginBucket, now time.Time) {
+	from := bucket.updated
+	if bucket.lockedUntil.After(from) {
+		from = bucket.lockedUntil
+	}
+	if now.After(from) {
+		bucket.tokens = min(limiter.burst, bucket.tokens+now.Sub(from).Seconds()*limiter.rate)
+	}
+	bucket.updated = now
+	if bucket.tokens >= limiter.burst {
+		bucket.lockouts = 0
+	}
+}
+
+// check returns how long the longest lockout of the keys lasts, 0 allows the login
+func (limiter *LoginLimiter) check(keys ...string) time.Duration {
+	limiter.Lock()
+	defer limiter.Unlock()
+	now := limiter.now()
+	var wait time.Duration
+	for _, key := range keys {
+		if bucket := limiter.buckets[key]; bucket != nil && bucket.lockedUntil.After(now) {
+			wait = max(wait, bucket.lockedUntil.Sub(now))
+		}
+	}
+	return wait
+}
+
+// hasFailures tells whether failed logins of a key haven't been forgiven yet
+func (limiter *LoginLimiter) hasFailures(key string) bool {
+	limiter.Lock()
+	defer limiter.Unlock()
+	bucket := limiter.buckets[key]
+	if bucket == nil {
+		return false
+	}
+	limiter.refill(bucket, limiter.now())
+	return bucket.tokens < limiter.burst
+}
+
+// fail records a failed login and reports the keys which got locked out by it
+func (limiter *LoginLimiter) fail(keys ...string) map[string]time.Duration {
+	limiter.Lock()
+	defer limiter.Unlock()
+	now := limiter.now()
+	limiter.sweep(now)
+	lockouts := map[string]time.Duration{}
+	for _, key := range keys {
+		bucket := limiter.buckets[key]
+		if bucket == nil {
+			bucket = &loginBucket{tokens: limiter.burst, updated: now}
+			limiter.buckets[key] = bucket
+		}
+		limiter.refill(bucket, now)
+		bucket.tokens = max(0, bucket.tokens-1)
+		if bucket.tokens < 1 && !bucket.lockedUntil.After(now) {
+			lockout := min(limiter.maxLockout, limiter.lockout<<min(bucket.lockouts, 30))
+			bucket.lockouts++
+			bucket.lockedUntil = now.Add(lockout)
+			lockouts[key] = lockout
+		}
+	}
+	return lockouts
+}
+
+// succeed forgets the failures of a key, e.g. of a username after a login to its existing account
+func (limiter *LoginLimiter) succeed(key string) {
+	limiter.Lock()
+	defer limiter.Unlock()
+	delete(limiter.buckets, key)
+}
+
+// sweep drops buckets which are full again, at most once a minute
+func (limiter *LoginLimiter) sweep(now time.Time) {
+	if now.Sub(limiter.lastSweep) < time.Minute {
+		return
+	}
+	limiter.lastSweep = now
+	for key, bucket := range limiter.buckets {
+		limiter.refill(bucket, now)
+		if bucket.tokens >= limiter.burst && !bucket.lockedUntil.After(now) {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+func (app *AppData) recordFailedLogin(r *http.Request, username string) {
+	app.recordFailedGuess(loginKeys(r, username)...)
+}
+
+func (app *AppData) recordFailedGuess(keys ...string) {
+	for key, lockout := range app.loginLimiter.fail(keys...) {
+		log.Printf("login: %s locked out for %v after repeated failed logins\n", key, lockout)
+	}
+}
+
+func writeLoginLockout(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+	http.Error(w, "too many failed logins, try again later", http.StatusTooManyRequests)
+}
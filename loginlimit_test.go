@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLoginLimiter(t *testing.T) {
+
+	t.Run("it should lock out with exponential backoff", func(t0 *testing.T) {
+		limiter := newLoginLimiter(2, 1, time.Minute, 3*time.Minute)
+		now := time.Unix(1000, 0)
+		limiter.now = func() time.Time { return now }
+
+		if lockouts := limiter.fail("ip:a"); len(lockouts) != 0 || limiter.check("ip:a") != 0 {
+			t0.Errorf("expected the first failure to be allowed, got %v", lockouts)
+		}
+		if lockouts := limiter.fail("ip:a", "user:b"); lockouts["ip:a"] != time.Minute || len(lockouts) != 1 {
+			t0.Errorf("expected a lockout of the ip only, got %v", lockouts)
+		}
+		if wait := limiter.check("ip:a", "user:b"); wait != time.Minute {
+			t0.Errorf("unexpected lockout: %v", wait)
+		}
+		for _, expected := range []time.Duration{2 * time.Minute, 3 * time.Minute} {
+			now = limiter.buckets["ip:a"].lockedUntil
+			if lockouts := limiter.fail("ip:a"); lockouts["ip:a"] != expected {
+				t0.Errorf("expected a lockout of %v, got %v", expected, lockouts)
+			}
+		}
+
+		now = now.Add(time.Hour) // the bucket is refilled
+		if lockouts := limiter.fail("ip:a"); len(lockouts) != 0 || limiter.buckets["ip:a"].lockouts != 0 {
+			t0.Errorf("expected the lockouts to be forgiven, got %v", lockouts)
+		}
+		limiter.succeed("ip:a")
+		if len(limiter.buckets) != 0 {
+			t0.Errorf("expected refilled buckets to be dropped, got %v", limiter.buckets)
+		}
+	})
+
+	t.Run("it should group IPv6 clients by network", func(t0 *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "[2001:db8:1:2:3:4:5:6]:1234"
+		if keys := loginKeys(r, "user1"); keys[0] != "ip:2001:db8:1:2::/64" || keys[1] != "user:user1" {
+			t0.Errorf("unexpected keys: %v", keys)
+		}
+	})
+
+	t.Run("it should answer repeated failed logins with 429", func(t0 *testing.T) {
+		t0.Setenv("SECRET_KEY", "q38rcNPrHkxBonj16HTKG95zbq0bzmJ189C9A-EgTxg")
+		t0.Setenv("OPEN_REGISTRATION", "false")
+		t0.Setenv("LOGIN_BURST", "2")
+		app := makeAppData()
+
+		login := func() *httptest.ResponseRecorder {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.SetBasicAuth("user1", "passwordpassword")
+			w := httptest.NewRecorder()
+			app.handleAuth(w, r)
+			return w
+		}
+		logged := new(bytes.Buffer)
+		log.SetOutput(logged)
+		defer log.SetOutput(os.Stderr)
+		for range 2 {
+			if w := login(); w.Code != http.StatusForbidden {
+				t0.Fatalf("expected 403, got %v", w.Code)
+			}
+		}
+		if w := login(); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+			t0.Errorf("expected 429 with Retry-After, got %v %v", w.Code, w.Header())
+		}
+		if count := bytes.Count(logged.Bytes(), []byte("USERS_ALLOWLIST")); count != 1 {
+			t0.Errorf("expected the fingerprint to be logged once, got %d times: %s", count, logged)
+		}
+	})
+
+	t.Run("it should not count allowlisted logins to empty drives", func(t0 *testing.T) {
+		t0.Setenv("SECRET_KEY", "q38rcNPrHkxBonj16HTKG95zbq0bzmJ189C9A-EgTxg")
+		t0.Setenv("USERS_ALLOWLIST", "jOoFNFNR1zZRWylgYRWi3PYnrn65Yc7AaAwUPTy9NyI")
+		t0.Setenv("LOGIN_BURST", "2")
+		app := makeAppData()
+
+		app.webBaseDir = "./www-test"
+		defer CheckFunc(func() error { return os.RemoveAll(app.webBaseDir) })
+		Check(os.MkdirAll(app.webBaseDir, 0700))
+		for i := range 3 {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.SetBasicAuth("user1", "passwordpassword")
+			w := httptest.NewRecorder()
+			if app.handleAuth(w, r) == nil {
+				t0.Errorf("login %d: expected the allowlisted user to login, got %v", i, w.Code)
+			}
+		}
+	})
+
+	t.Run("it should lock out a username after guessed passwords", func(t0 *testing.T) {
+		t0.Setenv("SECRET_KEY", "q38rcNPrHkxBonj16HTKG95zbq0bzmJ189C9A-EgTxg")
+		t0.Setenv("OPEN_REGISTRATION", "true")
+		t0.Setenv("LOGIN_BURST", "2")
+		app := makeAppData()
+
+		app.webBaseDir = "./www-test"
+		defer CheckFunc(func() error { return os.RemoveAll(app.webBaseDir) })
+		Check(os.MkdirAll(app.webBaseDir, 0700))
+		uploadFile(&app, http.MethodPost, "/data.txt", "data")
+
+		// every guess comes from another client, so only the bucket of the username empties
+		login := func(password string, client int) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = fmt.Sprintf("192.0.2.%d:1234", client)
+			r.SetBasicAuth("user1", password)
+			w := httptest.NewRecorder()
+			app.handleAuth(w, r)
+			return w
+		}
+		if w := login("passwordpassword", 1); w.Code != http.StatusOK {
+			t0.Fatalf("expected a login to the drive with data, got %v", w.Code)
+		}
+		for i := range 2 {
+			if w := login("guessedpassword!", 2+i); w.Code != http.StatusOK {
+				t0.Fatalf("expected the guess to open an empty drive, got %v", w.Code)
+			}
+		}
+		if w := login("passwordpassword", 4); w.Code != http.StatusTooManyRequests {
+			t0.Errorf("expected the username to be locked out, got %v", w.Code)
+		}
+	})
+}
@@ -2,13 +2,17 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"log"
 	"math"
 	"net/http"
 	"os"
 	"path"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -19,16 +23,31 @@ type AppData struct {
 	webBaseDir        string
 	minPasswordLength uint32
 	cookieLifetime    time.Duration
+	extractMaxFiles   int
+	extractMaxSize    int64
+	dropMaxFiles      int
+	dropMaxSize       int64
+	loginLimiter      *LoginLimiter
+	dropImports       *sync.WaitGroup      // running imports of drop boxes
+	sharedBlocks      *DecryptedBlockCache // decrypted blocks shared by all downloads
+	readAheadBlocks   int                  // blocks decrypted in advance for downloads, 0 disables the read-ahead
+	argon2Limiter     *Argon2Limiter       // bounds the memory of concurrent password hashes
 }
 
 func (app *AppData) handleRequest(w http.ResponseWriter, r *http.Request) {
-	urlPath := path.Clean(r.URL.Path)
-	if len(urlPath) == 0 {
+	if isS3Request(r) {
+		app.handleS3(w, r)
+		return
+	}
+
+	reqPath := path.Clean(r.URL.Path)
+	if !strings.HasPrefix(reqPath, "/") {
 		http.Error(w, "invalid path", http.StatusBadRequest)
 		return
 	}
-	if strings.HasSuffix(r.URL.Path, "/") {
-		urlPath = path.Join(urlPath, "index.html")
+	if isReservedPath(reqPath) && !isMountPath(reqPath) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
 	}
 
 	auth := app.handleAuth(w, r)
@@ -37,15 +56,59 @@ func (app *AppData) handleRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cryName := CryPath(urlPath).hash(auth.userKey, auth.userSalt)
-	fsPath := cryName.toFilepath(app.webBaseDir)
+	drive := app.userDrive(auth)
+	if isGroupPath(reqPath) && r.Method != "GET" && r.Method != "HEAD" {
+		unlock, ok := app.tryLockGroupWrites(reqPath)
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(GROUP_ROTATION_RETRY_AFTER/time.Second)))
+			http.Error(w, errGroupRotating.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		defer unlock()
+	}
+	if isMountPath(reqPath) {
+		mountDrive, ownerPath, writable, err := app.resolveMount(auth, reqPath)
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+			return
+		}
+		if r.Method == "MOVE" || r.Method == "COPY" {
+			http.Error(w, "move and copy are not supported for shared paths", http.StatusForbidden)
+			return
+		}
+		if !writable && r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "shared path is read-only", http.StatusForbidden)
+			return
+		}
+		drive, reqPath = mountDrive, ownerPath
+	}
+
+	urlPath := reqPath
+	if strings.HasSuffix(r.URL.Path, "/") {
+		urlPath = path.Join(urlPath, "index.html")
+	}
+	fsPath := drive.locate(CryPath(urlPath))
 
 	switch r.Method {
 	case "GET", "HEAD":
+		if r.URL.Query().Has("archive") {
+			app.handleArchiveDownload(w, r, drive, reqPath)
+			return
+		}
 		lock := fsPath.ReadLock()
 		defer fsPath.ReadUnlock(lock)
-		if file, err := NewCryFileReader(fsPath, auth.userKey); err == nil {
+		if file, err := NewCryFileReader(fsPath, drive.key); err == nil {
 			defer CheckFunc(file.Close)
+			// ServeContent evaluates the conditional headers with the ETag
+			w.Header().Set("ETag", file.etag)
+			if digest := file.reprDigest(); digest != "" {
+				w.Header().Set("Repr-Digest", digest)
+			}
+			file.enableSharedBlocks(app.sharedBlocks)
+			file.enableReadAhead(r.Context(), app.readAheadBlocks)
 			http.ServeContent(w, r, urlPath, file.modTime, file) // urlPath for mime type detection by extension
 		} else if errors.Is(err, os.ErrNotExist) {
 			http.Error(w, "not found", http.StatusNotFound)
@@ -56,10 +119,27 @@ func (app *AppData) handleRequest(w http.ResponseWriter, r *http.Request) {
 		}
 
 	case "POST", "PUT":
+		// digest headers of the request cover the whole multipart body, those of the file part only the file
+		body, err := verifyingReader(r.Body, r.Header, "Content-Digest", "Repr-Digest", "Content-MD5")
+		if err != nil {
+			http.Error(w, sanitizeError(err), http.StatusBadRequest)
+			return
+		}
+		verifyBody := body != r.Body
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{body, r.Body}
 		if err := r.ParseMultipartForm(32 << 20); err != nil { // read first 32MiB into memory and spool to disk on overflow
 			http.Error(w, sanitizeError(err), http.StatusBadRequest)
 			return
 		}
+		if verifyBody {
+			if _, err := io.Copy(io.Discard, r.Body); err != nil { // the epilogue is part of the verified content
+				http.Error(w, sanitizeError(err), http.StatusBadRequest)
+				return
+			}
+		}
 
 		file, handler, err := r.FormFile("file")
 		if err != nil {
@@ -68,10 +148,34 @@ func (app *AppData) handleRequest(w http.ResponseWriter, r *http.Request) {
 		}
 		defer CheckFunc(file.Close)
 
-		if err := WriteCryFile(fsPath, file, handler.Size, auth.userKey); err != nil {
+		if r.URL.Query().Has("extract") || r.FormValue("extract") != "" {
+			app.handleExtract(w, r, drive, reqPath, file, handler.Size)
+			return
+		}
+
+		content, err := verifyingReader(file, http.Header(handler.Header), "Content-Digest", "Repr-Digest", "Content-MD5")
+		if err != nil {
+			http.Error(w, sanitizeError(err), http.StatusBadRequest)
+			return
+		}
+
+		unlock, ok := handlePreconditions(w, r, fsPath, drive.key)
+		if !ok {
+			return
+		}
+		defer unlock()
+		if err := WriteCryFile(fsPath, content, handler.Size, drive.key); isDigestError(err) {
+			http.Error(w, sanitizeError(err), http.StatusBadRequest)
+			return
+		} else if err != nil {
 			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
 			return
 		}
+		if err := drive.link(urlPath, false); err != nil {
+			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+			return
+		}
+		setETag(w, fsPath, drive.key)
 
 		if r.Method == "POST" {
 			w.Header().Set("Location", r.URL.Path)
@@ -83,8 +187,13 @@ func (app *AppData) handleRequest(w http.ResponseWriter, r *http.Request) {
 		return
 
 	case "DELETE":
+		unlock, ok := handlePreconditions(w, r, fsPath, drive.key)
+		if !ok {
+			return
+		}
+		defer unlock()
 		if ok, err := IsFile(string(fsPath)); err == nil && ok {
-			if err = os.Remove(string(fsPath)); err == nil {
+			if err = drive.remove(urlPath); err == nil {
 				w.WriteHeader(http.StatusNoContent)
 				return
 			} else {
@@ -98,6 +207,11 @@ func (app *AppData) handleRequest(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "not found", http.StatusNotFound)
 			return
 		}
+
+	case "MOVE", "COPY":
+		app.handleMoveCopy(w, r, drive, reqPath, "")
+		return
+
 	default:
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -113,14 +227,19 @@ func addSecurityHeaders(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-func makeAppData() (app AppData) {
+func loadAppKey() AppKey {
 	if os.Getenv("SECRET_KEY") == "" {
 		log.Fatalf("Missing env var SECRET_KEY ... here is a good one: SECRET_KEY=%s", strEncode(Try(makeAppKey())))
 	}
-	app.appKey = Try(strDecode(os.Getenv("SECRET_KEY")))
-	if len(app.appKey) != APP_KEY_LENGTH {
+	appKey := Try(strDecode(os.Getenv("SECRET_KEY")))
+	if len(appKey) != APP_KEY_LENGTH {
 		log.Fatal("Wrong length for env var SECRET_KEY")
 	}
+	return appKey
+}
+
+func makeAppData() (app AppData) {
+	app.appKey = loadAppKey()
 
 	app.openRegistration = os.Getenv("OPEN_REGISTRATION") == "true"
 	if app.openRegistration {
@@ -150,6 +269,135 @@ func makeAppData() (app AppData) {
 
 	app.cookieLifetime = 24 * time.Hour
 
+	app.extractMaxFiles = 10000
+	if extractMaxFilesStr := os.Getenv("EXTRACT_MAX_FILES"); extractMaxFilesStr != "" {
+		extractMaxFiles, err := strconv.Atoi(extractMaxFilesStr)
+		if err == nil && extractMaxFiles > 0 {
+			app.extractMaxFiles = extractMaxFiles
+		} else {
+			log.Fatalf("invalid value for EXTRACT_MAX_FILES provided")
+		}
+	}
+
+	app.extractMaxSize = 1 << 30
+	if extractMaxSizeStr := os.Getenv("EXTRACT_MAX_SIZE"); extractMaxSizeStr != "" {
+		extractMaxSize, err := strconv.ParseInt(extractMaxSizeStr, 10, 64)
+		if err == nil && extractMaxSize > 0 {
+			app.extractMaxSize = extractMaxSize
+		} else {
+			log.Fatalf("invalid value for EXTRACT_MAX_SIZE provided")
+		}
+	}
+
+	app.dropMaxFiles = 1000
+	if dropMaxFilesStr := os.Getenv("DROP_MAX_FILES"); dropMaxFilesStr != "" {
+		dropMaxFiles, err := strconv.Atoi(dropMaxFilesStr)
+		if err == nil && dropMaxFiles > 0 {
+			app.dropMaxFiles = dropMaxFiles
+		} else {
+			log.Fatalf("invalid value for DROP_MAX_FILES provided")
+		}
+	}
+
+	app.dropMaxSize = 1 << 30
+	if dropMaxSizeStr := os.Getenv("DROP_MAX_SIZE"); dropMaxSizeStr != "" {
+		dropMaxSize, err := strconv.ParseInt(dropMaxSizeStr, 10, 64)
+		if err == nil && dropMaxSize > 0 {
+			app.dropMaxSize = dropMaxSize
+		} else {
+			log.Fatalf("invalid value for DROP_MAX_SIZE provided")
+		}
+	}
+
+	loginBurst := LOGIN_DEFAULT_BURST
+	if loginBurstStr := os.Getenv("LOGIN_BURST"); loginBurstStr != "" {
+		var err error
+		loginBurst, err = strconv.Atoi(loginBurstStr)
+		if err != nil || loginBurst <= 0 {
+			log.Fatalf("invalid value for LOGIN_BURST provided")
+		}
+		log.Println("LOGIN_BURST is set to", loginBurst)
+	}
+	loginRate := float64(LOGIN_DEFAULT_RATE)
+	if loginRateStr := os.Getenv("LOGIN_RATE"); loginRateStr != "" {
+		var err error
+		loginRate, err = strconv.ParseFloat(loginRateStr, 64)
+		if err != nil || loginRate <= 0 {
+			log.Fatalf("invalid value for LOGIN_RATE provided")
+		}
+		log.Println("LOGIN_RATE is set to", loginRate)
+	}
+	loginLockout := LOGIN_DEFAULT_LOCKOUT
+	if loginLockoutStr := os.Getenv("LOGIN_LOCKOUT"); loginLockoutStr != "" {
+		var err error
+		loginLockout, err = time.ParseDuration(loginLockoutStr)
+		if err != nil || loginLockout <= 0 {
+			log.Fatalf("invalid value for LOGIN_LOCKOUT provided")
+		}
+		log.Println("LOGIN_LOCKOUT is set to", loginLockout)
+	}
+	loginMaxLockout := max(loginLockout, LOGIN_DEFAULT_MAX_LOCKOUT)
+	if loginMaxLockoutStr := os.Getenv("LOGIN_MAX_LOCKOUT"); loginMaxLockoutStr != "" {
+		var err error
+		loginMaxLockout, err = time.ParseDuration(loginMaxLockoutStr)
+		if err != nil || loginMaxLockout < loginLockout {
+			log.Fatalf("invalid value for LOGIN_MAX_LOCKOUT provided")
+		}
+		log.Println("LOGIN_MAX_LOCKOUT is set to", loginMaxLockout)
+	}
+	app.loginLimiter = newLoginLimiter(loginBurst, loginRate, loginLockout, loginMaxLockout)
+	app.dropImports = new(sync.WaitGroup)
+
+	blockCacheSize := int64(BLOCK_CACHE_DEFAULT_SIZE)
+	if blockCacheSizeStr := os.Getenv("BLOCK_CACHE_SIZE"); blockCacheSizeStr != "" {
+		var err error
+		blockCacheSize, err = strconv.ParseInt(blockCacheSizeStr, 10, 64)
+		if err != nil || blockCacheSize < 0 {
+			log.Fatalf("invalid value for BLOCK_CACHE_SIZE provided")
+		}
+		log.Println("BLOCK_CACHE_SIZE is set to", blockCacheSize)
+	}
+	app.sharedBlocks = newDecryptedBlockCache(blockCacheSize)
+
+	app.readAheadBlocks = READ_AHEAD_DEFAULT_BLOCKS
+	if readAheadBlocksStr := os.Getenv("READ_AHEAD_BLOCKS"); readAheadBlocksStr != "" {
+		var err error
+		app.readAheadBlocks, err = strconv.Atoi(readAheadBlocksStr)
+		if err != nil || app.readAheadBlocks < 0 {
+			log.Fatalf("invalid value for READ_AHEAD_BLOCKS provided")
+		}
+		log.Println("READ_AHEAD_BLOCKS is set to", app.readAheadBlocks)
+	}
+
+	argon2MaxConcurrency := runtime.NumCPU()
+	if argon2MaxConcurrencyStr := os.Getenv("ARGON2_MAX_CONCURRENCY"); argon2MaxConcurrencyStr != "" {
+		var err error
+		argon2MaxConcurrency, err = strconv.Atoi(argon2MaxConcurrencyStr)
+		if err != nil || argon2MaxConcurrency <= 0 {
+			log.Fatalf("invalid value for ARGON2_MAX_CONCURRENCY provided")
+		}
+		log.Println("ARGON2_MAX_CONCURRENCY is set to", argon2MaxConcurrency)
+	}
+	argon2MemoryBudget := int64(ARGON2_DEFAULT_MEMORY_BUDGET)
+	if argon2MemoryBudgetStr := os.Getenv("ARGON2_MEMORY_BUDGET"); argon2MemoryBudgetStr != "" {
+		var err error
+		argon2MemoryBudget, err = strconv.ParseInt(argon2MemoryBudgetStr, 10, 64)
+		if err != nil || argon2MemoryBudget <= 0 {
+			log.Fatalf("invalid value for ARGON2_MEMORY_BUDGET provided")
+		}
+		log.Println("ARGON2_MEMORY_BUDGET is set to", argon2MemoryBudget)
+	}
+	argon2QueueLength := ARGON2_DEFAULT_QUEUE_LENGTH
+	if argon2QueueLengthStr := os.Getenv("ARGON2_QUEUE_LENGTH"); argon2QueueLengthStr != "" {
+		var err error
+		argon2QueueLength, err = strconv.Atoi(argon2QueueLengthStr)
+		if err != nil || argon2QueueLength < 0 {
+			log.Fatalf("invalid value for ARGON2_QUEUE_LENGTH provided")
+		}
+		log.Println("ARGON2_QUEUE_LENGTH is set to", argon2QueueLength)
+	}
+	app.argon2Limiter = newArgon2Limiter(argon2MaxConcurrency, argon2MemoryBudget, argon2QueueLength)
+
 	app.webBaseDir = "./www"
 	Check(os.MkdirAll(app.webBaseDir, 0700))
 
@@ -157,8 +405,46 @@ func makeAppData() (app AppData) {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] != "serve" {
+		if err := runCli(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	app := makeAppData()
 
+	if scrubIntervalStr := os.Getenv("SCRUB_INTERVAL"); scrubIntervalStr != "" {
+		scrubInterval, err := time.ParseDuration(scrubIntervalStr)
+		if err != nil || scrubInterval <= 0 {
+			log.Fatalf("invalid value for SCRUB_INTERVAL provided")
+		}
+		log.Println("SCRUB_INTERVAL is set to", scrubInterval)
+		go app.scrubPeriodically(scrubInterval)
+	}
+
+	if metricsAddr := os.Getenv("METRICS_ADDR"); metricsAddr != "" {
+		log.Println("serving metrics on", metricsAddr)
+		go app.serveMetrics(metricsAddr)
+	}
+
 	http.HandleFunc("/", addSecurityHeaders(app.handleRequest))
+	http.HandleFunc(WEBDAV_PREFIX, addSecurityHeaders(app.handleWebdav))
+	http.HandleFunc(WEBDAV_PREFIX+"/", addSecurityHeaders(app.handleWebdav))
+	http.HandleFunc(SYSTEM_PATH_PREFIX+"/s3-credentials", addSecurityHeaders(app.handleS3Credentials))
+	http.HandleFunc(SHARE_PREFIX, addSecurityHeaders(app.handleShare))
+	http.HandleFunc(SHARE_PREFIX+"/", addSecurityHeaders(app.handleShare))
+	http.HandleFunc(DROP_PREFIX, addSecurityHeaders(app.handleDrop))
+	http.HandleFunc(DROP_PREFIX+"/", addSecurityHeaders(app.handleDrop))
+	http.HandleFunc(GRANTS_PREFIX, addSecurityHeaders(app.handleGrants))
+	http.HandleFunc(GRANTS_PREFIX+"/", addSecurityHeaders(app.handleGrants))
+	http.HandleFunc(ACCOUNT_PATH, addSecurityHeaders(app.handleAccount))
+	http.HandleFunc(GROUPS_PREFIX, addSecurityHeaders(app.handleGroups))
+	http.HandleFunc(GROUPS_PREFIX+"/", addSecurityHeaders(app.handleGroups))
+	http.HandleFunc(SESSIONS_PREFIX, addSecurityHeaders(app.handleSessions))
+	http.HandleFunc(SESSIONS_PREFIX+"/", addSecurityHeaders(app.handleSessions))
+	http.HandleFunc(LOGIN_PATH, addSecurityHeaders(app.handleLogin))
+	http.HandleFunc(LOGOUT_PATH, addSecurityHeaders(app.handleLogout))
 	log.Fatal(http.ListenAndServe(":8000", nil))
 }
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
 	"flag"
 	"fmt"
 	"io"
@@ -9,6 +12,8 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path"
+	"strings"
 	"testing"
 )
 
@@ -31,6 +36,10 @@ func TestAppDataParsing(t *testing.T) {
 	t.Setenv("OPEN_REGISTRATION", "true")
 	t.Setenv("MIN_PASSWORD_LENGTH", "123")
 	t.Setenv("USERS_ALLOWLIST", "1,2,3")
+	t.Setenv("BLOCK_CACHE_SIZE", "1024")
+	t.Setenv("READ_AHEAD_BLOCKS", "0")
+	t.Setenv("ARGON2_MAX_CONCURRENCY", "3")
+	t.Setenv("ARGON2_MEMORY_BUDGET", "2048")
 
 	app := makeAppData()
 
@@ -45,12 +54,25 @@ func TestAppDataParsing(t *testing.T) {
 	if app.usersAllowlist != nil {
 		t.Error("wrong usersAllowlist parsed, should be nil as registration is open")
 	}
+
+	if app.sharedBlocks.stats().Capacity != 1024 || app.readAheadBlocks != 0 {
+		t.Error("wrong block cache size or readAheadBlocks parsed")
+	}
+
+	if stats := app.argon2Limiter.stats(); stats.Budget != 2048 || app.argon2Limiter.maxRunning != 3 {
+		t.Errorf("wrong argon2 limits parsed: %+v", stats)
+	}
 }
 
 func TestUnallowedMethod(t *testing.T) {
 	t.Setenv("SECRET_KEY", "q38rcNPrHkxBonj16HTKG95zbq0bzmJ189C9A-EgTxg")
 	t.Setenv("OPEN_REGISTRATION", "true")
 	app := makeAppData()
+
+	app.webBaseDir = "./www-test"
+	defer CheckFunc(func() error { return os.RemoveAll(app.webBaseDir) })
+	Check(os.MkdirAll(app.webBaseDir, 0700))
+
 	r := httptest.NewRequest(http.MethodPatch, "/", nil)
 	r.SetBasicAuth("user1", "passwordpassword") // 16 chars
 	w := httptest.NewRecorder()
@@ -190,3 +212,263 @@ func TestCRUD(t *testing.T) {
 	})
 
 }
+
+func uploadFile(app *AppData, method string, urlPath string, content string) *httptest.ResponseRecorder {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	part := Try(writer.CreateFormFile("file", path.Base(urlPath)))
+	Try(part.Write([]byte(content)))
+	Check(writer.Close())
+
+	r := httptest.NewRequest(method, urlPath, body)
+	r.Header.Add("Content-Type", writer.FormDataContentType())
+	r.SetBasicAuth("user1", "passwordpassword")
+	w := httptest.NewRecorder()
+	app.handleRequest(w, r)
+	return w
+}
+
+func createHome(app *AppData, username Username) {
+	auth := &AuthData{username: username, userSalt: makeUserSalt(app.appKey, username)}
+	auth.userKey = Password("passwordpassword").hash(auth.userSalt)
+	Check(app.userDrive(auth).mkdir("/home"))
+}
+
+func sendRequest(app *AppData, method string, urlPath string, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, urlPath, nil)
+	for key, value := range headers {
+		r.Header.Set(key, value)
+	}
+	r.SetBasicAuth("user1", "passwordpassword")
+	w := httptest.NewRecorder()
+	app.handleRequest(w, r)
+	return w
+}
+
+func TestMoveCopy(t *testing.T) {
+
+	t.Setenv("SECRET_KEY", "q38rcNPrHkxBonj16HTKG95zbq0bzmJ189C9A-EgTxg")
+	t.Setenv("OPEN_REGISTRATION", "true")
+	app := makeAppData()
+
+	app.webBaseDir = "./www-test"
+	defer CheckFunc(func() error { return os.RemoveAll(app.webBaseDir) })
+	Check(os.MkdirAll(app.webBaseDir, 0700))
+
+	for _, urlPath := range []string{"/a/one.txt", "/a/b/two.txt"} {
+		if w := uploadFile(&app, http.MethodPost, urlPath, urlPath); w.Code != http.StatusCreated {
+			t.Fatalf("upload failed: %v", w.Code)
+		}
+	}
+
+	expectContent := func(t0 *testing.T, urlPath string, content string) {
+		w := sendRequest(&app, http.MethodGet, urlPath, nil)
+		if w.Code != http.StatusOK || w.Body.String() != content {
+			t0.Errorf("expected %s to contain %q, got %v %q", urlPath, content, w.Code, w.Body.String())
+		}
+	}
+
+	t.Run("it should move a file", func(t0 *testing.T) {
+		w := sendRequest(&app, "MOVE", "/a/one.txt", map[string]string{"Destination": "/c/one.txt"})
+		if w.Code != http.StatusCreated {
+			t0.Fatalf("expected 201, got %v", w.Code)
+		}
+		expectContent(t0, "/c/one.txt", "/a/one.txt")
+		if w := sendRequest(&app, http.MethodGet, "/a/one.txt", nil); w.Code != http.StatusNotFound {
+			t0.Errorf("expected 404, got %v", w.Code)
+		}
+	})
+
+	t.Run("it should copy a directory", func(t0 *testing.T) {
+		w := sendRequest(&app, "COPY", "/a/", map[string]string{"Destination": "http://example.com/d"})
+		if w.Code != http.StatusCreated {
+			t0.Fatalf("expected 201, got %v", w.Code)
+		}
+		expectContent(t0, "/d/b/two.txt", "/a/b/two.txt")
+		expectContent(t0, "/a/b/two.txt", "/a/b/two.txt")
+	})
+
+	t.Run("it should respect the overwrite header", func(t0 *testing.T) {
+		w := sendRequest(&app, "COPY", "/c/one.txt", map[string]string{"Destination": "/d/b/two.txt", "Overwrite": "F"})
+		if w.Code != http.StatusPreconditionFailed {
+			t0.Errorf("expected 412, got %v", w.Code)
+		}
+		w = sendRequest(&app, "COPY", "/c/one.txt", map[string]string{"Destination": "/d/b/two.txt"})
+		if w.Code != http.StatusNoContent {
+			t0.Errorf("expected 204, got %v", w.Code)
+		}
+		expectContent(t0, "/d/b/two.txt", "/a/one.txt")
+	})
+
+	t.Run("it should move a directory", func(t0 *testing.T) {
+		w := sendRequest(&app, "MOVE", "/d", map[string]string{"Destination": "/e"})
+		if w.Code != http.StatusCreated {
+			t0.Fatalf("expected 201, got %v", w.Code)
+		}
+		expectContent(t0, "/e/b/two.txt", "/a/one.txt")
+		drive := app.userDrive(&AuthData{userKey: Password("passwordpassword").hash(makeUserSalt(app.appKey, "user1")), userSalt: makeUserSalt(app.appKey, "user1")})
+		if entries := Try(drive.readDir("/")); len(entries) != 3 || entries[2].name != "e" || !entries[2].isDir {
+			t0.Errorf("unexpected root directory listing: %v", entries)
+		}
+	})
+
+	t.Run("it should reject moving a directory into itself", func(t0 *testing.T) {
+		w := sendRequest(&app, "MOVE", "/a", map[string]string{"Destination": "/a/b/a"})
+		if w.Code != http.StatusForbidden {
+			t0.Errorf("expected 403, got %v", w.Code)
+		}
+		if w := sendRequest(&app, "MOVE", "/a/b", map[string]string{"Destination": "/a"}); w.Code != http.StatusForbidden {
+			t0.Errorf("expected 403, got %v", w.Code)
+		}
+	})
+
+	t.Run("it should keep the destination if the replacement fails", func(t0 *testing.T) {
+		for _, urlPath := range []string{"/f/old.txt", "/f/old/x.txt", "/f/src/one.txt", "/f/src/two.txt"} {
+			uploadFile(&app, http.MethodPost, urlPath, urlPath)
+		}
+		drive := app.userDrive(&AuthData{userKey: Password("passwordpassword").hash(makeUserSalt(app.appKey, "user1")), userSalt: makeUserSalt(app.appKey, "user1")})
+		Check(os.WriteFile(string(drive.locate(CryPath("/f/src/two.txt"))), []byte("corrupted"), 0600))
+
+		for _, method := range []string{"COPY", "MOVE"} {
+			for _, dst := range []string{"/f/old.txt", "/f/old"} {
+				if w := sendRequest(&app, method, "/f/src", map[string]string{"Destination": dst}); w.Code != http.StatusInternalServerError {
+					t0.Errorf("expected 500, got %v", w.Code)
+				}
+			}
+		}
+		expectContent(t0, "/f/old.txt", "/f/old.txt")
+		expectContent(t0, "/f/old/x.txt", "/f/old/x.txt")
+		expectContent(t0, "/f/src/one.txt", "/f/src/one.txt")
+		if entries := Try(drive.readDir("/f/old")); len(entries) != 1 || entries[0].name != "x.txt" {
+			t0.Errorf("unexpected listing of the destination: %v", entries)
+		}
+		if entries := Try(drive.readDir("/f")); len(entries) != 3 || entries[0].isDir != true || entries[1].isDir {
+			t0.Errorf("unexpected listing: %v", entries)
+		}
+	})
+}
+
+func TestArchiveDownload(t *testing.T) {
+
+	t.Setenv("SECRET_KEY", "q38rcNPrHkxBonj16HTKG95zbq0bzmJ189C9A-EgTxg")
+	t.Setenv("OPEN_REGISTRATION", "true")
+	app := makeAppData()
+
+	app.webBaseDir = "./www-test"
+	defer CheckFunc(func() error { return os.RemoveAll(app.webBaseDir) })
+	Check(os.MkdirAll(app.webBaseDir, 0700))
+
+	files := map[string]string{"one.txt": "content one", "sub/two.txt": "content two"}
+	for name, content := range files {
+		if w := uploadFile(&app, http.MethodPost, "/a/"+name, content); w.Code != http.StatusCreated {
+			t.Fatalf("upload failed: %v", w.Code)
+		}
+	}
+
+	t.Run("it should stream a zip archive", func(t0 *testing.T) {
+		w := sendRequest(&app, http.MethodGet, "/a/?archive=zip", nil)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+			t0.Fatalf("unexpected response: %v %v", w.Code, w.Header())
+		}
+		archive := Try(zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len())))
+		found := 0
+		for _, entry := range archive.File {
+			if content, ok := files[entry.Name]; ok {
+				found++
+				if data := Try(io.ReadAll(Try(entry.Open()))); string(data) != content {
+					t0.Errorf("wrong content for %s: %q", entry.Name, data)
+				}
+			}
+		}
+		if found != len(files) {
+			t0.Errorf("missing files in archive")
+		}
+	})
+
+	t.Run("it should stream a tar.gz archive", func(t0 *testing.T) {
+		w := sendRequest(&app, http.MethodGet, "/a?archive=tar.gz", nil)
+		archive := tar.NewReader(Try(gzip.NewReader(w.Body)))
+		var names []string
+		for header, err := archive.Next(); err == nil; header, err = archive.Next() {
+			names = append(names, header.Name)
+			if content, ok := files[header.Name]; ok && string(Try(io.ReadAll(archive))) != content {
+				t0.Errorf("wrong content for %s", header.Name)
+			}
+		}
+		if strings.Join(names, ",") != "one.txt,sub/,sub/two.txt" {
+			t0.Errorf("unexpected archive entries: %v", names)
+		}
+	})
+
+	t.Run("it should reject unknown formats", func(t0 *testing.T) {
+		if w := sendRequest(&app, http.MethodGet, "/a/?archive=rar", nil); w.Code != http.StatusBadRequest {
+			t0.Errorf("expected 400, got %v", w.Code)
+		}
+	})
+}
+
+func TestArchiveExtract(t *testing.T) {
+
+	t.Setenv("SECRET_KEY", "q38rcNPrHkxBonj16HTKG95zbq0bzmJ189C9A-EgTxg")
+	t.Setenv("OPEN_REGISTRATION", "true")
+	app := makeAppData()
+
+	app.webBaseDir = "./www-test"
+	defer CheckFunc(func() error { return os.RemoveAll(app.webBaseDir) })
+	Check(os.MkdirAll(app.webBaseDir, 0700))
+
+	zipBuffer := new(bytes.Buffer)
+	zipWriter := zip.NewWriter(zipBuffer)
+	for name, content := range map[string]string{"pkg/one.txt": "content one", "pkg/sub/two.txt": "content two", "../evil.txt": "evil"} {
+		Try(Try(zipWriter.Create(name)).Write([]byte(content)))
+	}
+	Check(zipWriter.Close())
+
+	t.Run("it should extract a zip archive", func(t0 *testing.T) {
+		w := uploadFile(&app, http.MethodPost, "/x/?extract", zipBuffer.String())
+		if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"files":2`) || !strings.Contains(w.Body.String(), `"reason":"path traversal"`) {
+			t0.Fatalf("unexpected response: %v %s", w.Code, w.Body.String())
+		}
+		if w := sendRequest(&app, http.MethodGet, "/x/pkg/sub/two.txt", nil); w.Body.String() != "content two" {
+			t0.Errorf("unexpected content: %q", w.Body.String())
+		}
+		if w := sendRequest(&app, http.MethodGet, "/evil.txt", nil); w.Code != http.StatusNotFound {
+			t0.Errorf("expected 404, got %v", w.Code)
+		}
+	})
+
+	t.Run("it should extract a subdirectory of a tar.gz archive", func(t0 *testing.T) {
+		tarBuffer := new(bytes.Buffer)
+		compressor := gzip.NewWriter(tarBuffer)
+		tarWriter := tar.NewWriter(compressor)
+		for name, content := range map[string]string{"package/min/vs/loader.js": "loader", "package/esm/other.js": "other"} {
+			Check(tarWriter.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Size: int64(len(content)), Mode: 0600}))
+			Try(tarWriter.Write([]byte(content)))
+		}
+		Check(tarWriter.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "package/min/vs/link", Linkname: "/etc/passwd"}))
+		Check(tarWriter.Close())
+		Check(compressor.Close())
+
+		w := uploadFile(&app, http.MethodPut, "/vs?extract=package/min/vs", tarBuffer.String())
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"files":1`) || !strings.Contains(w.Body.String(), "unsupported entry type") {
+			t0.Fatalf("unexpected response: %v %s", w.Code, w.Body.String())
+		}
+		if w := sendRequest(&app, http.MethodGet, "/vs/loader.js", nil); w.Body.String() != "loader" {
+			t0.Errorf("unexpected content: %q", w.Body.String())
+		}
+	})
+
+	t.Run("it should enforce the size limits", func(t0 *testing.T) {
+		app.extractMaxSize = 15
+		defer func() { app.extractMaxSize = 1 << 30 }()
+		if w := uploadFile(&app, http.MethodPost, "/y/?extract", zipBuffer.String()); w.Code != http.StatusRequestEntityTooLarge {
+			t0.Errorf("expected 413, got %v %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("it should reject unknown formats", func(t0 *testing.T) {
+		if w := uploadFile(&app, http.MethodPost, "/z/?extract", "plain text"); w.Code != http.StatusUnsupportedMediaType {
+			t0.Errorf("expected 415, got %v", w.Code)
+		}
+	})
+}
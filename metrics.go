@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// handleMetrics reports internal counters in the Prometheus text format. it is served on a separate address only
+func (app *AppData) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	cache := app.sharedBlocks.stats()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Header().Set("Cache-Control", "no-store")
+	metric := func(name string, kind string, help string, value any) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+	}
+	metric("crydrv_block_cache_hits_total", "counter", "Decrypted blocks served from the cache.", cache.Hits)
+	metric("crydrv_block_cache_misses_total", "counter", "Blocks which had to be decrypted.", cache.Misses)
+	metric("crydrv_block_cache_evictions_total", "counter", "Blocks dropped to stay within the capacity.", cache.Evictions)
+	metric("crydrv_block_cache_entries", "gauge", "Blocks in the cache.", cache.Entries)
+	metric("crydrv_block_cache_bytes", "gauge", "Memory used by the cache.", cache.Bytes)
+	metric("crydrv_block_cache_capacity_bytes", "gauge", "Configured capacity of the cache.", cache.Capacity)
+
+	argon2 := app.argon2Limiter.stats()
+	metric("crydrv_argon2_running", "gauge", "Password hashes being computed.", argon2.Running)
+	metric("crydrv_argon2_queued", "gauge", "Password hashes waiting for a slot.", argon2.Queued)
+	metric("crydrv_argon2_memory_bytes", "gauge", "Memory reserved by running password hashes.", argon2.Memory)
+	metric("crydrv_argon2_memory_budget_bytes", "gauge", "Configured memory budget for password hashes.", argon2.Budget)
+	metric("crydrv_argon2_completed_total", "counter", "Password hashes computed.", argon2.Completed)
+	metric("crydrv_argon2_rejected_total", "counter", "Password hashes rejected with 503 as the queue was full.", argon2.Rejected)
+	metric("crydrv_argon2_wait_seconds_total", "counter", "Time spent waiting in the queue.", argon2.WaitTime.Seconds())
+}
+
+func (app *AppData) serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", app.handleMetrics)
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+func parseDestination(r *http.Request, prefix string) (string, error) {
+	destination := r.Header.Get("Destination")
+	if destination == "" {
+		return "", errors.New("missing destination header")
+	}
+	u, err := url.Parse(destination)
+	if err != nil {
+		return "", err
+	}
+	if u.Host != "" && u.Host != r.Host {
+		return "", errors.New("destination must be on the same server")
+	}
+	if !strings.HasPrefix(u.Path, prefix+"/") {
+		return "", errors.New("invalid destination path")
+	}
+	dstPath := path.Clean(strings.TrimPrefix(u.Path, prefix))
+	if isReservedPath(dstPath) {
+		return "", errors.New("destination path is reserved")
+	}
+	return dstPath, nil
+}
+
+// handleMoveCopy implements the MOVE and COPY methods as specified by WebDAV (RFC 4918).
+// prefix is the url path the drive is served under
+func (app *AppData) handleMoveCopy(w http.ResponseWriter, r *http.Request, drive *CryDrive, srcPath string, prefix string) {
+	dstPath, err := parseDestination(r, prefix)
+	if err != nil {
+		http.Error(w, sanitizeError(err), http.StatusBadRequest)
+		return
+	}
+	if srcPath == "/" || dstPath == "/" {
+		http.Error(w, "cannot move or copy the root directory", http.StatusForbidden)
+		return
+	}
+	if dstPath == srcPath || strings.HasPrefix(dstPath, srcPath+"/") || strings.HasPrefix(srcPath, dstPath+"/") {
+		http.Error(w, "destination must not be the source itself, inside of it or contain it", http.StatusForbidden)
+		return
+	}
+
+	recursive := true
+	switch r.Header.Get("Depth") {
+	case "", "infinity":
+	case "0":
+		if r.Method == "COPY" {
+			recursive = false
+			break
+		}
+		fallthrough
+	default:
+		http.Error(w, "invalid depth header", http.StatusBadRequest)
+		return
+	}
+
+	srcExists, err := drive.exists(srcPath)
+	if err != nil {
+		http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+		return
+	} else if !srcExists {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	if parentIsFile, err := drive.isFile(path.Dir(dstPath)); err != nil {
+		http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+		return
+	} else if parentIsFile {
+		http.Error(w, "parent of destination is a file", http.StatusConflict)
+		return
+	}
+
+	dstExists, err := drive.exists(dstPath)
+	if err != nil {
+		http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+		return
+	}
+	if dstExists && r.Header.Get("Overwrite") == "F" {
+		http.Error(w, "destination already exists", http.StatusPreconditionFailed)
+		return
+	}
+
+	// an existing destination is only removed once its replacement is complete
+	switch {
+	case dstExists && r.Method == "MOVE":
+		// copied and removed afterwards, so a failure leaves both the source and the destination as they were
+		if err = drive.replace(dstPath, func() error { return drive.copy(srcPath, dstPath, true) }); err == nil {
+			err = drive.remove(srcPath)
+		}
+	case dstExists:
+		err = drive.replace(dstPath, func() error { return drive.copy(srcPath, dstPath, recursive) })
+	case r.Method == "MOVE":
+		err = drive.move(srcPath, dstPath)
+	default:
+		err = drive.copy(srcPath, dstPath, recursive)
+	}
+	if err != nil {
+		http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+		return
+	}
+
+	if dstExists {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.Header().Set("Location", prefix+dstPath)
+		w.WriteHeader(http.StatusCreated)
+	}
+}
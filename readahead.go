@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+const READ_AHEAD_DEFAULT_BLOCKS = 2
+
+type pendingBlock struct {
+	done   chan struct{}
+	block  *PlaintextBlock
+	err    error
+	cancel context.CancelFunc
+}
+
+// ReadAhead decrypts the next blocks of a sequential read on worker goroutines, so decryption and sending overlap.
+// at most `blocks` blocks are pending per reader
+type ReadAhead struct {
+	sync.Mutex
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	blocks  int64
+	pending map[int64]*pendingBlock
+	running sync.WaitGroup // workers and discarded blocks, which stop waits for
+}
+
+// enableReadAhead starts prefetching with the next read. the context ends it, e.g. when the client disconnects
+func (f *CryFileReader) enableReadAhead(ctx context.Context, blocks int) {
+	if blocks <= 0 || f.blocks <= 1 {
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	f.readAhead = &ReadAhead{ctx: ctx, cancel: cancel, blocks: int64(blocks), pending: map[int64]*pendingBlock{}}
+}
+
+func (readAhead *ReadAhead) start(f *CryFileReader, index int64) *pendingBlock {
+	ctx, cancel := context.WithCancel(readAhead.ctx)
+	pending := &pendingBlock{done: make(chan struct{}), cancel: cancel}
+	readAhead.running.Add(1)
+	go func() {
+		defer readAhead.running.Done()
+		defer close(pending.done)
+		if pending.err = ctx.Err(); pending.err == nil {
+			pending.block, pending.err = f.loadBlock(index)
+		}
+	}()
+	return pending
+}
+
+// discard cancels a pending block and returns its buffer to the pool once the worker is done with it
+func (readAhead *ReadAhead) discard(pending *pendingBlock) {
+	pending.cancel()
+	readAhead.running.Add(1)
+	go func() {
+		defer readAhead.running.Done()
+		<-pending.done
+		pending.block.release()
+	}()
+}
+
+// take returns a block and prefetches the following ones. blocks outside of the new window are dropped, as the client has seeked
+func (readAhead *ReadAhead) take(f *CryFileReader, index int64) (*PlaintextBlock, error) {
+	readAhead.Lock()
+	if err := readAhead.ctx.Err(); err != nil { // stopped or the client is gone
+		readAhead.Unlock()
+		return nil, err
+	}
+	for i, pending := range readAhead.pending {
+		if i < index || i > index+readAhead.blocks {
+			readAhead.discard(pending)
+			delete(readAhead.pending, i)
+		}
+	}
+	pending := readAhead.pending[index]
+	delete(readAhead.pending, index)
+	for i := index + 1; i <= index+readAhead.blocks && i < f.blocks; i++ {
+		if readAhead.pending[i] == nil {
+			readAhead.pending[i] = readAhead.start(f, i)
+		}
+	}
+	readAhead.Unlock()
+
+	if pending == nil {
+		return f.loadBlock(index)
+	}
+	defer pending.cancel()
+	<-pending.done // a cancelled worker doesn't start decrypting, so this waits for at most one block
+	return pending.block, pending.err
+}
+
+// stop discards the pending blocks and waits for the workers, so no file read happens after the reader is closed
+func (readAhead *ReadAhead) stop() {
+	readAhead.Lock()
+	readAhead.cancel()
+	for _, pending := range readAhead.pending {
+		readAhead.discard(pending)
+	}
+	readAhead.pending = map[int64]*pendingBlock{}
+	readAhead.Unlock()
+	readAhead.running.Wait()
+}
@@ -0,0 +1,823 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// all buckets map to the root of the drive of the authenticated user
+const S3_BUCKET_NAME = "crydrv"
+const S3_NAMESPACE = "http://s3.amazonaws.com/doc/2006-03-01/"
+const S3_MAX_KEYS = 1000
+const S3_MAX_PARTS = 10000
+
+// multipart uploads are kept as encrypted part files until they are completed
+const S3_UPLOAD_PREFIX = "s3upload:"
+const S3_PART_PREFIX = "s3part:"
+const S3_UPLOAD_LIST_CRYPATH = "s3uploads:"  // ids of all unfinished uploads of a user
+const S3_UPLOAD_MAX_AGE = 7 * 24 * time.Hour // unfinished uploads are removed afterwards
+
+type s3Bucket struct {
+	Name         string
+	CreationDate string
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string `xml:",omitempty"`
+	Size         int64
+	StorageClass string
+}
+
+type s3CommonPrefix struct {
+	Prefix string
+}
+
+type s3ListBucketResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Xmlns                 string   `xml:"xmlns,attr"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	EncodingType          string `xml:",omitempty"`
+	MaxKeys               int
+	KeyCount              int
+	IsTruncated           bool
+	Marker                *string `xml:",omitempty"`
+	NextMarker            string  `xml:",omitempty"`
+	StartAfter            string  `xml:",omitempty"`
+	ContinuationToken     string  `xml:",omitempty"`
+	NextContinuationToken string  `xml:",omitempty"`
+	Contents              []s3Object
+	CommonPrefixes        []s3CommonPrefix
+}
+
+type s3Upload struct {
+	Key     string
+	Created time.Time
+	Parts   map[int]int64 // part number -> size
+}
+
+func isS3Request(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Authorization"), S3_ALGORITHM) || r.URL.Query().Get("X-Amz-Algorithm") == S3_ALGORITHM
+}
+
+func s3Time(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, err error) {
+	var s3err *S3Error
+	if !errors.As(err, &s3err) {
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			s3err = &S3Error{http.StatusNotFound, "NoSuchKey", "the specified key does not exist"}
+		case errors.Is(err, ErrDigestMismatch), errors.Is(err, errS3ChunkSignature):
+			s3err = &S3Error{http.StatusBadRequest, "BadDigest", err.Error()}
+		default:
+			s3err = &S3Error{http.StatusInternalServerError, "InternalError", sanitizeError(err)}
+		}
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(s3err.status)
+	if r.Method != "HEAD" {
+		_, _ = io.WriteString(w, xml.Header+"<Error><Code>"+s3err.code+"</Code><Message>"+xmlEscape(s3err.message)+"</Message><Resource>"+xmlEscape(r.URL.Path)+"</Resource></Error>")
+	}
+}
+
+// readS3XML reads the whole body before decoding it, as the payload hash is only verified at its end
+func readS3XML(body io.Reader, value any) error {
+	data, err := io.ReadAll(io.LimitReader(body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if err := xml.Unmarshal(data, value); err != nil {
+		return &S3Error{http.StatusBadRequest, "MalformedXML", err.Error()}
+	}
+	return nil
+}
+
+func writeS3XML(w http.ResponseWriter, value any) {
+	data, err := xml.Marshal(value)
+	Check(err)
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = io.WriteString(w, xml.Header+string(data))
+}
+
+// s3Path maps an object key to a drive path. keys which are not in canonical form are rejected, as they would alias other keys
+func s3Path(key string) (string, error) {
+	urlPath := "/" + strings.TrimSuffix(key, "/")
+	if path.Clean(urlPath) != urlPath || urlPath == "/" || isReservedPath(urlPath) {
+		return "", &S3Error{http.StatusBadRequest, "InvalidArgument", "invalid object key"}
+	}
+	return urlPath, nil
+}
+
+func (app *AppData) handleS3Credentials(w http.ResponseWriter, r *http.Request) {
+	auth := app.handleAuth(w, r)
+	if auth == nil {
+		// handleAuth has already set the http response
+		return
+	}
+	accessKeyID, secretAccessKey, err := app.makeS3Credentials(auth)
+	if err != nil {
+		http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = io.WriteString(w, "AWS_ACCESS_KEY_ID="+accessKeyID+"\nAWS_SECRET_ACCESS_KEY="+secretAccessKey+"\n")
+}
+
+// handleS3 implements the subset of the S3 api (path-style requests only) used by common backup and sync tools
+func (app *AppData) handleS3(w http.ResponseWriter, r *http.Request) {
+	auth, signer, err := app.s3Authenticate(r)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	drive := app.userDrive(auth)
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+
+	switch {
+	case bucket == "" && r.Method == "GET":
+		writeS3XML(w, struct {
+			XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+			Xmlns   string   `xml:"xmlns,attr"`
+			Owner   struct{ ID string }
+			Buckets []s3Bucket `xml:"Buckets>Bucket"`
+		}{Xmlns: S3_NAMESPACE, Buckets: []s3Bucket{{Name: S3_BUCKET_NAME, CreationDate: s3Time(time.Unix(0, 0))}}})
+	case bucket == "":
+		writeS3Error(w, r, &S3Error{http.StatusMethodNotAllowed, "MethodNotAllowed", "method not allowed"})
+
+	case key == "" && (r.Method == "HEAD" || r.Method == "PUT"):
+		w.WriteHeader(http.StatusOK) // the bucket always exists
+	case key == "" && r.Method == "GET" && query.Has("location"):
+		writeS3XML(w, struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+			Xmlns   string   `xml:"xmlns,attr"`
+		}{Xmlns: S3_NAMESPACE})
+	case key == "" && r.Method == "GET" && query.Has("uploads"):
+		app.s3ListMultipartUploads(w, r, drive, bucket)
+	case key == "" && r.Method == "GET":
+		app.s3ListObjects(w, r, drive, bucket)
+	case key == "" && r.Method == "POST" && query.Has("delete"):
+		app.s3DeleteObjects(w, r, drive, signer)
+	case key == "":
+		writeS3Error(w, r, &S3Error{http.StatusMethodNotAllowed, "MethodNotAllowed", "method not allowed"})
+
+	case r.Method == "POST" && query.Has("uploads"):
+		app.s3CreateMultipartUpload(w, r, drive, bucket, key)
+	case r.Method == "PUT" && query.Has("uploadId"):
+		app.s3UploadPart(w, r, drive, signer, key)
+	case r.Method == "POST" && query.Has("uploadId"):
+		app.s3CompleteMultipartUpload(w, r, drive, signer, bucket, key)
+	case r.Method == "DELETE" && query.Has("uploadId"):
+		app.s3AbortMultipartUpload(w, r, drive, key)
+	case r.Method == "GET" && query.Has("uploadId"):
+		app.s3ListParts(w, r, drive, bucket, key)
+
+	case r.Method == "GET" || r.Method == "HEAD":
+		app.s3GetObject(w, r, drive, key)
+	case r.Method == "PUT" && r.Header.Get("X-Amz-Copy-Source") != "":
+		app.s3CopyObject(w, r, drive, key)
+	case r.Method == "PUT":
+		app.s3PutObject(w, r, drive, signer, key)
+	case r.Method == "DELETE":
+		if err := app.s3DeleteObject(drive, key); err != nil {
+			writeS3Error(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3Error(w, r, &S3Error{http.StatusMethodNotAllowed, "MethodNotAllowed", "method not allowed"})
+	}
+}
+
+func (app *AppData) s3GetObject(w http.ResponseWriter, r *http.Request, drive *CryDrive, key string) {
+	urlPath, err := s3Path(key)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	if strings.HasSuffix(key, "/") { // folder marker
+		if ok, err := drive.isDir(urlPath); err != nil {
+			writeS3Error(w, r, err)
+			return
+		} else if !ok {
+			writeS3Error(w, r, os.ErrNotExist)
+			return
+		}
+		w.Header().Set("Content-Length", "0")
+		return
+	}
+
+	fsPath := drive.locate(CryPath(urlPath))
+	lock := fsPath.ReadLock()
+	defer fsPath.ReadUnlock(lock)
+	file, err := NewCryFileReader(fsPath, drive.key)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	defer CheckFunc(file.Close)
+	w.Header().Set("ETag", file.etag)
+	file.enableSharedBlocks(app.sharedBlocks)
+	file.enableReadAhead(r.Context(), app.readAheadBlocks)
+	http.ServeContent(w, r, urlPath, file.modTime, file)
+}
+
+func (app *AppData) s3PutObject(w http.ResponseWriter, r *http.Request, drive *CryDrive, signer *S3Signer, key string) {
+	urlPath, err := s3Path(key)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	if strings.HasSuffix(key, "/") { // folder marker
+		if err := drive.mkdir(urlPath); err != nil {
+			writeS3Error(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	body, size, err := s3Body(r, signer)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	if contentMD5 := r.Header.Get("Content-Md5"); contentMD5 != "" {
+		expected, err := base64.StdEncoding.DecodeString(contentMD5)
+		if err != nil {
+			writeS3Error(w, r, &S3Error{http.StatusBadRequest, "InvalidDigest", "invalid Content-MD5"})
+			return
+		}
+		body = &HashVerifyingReader{reader: body, hash: md5.New(), expected: expected}
+	}
+
+	if err := WriteCryFile(drive.locate(CryPath(urlPath)), body, size, drive.key); err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	if err := drive.link(urlPath, false); err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	// the same etag as for reads and listings, so sync tools can compare them
+	setETag(w, drive.locate(CryPath(urlPath)), drive.key)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (app *AppData) s3CopyObject(w http.ResponseWriter, r *http.Request, drive *CryDrive, key string) {
+	dstPath, err := s3Path(key)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	source := strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "/")
+	if decoded, err := url.PathUnescape(source); err == nil {
+		source = decoded
+	}
+	_, sourceKey, _ := strings.Cut(source, "/")
+	srcPath, err := s3Path(sourceKey)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	if ok, err := drive.isFile(srcPath); err != nil {
+		writeS3Error(w, r, err)
+		return
+	} else if !ok {
+		writeS3Error(w, r, os.ErrNotExist)
+		return
+	}
+	if srcPath != dstPath {
+		if err := drive.copy(srcPath, dstPath, false); err != nil {
+			writeS3Error(w, r, err)
+			return
+		}
+	}
+	writeS3XML(w, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		Xmlns        string   `xml:"xmlns,attr"`
+		LastModified string
+	}{Xmlns: S3_NAMESPACE, LastModified: s3Time(time.Now())})
+}
+
+func (app *AppData) s3DeleteObject(drive *CryDrive, key string) error {
+	urlPath, err := s3Path(key)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(key, "/") { // folder markers only vanish with the last object inside
+		if entries, err := drive.readDir(urlPath); err != nil || len(entries) > 0 {
+			return IgnoreNotExist(err)
+		}
+	} else if ok, err := drive.isFile(urlPath); err != nil || !ok {
+		return err
+	}
+	return IgnoreNotExist(drive.remove(urlPath))
+}
+
+func (app *AppData) s3DeleteObjects(w http.ResponseWriter, r *http.Request, drive *CryDrive, signer *S3Signer) {
+	body, _, err := s3Body(r, signer)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	request := struct {
+		Quiet   bool
+		Objects []struct{ Key string } `xml:"Object"`
+	}{}
+	if err := readS3XML(body, &request); err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+
+	type deleted struct{ Key string }
+	type deleteError struct{ Key, Code, Message string }
+	result := struct {
+		XMLName xml.Name      `xml:"DeleteResult"`
+		Xmlns   string        `xml:"xmlns,attr"`
+		Deleted []deleted     `xml:"Deleted"`
+		Errors  []deleteError `xml:"Error"`
+	}{Xmlns: S3_NAMESPACE}
+	for _, object := range request.Objects {
+		if err := app.s3DeleteObject(drive, object.Key); err != nil {
+			result.Errors = append(result.Errors, deleteError{object.Key, "InternalError", sanitizeError(err)})
+		} else if !request.Quiet {
+			result.Deleted = append(result.Deleted, deleted{object.Key})
+		}
+	}
+	writeS3XML(w, result)
+}
+
+func (app *AppData) s3ListObjects(w http.ResponseWriter, r *http.Request, drive *CryDrive, bucket string) {
+	query := r.URL.Query()
+	v2 := query.Get("list-type") == "2"
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+
+	result := s3ListBucketResult{
+		Xmlns:        S3_NAMESPACE,
+		Name:         bucket,
+		Prefix:       prefix,
+		Delimiter:    delimiter,
+		EncodingType: query.Get("encoding-type"),
+		MaxKeys:      S3_MAX_KEYS,
+	}
+	if maxKeys, err := strconv.Atoi(query.Get("max-keys")); err == nil && maxKeys >= 0 && maxKeys < S3_MAX_KEYS {
+		result.MaxKeys = maxKeys
+	}
+
+	marker := query.Get("marker")
+	if v2 {
+		result.StartAfter = query.Get("start-after")
+		result.ContinuationToken = query.Get("continuation-token")
+		marker = result.StartAfter
+		if result.ContinuationToken != "" {
+			token, err := strDecode(result.ContinuationToken)
+			if err != nil {
+				writeS3Error(w, r, &S3Error{http.StatusBadRequest, "InvalidArgument", "invalid continuation token"})
+				return
+			}
+			marker = string(token)
+		}
+	} else {
+		result.Marker = &marker
+	}
+
+	encode := func(key string) string {
+		if result.EncodingType == "url" {
+			return awsURIEncode(key, false)
+		}
+		return key
+	}
+
+	// start at the deepest directory which is entirely covered by the prefix
+	startDir := "/" + prefix[:strings.LastIndex(prefix, "/")+1]
+	lastKey := ""
+	errDone := errors.New("done")
+	err := drive.walk(path.Clean(startDir), func(urlPath string, isDir bool) (bool, error) {
+		key := strings.TrimPrefix(urlPath, "/")
+		dirKey := key + "/"
+		if isDir {
+			if !strings.HasPrefix(dirKey, prefix) && !strings.HasPrefix(prefix, dirKey) {
+				return false, nil
+			}
+			if dirKey < marker && !strings.HasPrefix(marker, dirKey) {
+				return false, nil // the whole directory has already been listed
+			}
+		} else if !strings.HasPrefix(key, prefix) || key <= marker {
+			return false, nil
+		}
+
+		name := key
+		if isDir {
+			name = dirKey
+		}
+		if delimiter != "" && strings.HasPrefix(name, prefix) {
+			if index := strings.Index(name[len(prefix):], delimiter); index >= 0 {
+				commonPrefix := name[:len(prefix)+index+len(delimiter)]
+				if commonPrefix <= marker || commonPrefix == lastKey {
+					return false, nil
+				}
+				if result.KeyCount >= result.MaxKeys {
+					result.IsTruncated = true
+					return false, errDone
+				}
+				result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: encode(commonPrefix)})
+				result.KeyCount++
+				lastKey = commonPrefix
+				return false, nil
+			}
+		}
+		if isDir {
+			return true, nil
+		}
+
+		if result.KeyCount >= result.MaxKeys {
+			result.IsTruncated = true
+			return false, errDone
+		}
+		info, err := drive.davStat(urlPath)
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		result.Contents = append(result.Contents, s3Object{Key: encode(key), LastModified: s3Time(info.modTime), ETag: info.etag, Size: info.size, StorageClass: "STANDARD"})
+		result.KeyCount++
+		lastKey = key
+		return false, nil
+	})
+	if err != nil && err != errDone {
+		writeS3Error(w, r, err)
+		return
+	}
+
+	if result.IsTruncated {
+		if v2 {
+			result.NextContinuationToken = strEncode([]byte(lastKey))
+		} else {
+			result.NextMarker = lastKey
+		}
+	}
+	writeS3XML(w, result)
+}
+
+// ---------- multipart uploads ----------
+
+func (drive *CryDrive) readS3Upload(uploadID string) (*s3Upload, error) {
+	fsPath := drive.locate(CryPath(S3_UPLOAD_PREFIX + uploadID))
+	lock := fsPath.ReadLock()
+	defer fsPath.ReadUnlock(lock)
+	file, err := NewCryFileReader(fsPath, drive.key)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, &S3Error{http.StatusNotFound, "NoSuchUpload", "the specified upload does not exist"}
+	} else if err != nil {
+		return nil, err
+	}
+	defer IgnoreErrFunc(file.Close)
+	upload := new(s3Upload)
+	return upload, json.NewDecoder(file).Decode(upload)
+}
+
+func (drive *CryDrive) writeS3Upload(uploadID string, upload *s3Upload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	return WriteCryFile(drive.locate(CryPath(S3_UPLOAD_PREFIX+uploadID)), strings.NewReader(string(data)), int64(len(data)), drive.key)
+}
+
+func s3PartPath(uploadID string, partNumber int) CryPath {
+	return CryPath(S3_PART_PREFIX + uploadID + ":" + strconv.Itoa(partNumber))
+}
+
+func (app *AppData) s3CreateMultipartUpload(w http.ResponseWriter, r *http.Request, drive *CryDrive, bucket string, key string) {
+	if _, err := s3Path(key); err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	if _, err := drive.readS3Uploads(time.Now()); err != nil { // removes abandoned uploads
+		writeS3Error(w, r, err)
+		return
+	}
+	uploadID := strEncode(Try(makeAppKey()))
+	if err := drive.writeS3Upload(uploadID, &s3Upload{Key: key, Created: time.Now(), Parts: map[int]int64{}}); err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	if err := drive.updateS3UploadList(func(ids []string) []string { return append(ids, uploadID) }); err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	writeS3XML(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Xmlns: S3_NAMESPACE, Bucket: bucket, Key: key, UploadId: uploadID})
+}
+
+func (app *AppData) s3UploadPart(w http.ResponseWriter, r *http.Request, drive *CryDrive, signer *S3Signer, key string) {
+	uploadID := r.URL.Query().Get("uploadId")
+	partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > S3_MAX_PARTS {
+		writeS3Error(w, r, &S3Error{http.StatusBadRequest, "InvalidArgument", "invalid part number"})
+		return
+	}
+	if upload, err := drive.readS3Upload(uploadID); err != nil {
+		writeS3Error(w, r, err)
+		return
+	} else if upload.Key != key {
+		writeS3Error(w, r, &S3Error{http.StatusNotFound, "NoSuchUpload", "the specified upload does not exist"})
+		return
+	}
+
+	body, size, err := s3Body(r, signer)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	checksum := md5.New()
+	counter := &countingWriter{hash: checksum}
+	if err := WriteCryFile(drive.locate(s3PartPath(uploadID, partNumber)), io.TeeReader(body, counter), size, drive.key); err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+
+	defer lockMetadata(drive.locate(CryPath(S3_UPLOAD_PREFIX + uploadID)))()
+	upload, err := drive.readS3Upload(uploadID)
+	if err == nil {
+		upload.Parts[partNumber] = counter.size
+		err = drive.writeS3Upload(uploadID, upload)
+	}
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", `"`+hex.EncodeToString(checksum.Sum(nil))+`"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+type countingWriter struct {
+	hash hash.Hash
+	size int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.size += int64(len(p))
+	return c.hash.Write(p)
+}
+
+func (app *AppData) s3CompleteMultipartUpload(w http.ResponseWriter, r *http.Request, drive *CryDrive, signer *S3Signer, bucket string, key string) {
+	uploadID := r.URL.Query().Get("uploadId")
+	urlPath, err := s3Path(key)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	body, _, err := s3Body(r, signer)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	request := struct {
+		Parts []struct{ PartNumber int } `xml:"Part"`
+	}{}
+	if err := readS3XML(body, &request); err != nil {
+		writeS3Error(w, r, err)
+		return
+	} else if len(request.Parts) == 0 {
+		writeS3Error(w, r, &S3Error{http.StatusBadRequest, "MalformedXML", "invalid part list"})
+		return
+	}
+	upload, err := drive.readS3Upload(uploadID)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	} else if upload.Key != key {
+		writeS3Error(w, r, &S3Error{http.StatusNotFound, "NoSuchUpload", "the specified upload does not exist"})
+		return
+	}
+
+	var readers []io.Reader
+	var size int64
+	for i, part := range request.Parts {
+		partSize, ok := upload.Parts[part.PartNumber]
+		if !ok || (i > 0 && part.PartNumber <= request.Parts[i-1].PartNumber) {
+			writeS3Error(w, r, &S3Error{http.StatusBadRequest, "InvalidPart", "invalid part " + strconv.Itoa(part.PartNumber)})
+			return
+		}
+		fsPath := drive.locate(s3PartPath(uploadID, part.PartNumber))
+		lock := fsPath.ReadLock()
+		file, err := NewCryFileReader(fsPath, drive.key)
+		fsPath.ReadUnlock(lock) // parts are replaced atomically, so the open file stays valid
+		if err != nil {
+			writeS3Error(w, r, err)
+			return
+		}
+		defer IgnoreErrFunc(file.Close)
+		readers = append(readers, file)
+		size += partSize
+	}
+
+	fsPath := drive.locate(CryPath(urlPath))
+	if err := WriteCryFile(fsPath, io.MultiReader(readers...), size, drive.key); err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	if err := drive.link(urlPath, false); err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	if err := drive.removeS3Upload(uploadID, upload); err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	etag, err := readETag(fsPath, drive.key)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+
+	writeS3XML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{Xmlns: S3_NAMESPACE, Bucket: bucket, Key: key, ETag: etag})
+}
+
+func (drive *CryDrive) removeS3Upload(uploadID string, upload *s3Upload) error {
+	for partNumber := range upload.Parts {
+		if err := IgnoreNotExist(drive.removeFile(s3PartPath(uploadID, partNumber))); err != nil {
+			return err
+		}
+	}
+	if err := IgnoreNotExist(drive.removeFile(CryPath(S3_UPLOAD_PREFIX + uploadID))); err != nil {
+		return err
+	}
+	return drive.updateS3UploadList(func(ids []string) []string {
+		return slices.DeleteFunc(ids, func(id string) bool { return id == uploadID })
+	})
+}
+
+func (drive *CryDrive) readS3UploadList() ([]string, error) {
+	fsPath := drive.locate(S3_UPLOAD_LIST_CRYPATH)
+	lock := fsPath.ReadLock()
+	defer fsPath.ReadUnlock(lock)
+
+	file, err := NewCryFileReader(fsPath, drive.key)
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer IgnoreErrFunc(file.Close)
+	var ids []string
+	return ids, json.NewDecoder(file).Decode(&ids)
+}
+
+func (drive *CryDrive) updateS3UploadList(modify func(ids []string) []string) error {
+	fsPath := drive.locate(S3_UPLOAD_LIST_CRYPATH)
+	defer lockMetadata(fsPath)()
+
+	ids, err := drive.readS3UploadList()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(modify(ids))
+	if err != nil {
+		return err
+	}
+	return WriteCryFile(fsPath, strings.NewReader(string(data)), int64(len(data)), drive.key)
+}
+
+// readS3Uploads returns the unfinished uploads by id. uploads older than S3_UPLOAD_MAX_AGE are removed on the way
+func (drive *CryDrive) readS3Uploads(now time.Time) (map[string]*s3Upload, error) {
+	ids, err := drive.readS3UploadList()
+	if err != nil {
+		return nil, err
+	}
+	uploads := map[string]*s3Upload{}
+	for _, id := range ids {
+		upload, err := drive.readS3Upload(id)
+		var s3err *S3Error
+		if errors.As(err, &s3err) { // already completed or aborted
+			upload, err = &s3Upload{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if now.Sub(upload.Created) > S3_UPLOAD_MAX_AGE {
+			if err := drive.removeS3Upload(id, upload); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		uploads[id] = upload
+	}
+	return uploads, nil
+}
+
+func (app *AppData) s3AbortMultipartUpload(w http.ResponseWriter, r *http.Request, drive *CryDrive, key string) {
+	uploadID := r.URL.Query().Get("uploadId")
+	upload, err := drive.readS3Upload(uploadID)
+	if err == nil && upload.Key == key {
+		err = drive.removeS3Upload(uploadID, upload)
+	}
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *AppData) s3ListMultipartUploads(w http.ResponseWriter, r *http.Request, drive *CryDrive, bucket string) {
+	uploads, err := drive.readS3Uploads(time.Now())
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	type upload struct {
+		Key          string
+		UploadId     string
+		Initiated    string
+		StorageClass string
+		created      time.Time
+	}
+	prefix := r.URL.Query().Get("prefix")
+	result := struct {
+		XMLName     xml.Name `xml:"ListMultipartUploadsResult"`
+		Xmlns       string   `xml:"xmlns,attr"`
+		Bucket      string
+		Prefix      string
+		MaxUploads  int
+		IsTruncated bool
+		Uploads     []upload `xml:"Upload"`
+	}{Xmlns: S3_NAMESPACE, Bucket: bucket, Prefix: prefix, MaxUploads: S3_MAX_KEYS}
+	for id, u := range uploads {
+		if strings.HasPrefix(u.Key, prefix) {
+			result.Uploads = append(result.Uploads, upload{u.Key, id, s3Time(u.Created), "STANDARD", u.Created})
+		}
+	}
+	sort.Slice(result.Uploads, func(i, j int) bool {
+		a, b := result.Uploads[i], result.Uploads[j]
+		return a.Key < b.Key || (a.Key == b.Key && a.created.Before(b.created))
+	})
+	if len(result.Uploads) > S3_MAX_KEYS {
+		result.Uploads, result.IsTruncated = result.Uploads[:S3_MAX_KEYS], true
+	}
+	writeS3XML(w, result)
+}
+
+func (app *AppData) s3ListParts(w http.ResponseWriter, r *http.Request, drive *CryDrive, bucket string, key string) {
+	uploadID := r.URL.Query().Get("uploadId")
+	upload, err := drive.readS3Upload(uploadID)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	} else if upload.Key != key {
+		writeS3Error(w, r, &S3Error{http.StatusNotFound, "NoSuchUpload", "the specified upload does not exist"})
+		return
+	}
+	type part struct {
+		PartNumber int
+		Size       int64
+	}
+	result := struct {
+		XMLName  xml.Name `xml:"ListPartsResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string
+		Key      string
+		UploadId string
+		Parts    []part `xml:"Part"`
+	}{Xmlns: S3_NAMESPACE, Bucket: bucket, Key: key, UploadId: uploadID}
+	for partNumber, size := range upload.Parts {
+		result.Parts = append(result.Parts, part{partNumber, size})
+	}
+	sort.Slice(result.Parts, func(i, j int) bool { return result.Parts[i].PartNumber < result.Parts[j].PartNumber })
+	writeS3XML(w, result)
+}
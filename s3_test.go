@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestS3SignatureVector(t *testing.T) {
+	// example "GET Object" from the AWS signature version 4 documentation
+	r := httptest.NewRequest(http.MethodGet, "http://examplebucket.s3.amazonaws.com/test.txt", nil)
+	r.Header.Set("Range", "bytes=0-9")
+	r.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+	r.Header.Set("X-Amz-Date", "20130524T000000Z")
+
+	signingKey := s3SigningKey("wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY", "20130524", "us-east-1", "s3")
+	canonicalRequest := s3CanonicalRequest(r, []string{"host", "range", "x-amz-content-sha256", "x-amz-date"}, emptySHA256)
+	signature := hex.EncodeToString(hmacSHA256(signingKey, s3StringToSign("20130524T000000Z", "20130524/us-east-1/s3/aws4_request", canonicalRequest)))
+	if signature != "f0e8bdb87c964420e857bd35b5d6ed310bd44f0170aba48dd91039c6036bdb41" {
+		t.Errorf("wrong signature: %s", signature)
+	}
+}
+
+type s3TestClient struct {
+	app             *AppData
+	accessKeyID     string
+	secretAccessKey string
+}
+
+func (c *s3TestClient) sign(r *http.Request, payloadHash string) string {
+	timestamp := time.Now().UTC().Format(S3_TIME_FORMAT)
+	scope := timestamp[:8] + "/us-east-1/s3/aws4_request"
+	r.Header.Set("X-Amz-Date", timestamp)
+	r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	signingKey := s3SigningKey(c.secretAccessKey, timestamp[:8], "us-east-1", "s3")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, s3StringToSign(timestamp, scope, s3CanonicalRequest(r, signedHeaders, payloadHash))))
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", S3_ALGORITHM, c.accessKeyID, scope, strings.Join(signedHeaders, ";"), signature))
+	return signature
+}
+
+func (c *s3TestClient) send(method string, target string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	hash := sha256.Sum256([]byte(body))
+	c.sign(r, hex.EncodeToString(hash[:]))
+	w := httptest.NewRecorder()
+	c.app.handleRequest(w, r)
+	return w
+}
+
+func TestS3(t *testing.T) {
+
+	t.Setenv("SECRET_KEY", "q38rcNPrHkxBonj16HTKG95zbq0bzmJ189C9A-EgTxg")
+	t.Setenv("OPEN_REGISTRATION", "true")
+	app := makeAppData()
+
+	app.webBaseDir = "./www-test"
+	defer CheckFunc(func() error { return os.RemoveAll(app.webBaseDir) })
+	Check(os.MkdirAll(app.webBaseDir, 0700))
+
+	r := httptest.NewRequest(http.MethodGet, SYSTEM_PATH_PREFIX+"/s3-credentials", nil)
+	r.SetBasicAuth("user1", "passwordpassword")
+	w := httptest.NewRecorder()
+	app.handleS3Credentials(w, r)
+	client := &s3TestClient{app: &app}
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if key, value, ok := strings.Cut(line, "="); ok && key == "AWS_ACCESS_KEY_ID" {
+			client.accessKeyID = value
+		} else if ok && key == "AWS_SECRET_ACCESS_KEY" {
+			client.secretAccessKey = value
+		}
+	}
+
+	t.Run("it should reject wrong signatures", func(t0 *testing.T) {
+		wrongClient := &s3TestClient{app: &app, accessKeyID: client.accessKeyID, secretAccessKey: "wrong"}
+		if w := wrongClient.send(http.MethodGet, "/bucket/a.txt", ""); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "SignatureDoesNotMatch") {
+			t0.Errorf("expected 403, got %v %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("it should put and get objects", func(t0 *testing.T) {
+		for _, key := range []string{"a.txt", "dir/b.txt", "dir/sub/c.txt", "dir-x.txt"} {
+			if w := client.send(http.MethodPut, "/bucket/"+key, "content of "+key); w.Code != http.StatusOK {
+				t0.Fatalf("expected 200, got %v %s", w.Code, w.Body.String())
+			}
+		}
+		w := client.send(http.MethodGet, "/bucket/dir/b.txt", "")
+		if w.Code != http.StatusOK || w.Body.String() != "content of dir/b.txt" {
+			t0.Errorf("unexpected response: %v %q", w.Code, w.Body.String())
+		}
+		etag := w.Header().Get("ETag")
+		if put := client.send(http.MethodPut, "/bucket/dir/b.txt", "content of dir/b.txt"); etag == "" || put.Header().Get("ETag") == etag {
+			t0.Errorf("expected a new etag for the new version, got %q", etag)
+		} else if head := client.send(http.MethodHead, "/bucket/dir/b.txt", ""); head.Header().Get("ETag") != put.Header().Get("ETag") {
+			t0.Errorf("expected the etag of the put, got %q", head.Header().Get("ETag"))
+		}
+		if w := client.send(http.MethodGet, "/bucket/missing.txt", ""); w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "NoSuchKey") {
+			t0.Errorf("expected 404, got %v", w.Code)
+		}
+	})
+
+	t.Run("it should reject a wrong payload hash", func(t0 *testing.T) {
+		r := httptest.NewRequest(http.MethodPut, "/bucket/a.txt", strings.NewReader("tampered"))
+		client.sign(r, emptySHA256)
+		w := httptest.NewRecorder()
+		app.handleRequest(w, r)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "BadDigest") {
+			t0.Errorf("expected 400, got %v %s", w.Code, w.Body.String())
+		}
+		if w := client.send(http.MethodGet, "/bucket/a.txt", ""); w.Body.String() != "content of a.txt" {
+			t0.Errorf("object has been modified: %q", w.Body.String())
+		}
+	})
+
+	t.Run("it should list objects", func(t0 *testing.T) {
+		w := client.send(http.MethodGet, "/bucket?list-type=2", "")
+		body := w.Body.String()
+		if strings.Index(body, "<Key>dir-x.txt</Key>") > strings.Index(body, "<Key>dir/b.txt</Key>") || !strings.Contains(body, "<Key>dir/sub/c.txt</Key>") || !strings.Contains(body, "<KeyCount>4</KeyCount>") {
+			t0.Errorf("unexpected listing: %s", body)
+		}
+
+		w = client.send(http.MethodGet, "/bucket?list-type=2&delimiter=%2F&prefix=dir%2F", "")
+		body = w.Body.String()
+		if !strings.Contains(body, "<Key>dir/b.txt</Key>") || !strings.Contains(body, "<Prefix>dir/sub/</Prefix>") || strings.Contains(body, "c.txt") {
+			t0.Errorf("unexpected listing: %s", body)
+		}
+		if etag := client.send(http.MethodHead, "/bucket/dir/b.txt", "").Header().Get("ETag"); !strings.Contains(body, "<ETag>"+xmlEscape(etag)+"</ETag>") {
+			t0.Errorf("expected the etag %s in the listing: %s", etag, body)
+		}
+
+		w = client.send(http.MethodGet, "/bucket?list-type=2&max-keys=2", "")
+		body = w.Body.String()
+		token := body[strings.Index(body, "<NextContinuationToken>")+23 : strings.Index(body, "</NextContinuationToken>")]
+		w = client.send(http.MethodGet, "/bucket?list-type=2&max-keys=2&continuation-token="+token, "")
+		body = w.Body.String()
+		if !strings.Contains(body, "<Key>dir/b.txt</Key>") || !strings.Contains(body, "<Key>dir/sub/c.txt</Key>") || strings.Contains(body, "a.txt") {
+			t0.Errorf("unexpected listing: %s", body)
+		}
+	})
+
+	t.Run("it should complete multipart uploads", func(t0 *testing.T) {
+		w := client.send(http.MethodPost, "/bucket/multi.bin?uploads", "")
+		body := w.Body.String()
+		uploadID := body[strings.Index(body, "<UploadId>")+10 : strings.Index(body, "</UploadId>")]
+		for i, content := range []string{"part1-", "part2"} {
+			if w := client.send(http.MethodPut, "/bucket/multi.bin?partNumber="+strconv.Itoa(i+1)+"&uploadId="+uploadID, content); w.Code != http.StatusOK {
+				t0.Fatalf("expected 200, got %v %s", w.Code, w.Body.String())
+			}
+		}
+		if w := client.send(http.MethodGet, "/bucket/other.bin?uploadId="+uploadID, ""); w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "NoSuchUpload") {
+			t0.Errorf("expected the upload to be listed only under its key, got %v", w.Code)
+		}
+		if w := client.send(http.MethodGet, "/bucket?uploads", ""); !strings.Contains(w.Body.String(), "<Key>multi.bin</Key><UploadId>"+uploadID+"</UploadId>") {
+			t0.Errorf("expected the upload to be listed: %s", w.Body.String())
+		}
+		complete := "<CompleteMultipartUpload><Part><PartNumber>1</PartNumber></Part><Part><PartNumber>2</PartNumber></Part></CompleteMultipartUpload>"
+		r := httptest.NewRequest(http.MethodPost, "/bucket/multi.bin?uploadId="+uploadID, strings.NewReader(complete))
+		client.sign(r, emptySHA256)
+		w = httptest.NewRecorder()
+		app.handleRequest(w, r)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "BadDigest") {
+			t0.Errorf("expected the payload hash to be verified, got %v %s", w.Code, w.Body.String())
+		}
+		w = client.send(http.MethodPost, "/bucket/multi.bin?uploadId="+uploadID, complete)
+		if w.Code != http.StatusOK {
+			t0.Fatalf("expected 200, got %v %s", w.Code, w.Body.String())
+		}
+		etag := w.Body.String()[strings.Index(w.Body.String(), "<ETag>")+6 : strings.Index(w.Body.String(), "</ETag>")]
+		if w := client.send(http.MethodGet, "/bucket/multi.bin", ""); w.Body.String() != "part1-part2" || xmlEscape(w.Header().Get("ETag")) != etag {
+			t0.Errorf("unexpected content: %q %s", w.Body.String(), w.Header().Get("ETag"))
+		}
+		if w := client.send(http.MethodGet, "/bucket?uploads", ""); strings.Contains(w.Body.String(), uploadID) {
+			t0.Errorf("expected the upload to be unlisted: %s", w.Body.String())
+		}
+		if w := client.send(http.MethodGet, "/bucket/multi.bin?uploadId="+uploadID, ""); w.Code != http.StatusNotFound {
+			t0.Errorf("upload should have been removed, got %v", w.Code)
+		}
+	})
+
+	t.Run("it should remove abandoned multipart uploads", func(t0 *testing.T) {
+		w := client.send(http.MethodPost, "/bucket/abandoned.bin?uploads", "")
+		body := w.Body.String()
+		uploadID := body[strings.Index(body, "<UploadId>")+10 : strings.Index(body, "</UploadId>")]
+		client.send(http.MethodPut, "/bucket/abandoned.bin?partNumber=1&uploadId="+uploadID, "part")
+
+		drive := app.userDrive(&AuthData{userKey: Password("passwordpassword").hash(makeUserSalt(app.appKey, "user1")), userSalt: makeUserSalt(app.appKey, "user1")})
+		upload := Try(drive.readS3Upload(uploadID))
+		upload.Created = upload.Created.Add(-S3_UPLOAD_MAX_AGE - time.Minute)
+		Check(drive.writeS3Upload(uploadID, upload))
+
+		if w := client.send(http.MethodGet, "/bucket?uploads", ""); strings.Contains(w.Body.String(), uploadID) {
+			t0.Errorf("expected the upload to be expired: %s", w.Body.String())
+		}
+		if ok, _ := IsFile(string(drive.locate(s3PartPath(uploadID, 1)))); ok {
+			t0.Errorf("expected the part to be removed")
+		}
+	})
+
+	t.Run("it should verify signed chunks", func(t0 *testing.T) {
+		upload := func(tamper bool) int {
+			r := httptest.NewRequest(http.MethodPut, "/bucket/chunked.txt", nil)
+			r.Header.Set("X-Amz-Decoded-Content-Length", "11")
+			seed := client.sign(r, S3_STREAMING_PAYLOAD)
+			signer := &S3Signer{
+				signingKey: s3SigningKey(client.secretAccessKey, r.Header.Get("X-Amz-Date")[:8], "us-east-1", "s3"),
+				timestamp:  r.Header.Get("X-Amz-Date"),
+				scope:      r.Header.Get("X-Amz-Date")[:8] + "/us-east-1/s3/aws4_request",
+				signature:  seed,
+			}
+			var body strings.Builder
+			for _, chunk := range []string{"hello ", "world", ""} {
+				hash := sha256.Sum256([]byte(chunk))
+				signer.signature = hex.EncodeToString(hmacSHA256(signer.signingKey, strings.Join([]string{
+					S3_ALGORITHM + "-PAYLOAD", signer.timestamp, signer.scope, signer.signature, emptySHA256, hex.EncodeToString(hash[:]),
+				}, "\n")))
+				if tamper {
+					chunk = strings.ToUpper(chunk)
+				}
+				fmt.Fprintf(&body, "%x;chunk-signature=%s\r\n%s\r\n", len(chunk), signer.signature, chunk)
+			}
+			r.Body = io.NopCloser(strings.NewReader(body.String()))
+			w := httptest.NewRecorder()
+			app.handleRequest(w, r)
+			return w.Code
+		}
+		if code := upload(true); code != http.StatusBadRequest {
+			t0.Errorf("expected 400, got %v", code)
+		}
+		if code := upload(false); code != http.StatusOK {
+			t0.Errorf("expected 200, got %v", code)
+		}
+		if w := client.send(http.MethodGet, "/bucket/chunked.txt", ""); w.Body.String() != "hello world" {
+			t0.Errorf("unexpected content: %q", w.Body.String())
+		}
+	})
+
+	t.Run("it should delete objects", func(t0 *testing.T) {
+		if w := client.send(http.MethodDelete, "/bucket/a.txt", ""); w.Code != http.StatusNoContent {
+			t0.Errorf("expected 204, got %v", w.Code)
+		}
+		w := client.send(http.MethodPost, "/bucket?delete", "<Delete><Object><Key>dir/b.txt</Key></Object><Object><Key>dir-x.txt</Key></Object></Delete>")
+		if w.Code != http.StatusOK || strings.Count(w.Body.String(), "<Deleted>") != 2 {
+			t0.Errorf("unexpected response: %v %s", w.Code, w.Body.String())
+		}
+		if w := client.send(http.MethodHead, "/bucket/a.txt", ""); w.Code != http.StatusNotFound {
+			t0.Errorf("expected 404, got %v", w.Code)
+		}
+	})
+}
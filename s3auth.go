@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const S3_ALGORITHM = "AWS4-HMAC-SHA256"
+const S3_TIME_FORMAT = "20060102T150405Z"
+const S3_MAX_CLOCK_SKEW = 15 * time.Minute
+const S3_MAX_CHUNK_SIZE = 16 * 1024 * 1024 // bytes
+
+const S3_UNSIGNED_PAYLOAD = "UNSIGNED-PAYLOAD"
+const S3_STREAMING_PAYLOAD = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+const S3_STREAMING_UNSIGNED_PAYLOAD = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+
+var emptySHA256 = hex.EncodeToString(sha256.New().Sum(nil))
+
+// S3Error is reported to the client as xml error document
+type S3Error struct {
+	status  int
+	code    string
+	message string
+}
+
+func (err *S3Error) Error() string {
+	return err.message
+}
+
+// S3Signer verifies the signatures of a request and, for streaming uploads, of its chunks
+type S3Signer struct {
+	signingKey []byte
+	timestamp  string
+	scope      string
+	signature  string
+}
+
+// the access key id is the username and user key encrypted with a key derived from the app key.
+// the secret access key is derived from the user key. the server can therefore verify requests without storing anything
+func (app *AppData) makeS3Credentials(auth *AuthData) (accessKeyID string, secretAccessKey string, err error) {
+	plaintext := append(append(Plaintext{}, auth.userKey...), []byte(auth.username)...)
+	ciphertext, err := app.appKey.deriveKey("s3-access-key").encrypt(plaintext)
+	if err != nil {
+		return "", "", err
+	}
+	return strEncode(ciphertext), s3SecretAccessKey(auth), nil
+}
+
+func s3SecretAccessKey(auth *AuthData) string {
+	hkdf := hkdf.New(hkdfHasher, auth.userKey, auth.userSalt, []byte("s3-secret-access-key"))
+	secret := make([]byte, hkdfHasher().Size())
+	Try(io.ReadFull(hkdf, secret))
+	return strEncode(secret)
+}
+
+func (app *AppData) openS3AccessKey(accessKeyID string) (*AuthData, error) {
+	ciphertext, err := strDecode(accessKeyID)
+	if err != nil || len(ciphertext) < 12+16+USER_KEY_LENGTH {
+		return nil, errors.New("invalid access key id")
+	}
+	plaintext, err := app.appKey.deriveKey("s3-access-key").decrypt(ciphertext)
+	if err != nil {
+		return nil, errors.New("invalid access key id")
+	}
+	auth := new(AuthData)
+	auth.userKey = UserKey(plaintext[:USER_KEY_LENGTH])
+	auth.username = Username(plaintext[USER_KEY_LENGTH:])
+	auth.userSalt = makeUserSalt(app.appKey, auth.username)
+	return auth, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func s3SigningKey(secretAccessKey string, date string, region string, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+// awsURIEncode encodes everything except the unreserved characters as demanded by signature version 4
+func awsURIEncode(value string, encodeSlash bool) string {
+	var buf strings.Builder
+	for _, b := range []byte(value) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') || b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && !encodeSlash) {
+			buf.WriteByte(b)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
+
+func s3CanonicalRequest(r *http.Request, signedHeaders []string, payloadHash string) string {
+	var query []string
+	for key, values := range r.URL.Query() {
+		if key == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			query = append(query, awsURIEncode(key, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	sort.Strings(query)
+
+	var headers strings.Builder
+	for _, name := range signedHeaders {
+		value := strings.Join(r.Header.Values(name), ",")
+		switch {
+		case name == "host":
+			value = r.Host
+		case name == "content-length" && value == "":
+			value = strconv.FormatInt(r.ContentLength, 10)
+		}
+		headers.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		awsURIEncode(r.URL.Path, false),
+		strings.Join(query, "&"),
+		headers.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+func s3StringToSign(timestamp string, scope string, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	return S3_ALGORITHM + "\n" + timestamp + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+}
+
+// s3Authenticate verifies the signature version 4 of a request, either sent as authorization header or as query parameters (presigned url)
+func (app *AppData) s3Authenticate(r *http.Request) (*AuthData, *S3Signer, error) {
+	var credential, signedHeaders, signature, timestamp, payloadHash string
+	var expires time.Duration
+
+	if authorization := r.Header.Get("Authorization"); authorization != "" {
+		fields := strings.Split(strings.TrimSpace(strings.TrimPrefix(authorization, S3_ALGORITHM)), ",")
+		for _, field := range fields {
+			key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch key {
+			case "Credential":
+				credential = value
+			case "SignedHeaders":
+				signedHeaders = value
+			case "Signature":
+				signature = value
+			}
+		}
+		timestamp = r.Header.Get("X-Amz-Date")
+		payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+		expires = S3_MAX_CLOCK_SKEW
+	} else {
+		query := r.URL.Query()
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		signature = query.Get("X-Amz-Signature")
+		timestamp = query.Get("X-Amz-Date")
+		payloadHash = S3_UNSIGNED_PAYLOAD
+		seconds, err := strconv.ParseUint(query.Get("X-Amz-Expires"), 10, 32)
+		if err != nil || seconds > 7*24*3600 {
+			return nil, nil, &S3Error{http.StatusBadRequest, "AuthorizationQueryParametersError", "invalid X-Amz-Expires"}
+		}
+		expires = time.Duration(seconds) * time.Second
+	}
+
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" || signedHeaders == "" || signature == "" || payloadHash == "" {
+		return nil, nil, &S3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "malformed authorization"}
+	}
+	requestTime, err := time.Parse(S3_TIME_FORMAT, timestamp)
+	if err != nil || !strings.HasPrefix(timestamp, parts[1]) {
+		return nil, nil, &S3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "invalid date"}
+	}
+	if now := time.Now(); now.Before(requestTime.Add(-S3_MAX_CLOCK_SKEW)) || now.After(requestTime.Add(expires)) {
+		return nil, nil, &S3Error{http.StatusForbidden, "RequestTimeTooSkewed", "request time is too skewed or expired"}
+	}
+
+	auth, err := app.openS3AccessKey(parts[0])
+	if err != nil {
+		return nil, nil, &S3Error{http.StatusForbidden, "InvalidAccessKeyId", err.Error()}
+	}
+	if !app.isRegistered(auth) {
+		return nil, nil, &S3Error{http.StatusForbidden, "AccessDenied", "unauthorized account"}
+	}
+
+	signer := &S3Signer{
+		signingKey: s3SigningKey(s3SecretAccessKey(auth), parts[1], parts[2], parts[3]),
+		timestamp:  timestamp,
+		scope:      strings.Join(parts[1:], "/"),
+	}
+	canonicalRequest := s3CanonicalRequest(r, strings.Split(signedHeaders, ";"), payloadHash)
+	signer.signature = hex.EncodeToString(hmacSHA256(signer.signingKey, s3StringToSign(timestamp, signer.scope, canonicalRequest)))
+	if subtle.ConstantTimeCompare([]byte(signer.signature), []byte(signature)) != 1 {
+		return nil, nil, &S3Error{http.StatusForbidden, "SignatureDoesNotMatch", "signature does not match"}
+	}
+	return auth, signer, nil
+}
+
+// s3Body returns the verified payload of a request and its size (-1 if unknown)
+func s3Body(r *http.Request, signer *S3Signer) (io.Reader, int64, error) {
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	switch {
+	case payloadHash == S3_STREAMING_PAYLOAD || payloadHash == S3_STREAMING_UNSIGNED_PAYLOAD:
+		size, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+		if err != nil {
+			return nil, 0, &S3Error{http.StatusBadRequest, "MissingContentLength", "missing decoded content length"}
+		}
+		reader := &S3ChunkedReader{reader: bufio.NewReader(r.Body)}
+		if payloadHash == S3_STREAMING_PAYLOAD {
+			reader.signer = signer
+		}
+		return reader, size, nil
+	case payloadHash == "" || payloadHash == S3_UNSIGNED_PAYLOAD:
+		return r.Body, r.ContentLength, nil
+	default:
+		expected, err := hex.DecodeString(payloadHash)
+		if err != nil || len(expected) != sha256.Size {
+			return nil, 0, &S3Error{http.StatusBadRequest, "InvalidArgument", "unsupported payload hash"}
+		}
+		return &HashVerifyingReader{reader: r.Body, hash: sha256.New(), expected: expected}, r.ContentLength, nil
+	}
+}
+
+// HashVerifyingReader fails at the end of the stream if the content doesn't match the expected hash
+type HashVerifyingReader struct {
+	reader   io.Reader
+	hash     hash.Hash
+	expected []byte
+}
+
+var ErrDigestMismatch = errors.New("content does not match the announced digest")
+
+func (r *HashVerifyingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(r.hash.Sum(nil), r.expected) {
+		return n, ErrDigestMismatch
+	}
+	return n, err
+}
+
+// S3ChunkedReader decodes the aws-chunked content encoding and verifies the chunk signatures
+type S3ChunkedReader struct {
+	reader *bufio.Reader
+	signer *S3Signer // nil for unsigned chunks
+	chunk  []byte
+	done   bool
+}
+
+var errS3ChunkSignature = errors.New("chunk signature does not match")
+
+func (r *S3ChunkedReader) readLine() (string, error) {
+	line, err := r.reader.ReadString('\n')
+	if err != nil {
+		return "", io.ErrUnexpectedEOF
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (r *S3ChunkedReader) nextChunk() error {
+	header, err := r.readLine()
+	if err != nil {
+		return err
+	}
+	sizeStr, extension, _ := strings.Cut(header, ";")
+	size, err := strconv.ParseInt(sizeStr, 16, 64)
+	if err != nil || size < 0 || size > S3_MAX_CHUNK_SIZE {
+		return errors.New("invalid chunk size")
+	}
+	r.chunk = make([]byte, size)
+	if _, err := io.ReadFull(r.reader, r.chunk); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+
+	if r.signer != nil {
+		chunkHash := sha256.Sum256(r.chunk)
+		stringToSign := strings.Join([]string{
+			S3_ALGORITHM + "-PAYLOAD", r.signer.timestamp, r.signer.scope, r.signer.signature, emptySHA256, hex.EncodeToString(chunkHash[:]),
+		}, "\n")
+		signature := hex.EncodeToString(hmacSHA256(r.signer.signingKey, stringToSign))
+		if subtle.ConstantTimeCompare([]byte("chunk-signature="+signature), []byte(extension)) != 1 {
+			return errS3ChunkSignature
+		}
+		r.signer.signature = signature
+	}
+
+	if size == 0 {
+		r.done = true
+		for { // skip trailing headers (e.g. checksums)
+			line, err := r.readLine()
+			if err != nil || line == "" {
+				return nil
+			}
+		}
+	}
+	if line, err := r.readLine(); err != nil || line != "" {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func (r *S3ChunkedReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
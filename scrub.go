@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const SCRUB_TEMP_FILE_MAX_AGE = time.Hour // younger temp files probably belong to running uploads
+
+var shardNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{2}$`)
+var cryFileNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{41}$`) // base64url encoded hash without the shard prefix
+
+type ScrubStats struct {
+	files    int
+	bytes    int64
+	problems int
+}
+
+// checkCiphertextSize verifies the block structure behind the header: all blocks are full except the last one, which holds at least one byte of data
+func checkCiphertextSize(size int64, headerSize int64) error {
+	if rest := (size - headerSize) % BLOCK_SIZE_ENCRYPTED; rest != 0 && rest <= BLOCK_SIZE_ENCRYPTED-BLOCK_SIZE_UNENCRYPTED {
+		return fmt.Errorf("truncated block of %d bytes", rest)
+	}
+	return nil
+}
+
+// authenticateCryFile decrypts every block, so any modified byte is detected by the AEAD. reordered blocks are detected by the hash in the header
+func authenticateCryFile(fsPath FsFilepath, userKey UserKey) error {
+	file, err := NewCryFileReader(fsPath, userKey)
+	if err != nil {
+		return err
+	}
+	defer IgnoreErrFunc(file.Close)
+	checksum := sha256.New()
+	if _, err = io.Copy(checksum, file); err != nil {
+		return err
+	}
+	if file.digest != nil && !bytes.Equal(checksum.Sum(nil), file.digest) {
+		return errors.New("content doesn't match the hash in the header")
+	}
+	return nil
+}
+
+// belongsTo tries to decrypt the header or the first block, which only succeeds with the key of the owner
+func belongsTo(fsPath FsFilepath, userKey UserKey) bool {
+	file, err := os.Open(string(fsPath))
+	if err != nil {
+		return false
+	}
+	defer IgnoreErrFunc(file.Close)
+	buf := make(Ciphertext, BLOCK_SIZE_ENCRYPTED)
+	n, err := io.ReadFull(file, buf)
+	if n == 0 || (err != nil && err != io.ErrUnexpectedEOF) {
+		return false
+	}
+	if hasCryHeader(buf[:n]) {
+		_, err = userKey.decrypt(buf[len(CRY_HEADER_MAGIC):CRY_HEADER_SIZE])
+	} else {
+		_, err = userKey.decrypt(buf[:n])
+	}
+	return err == nil
+}
+
+// reachableFiles collects the CryPaths of all directory indexes, files and sidecars of a drive by their storage location.
+// index entries without ciphertext and unreadable indexes are reported, the content of the latter is skipped
+func (drive *CryDrive) reachableFiles(report func(fsPath FsFilepath, problem string)) (map[FsFilepath]CryPath, error) {
+	reachable := map[FsFilepath]CryPath{}
+	for _, crypath := range []CryPath{SHARE_LIST_CRYPATH, KEYPAIR_CRYPATH, OUTGOING_GRANTS_CRYPATH, SESSION_LIST_CRYPATH} {
+		reachable[drive.locate(crypath)] = crypath
+	}
+	register := func(urlPath string, isDir bool) bool {
+		crypath := CryPath(urlPath)
+		if isDir {
+			crypath = CryPath(DIR_INDEX_PREFIX + urlPath)
+		}
+		fsPath := drive.locate(crypath)
+		reachable[fsPath] = crypath
+		for _, prefix := range sidecarPrefixes {
+			reachable[drive.locate(CryPath(prefix+urlPath))] = CryPath(prefix + urlPath)
+		}
+		if !isDir {
+			if ok, err := IsFile(string(fsPath)); err == nil && !ok {
+				report(fsPath, "missing ciphertext of "+urlPath)
+			}
+			return false
+		}
+		if _, err := drive.readDirIndex(urlPath); errors.Is(err, os.ErrNotExist) && urlPath != "/" {
+			report(fsPath, "missing directory index of "+urlPath)
+		} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+			report(fsPath, "corrupt directory index of "+urlPath+": "+sanitizeError(err))
+		} else {
+			return true
+		}
+		return false
+	}
+
+	if !register("/", true) {
+		return reachable, nil
+	}
+	err := drive.walk("/", func(urlPath string, isDir bool) (bool, error) {
+		return register(urlPath, isDir), nil
+	})
+	return reachable, err
+}
+
+// scrubStorage checks the structure of all files in the storage directory. with a drive every file of its user is authenticated fully,
+// files of the user which are not reachable via the directory indexes are reported as orphaned
+func scrubStorage(baseDir string, drive *CryDrive, report func(fsPath FsFilepath, problem string)) (ScrubStats, error) {
+	var stats ScrubStats
+	countedReport := func(fsPath FsFilepath, problem string) {
+		stats.problems++
+		report(fsPath, problem)
+	}
+
+	var reachable map[FsFilepath]CryPath
+	if drive != nil {
+		var err error
+		if reachable, err = drive.reachableFiles(countedReport); err != nil {
+			return stats, err
+		}
+	}
+
+	shards, err := os.ReadDir(baseDir)
+	if err != nil {
+		return stats, err
+	}
+	for _, shard := range shards {
+		shardPath := filepath.Join(baseDir, shard.Name())
+		if !shard.IsDir() || !shardNamePattern.MatchString(shard.Name()) {
+			countedReport(FsFilepath(shardPath), "unexpected file")
+			continue
+		}
+		entries, err := os.ReadDir(shardPath)
+		if err != nil {
+			return stats, err
+		}
+		if len(entries) == 0 {
+			countedReport(FsFilepath(shardPath), "empty shard directory")
+		}
+		for _, entry := range entries {
+			fsPath := FsFilepath(filepath.Join(shardPath, entry.Name()))
+			info, err := entry.Info()
+			if errors.Is(err, os.ErrNotExist) {
+				continue // replaced or deleted meanwhile
+			} else if err != nil {
+				return stats, err
+			}
+
+			if matched, _ := filepath.Match(TEMP_FILE_PATTERN, entry.Name()); matched {
+				if time.Since(info.ModTime()) > SCRUB_TEMP_FILE_MAX_AGE {
+					countedReport(fsPath, "leftover temporary file")
+				}
+				continue
+			}
+			if !info.Mode().IsRegular() || !cryFileNamePattern.MatchString(entry.Name()) {
+				countedReport(fsPath, "unexpected file")
+				continue
+			}
+
+			stats.files++
+			stats.bytes += info.Size()
+			headerSize, err := readCryHeaderSize(fsPath)
+			if err == nil {
+				err = checkCiphertextSize(info.Size(), headerSize)
+			}
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			} else if err != nil {
+				countedReport(fsPath, "corrupt: "+err.Error())
+				continue
+			}
+
+			if drive == nil {
+				continue
+			}
+			if crypath, ok := reachable[fsPath]; ok {
+				if strings.HasPrefix(string(crypath), DIR_INDEX_PREFIX) {
+					continue // already decrypted while collecting the reachable files
+				}
+				lock := fsPath.ReadLock()
+				err := authenticateCryFile(fsPath, drive.key)
+				fsPath.ReadUnlock(lock)
+				if err != nil && !errors.Is(err, os.ErrNotExist) {
+					countedReport(fsPath, "corrupt "+string(crypath)+": "+sanitizeError(err))
+				}
+			} else if belongsTo(fsPath, drive.key) {
+				countedReport(fsPath, "orphaned: not reachable via the directory indexes")
+			}
+		}
+	}
+	return stats, nil
+}
+
+// scrubPeriodically runs the structural checks in the background. user files can't be authenticated without the credentials
+func (app *AppData) scrubPeriodically(interval time.Duration) {
+	for range time.Tick(interval) {
+		stats, err := scrubStorage(app.webBaseDir, nil, func(fsPath FsFilepath, problem string) {
+			log.Printf("scrub: %s: %s\n", fsPath, problem)
+		})
+		if err != nil {
+			log.Println("scrub failed:", sanitizeError(err))
+		} else {
+			log.Printf("scrub finished: %d files, %d bytes, %d problems\n", stats.files, stats.bytes, stats.problems)
+		}
+	}
+}
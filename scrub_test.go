@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScrub(t *testing.T) {
+
+	t.Setenv("SECRET_KEY", "q38rcNPrHkxBonj16HTKG95zbq0bzmJ189C9A-EgTxg")
+	t.Setenv("OPEN_REGISTRATION", "true")
+	app := makeAppData()
+
+	app.webBaseDir = "./www-test"
+	defer CheckFunc(func() error { return os.RemoveAll(app.webBaseDir) })
+	Check(os.MkdirAll(app.webBaseDir, 0700))
+
+	for _, name := range []string{"/a.txt", "/dir/b.txt", "/dir/c.txt"} {
+		uploadFile(&app, http.MethodPost, name, "content of "+name)
+	}
+	auth := &AuthData{userSalt: makeUserSalt(app.appKey, "user1")}
+	auth.userKey = Password("passwordpassword").hash(auth.userSalt)
+	drive := app.userDrive(auth)
+
+	scrub := func(drive *CryDrive) map[string]string {
+		problems := map[string]string{}
+		Try(scrubStorage(app.webBaseDir, drive, func(fsPath FsFilepath, problem string) {
+			problems[string(fsPath)] = problem
+		}))
+		return problems
+	}
+
+	t.Run("it should find no problems in a healthy storage", func(t0 *testing.T) {
+		if problems := scrub(drive); len(problems) != 0 {
+			t0.Errorf("unexpected problems: %v", problems)
+		}
+	})
+
+	t.Run("it should detect damaged files", func(t0 *testing.T) {
+		modified := drive.locate("/a.txt")
+		data := Try(os.ReadFile(string(modified)))
+		data[len(data)-1] ^= 1
+		Check(os.WriteFile(string(modified), data, 0600))
+
+		truncated := drive.locate("/dir/b.txt")
+		Check(os.Truncate(string(truncated), 20))
+
+		Check(os.Remove(string(drive.locate("/dir/c.txt"))))
+		Check(os.Mkdir(filepath.Join(app.webBaseDir, "__"), 0700))
+
+		if problems := scrub(nil); !strings.HasPrefix(problems[string(truncated)], "corrupt") || problems[string(modified)] != "" {
+			t0.Errorf("unexpected structural problems: %v", problems)
+		}
+		problems := scrub(drive)
+		if !strings.HasPrefix(problems[string(modified)], "corrupt /a.txt") || !strings.HasPrefix(problems[string(drive.locate("/dir/c.txt"))], "missing") {
+			t0.Errorf("unexpected problems: %v", problems)
+		}
+		if problems[filepath.Join(app.webBaseDir, "__")] != "empty shard directory" {
+			t0.Errorf("empty shard directory not reported: %v", problems)
+		}
+	})
+
+	t.Run("it should detect orphaned files of the user", func(t0 *testing.T) {
+		orphan := drive.locate("/unlinked.txt")
+		Check(WriteCryFile(orphan, strings.NewReader("orphan"), 6, drive.key))
+		if problems := scrub(drive); !strings.HasPrefix(problems[string(orphan)], "orphaned") {
+			t0.Errorf("orphan not reported: %v", problems)
+		}
+	})
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+const SESSIONS_PREFIX = SYSTEM_PATH_PREFIX + "/sessions"
+const SESSION_LIST_CRYPATH = "sessions:"     // sessions of a user, stored in the drive of the user
+const SESSION_REVOKED_CRYPATH = "revoked:"   // time of the last "revoke all" of a user, stored in the drive of the user
+const SESSION_ID_LENGTH = 16                 // bytes
+const SESSION_CLOCK_SKEW = time.Minute       // tolerated for tokens issued by another instance
+const SESSION_TOUCH_INTERVAL = time.Minute   // the last use is recorded at most this often
+const SESSION_MAX_COUNT = 50                 // per user
+const SESSION_PENDING_LIFETIME = time.Minute // a session of a basic auth login is listed when its cookie comes back within this time
+
+var errInvalidSession = errors.New("invalid session")
+
+// SessionToken is the content of the cookie. it is encrypted with a key of the server, so the user key never leaves it in the clear
+// and the server decides when a session ends
+type SessionToken struct {
+	ID       string   `json:"id"`
+	Username Username `json:"username"`
+	UserKey  UserKey  `json:"userKey"`
+	Issued   int64    `json:"issuedMs"`          // unix milliseconds, precise enough to tell tokens issued right before a "revoke all"
+	Expires  int64    `json:"expires"`           // unix seconds
+	Pending  bool     `json:"pending,omitempty"` // not listed until the client presents the cookie, as clients without cookies login with every request
+}
+
+// Session is an entry of the session list of a user. a token is only valid as long as its session is listed
+type Session struct {
+	ID        string    `json:"id"`
+	Created   time.Time `json:"created"`
+	LastUsed  time.Time `json:"lastUsed"`
+	Expires   time.Time `json:"expires"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	Current   bool      `json:"current,omitempty"` // only set in listings
+}
+
+func (app *AppData) sessionKey() UserKey {
+	return app.appKey.deriveKey("session-cookie")
+}
+
+func (app *AppData) issueSession(auth *AuthData, id string, now time.Time, pending bool) (string, error) {
+	plaintext, err := json.Marshal(SessionToken{
+		ID:       id,
+		Username: auth.username,
+		UserKey:  auth.userKey,
+		Issued:   now.UnixMilli(),
+		Expires:  now.Add(app.cookieLifetime).Unix(),
+		Pending:  pending,
+	})
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := app.sessionKey().encrypt(plaintext)
+	if err != nil {
+		return "", err
+	}
+	return strEncode(ciphertext), nil
+}
+
+// openSession validates a token. tampered and expired tokens are both errInvalidSession
+func (app *AppData) openSession(value string, now time.Time) (*SessionToken, error) {
+	ciphertext, err := strDecode(value)
+	if err != nil {
+		return nil, errInvalidSession
+	}
+	plaintext, err := app.sessionKey().decrypt(ciphertext)
+	if err != nil {
+		return nil, errInvalidSession
+	}
+	token := new(SessionToken)
+	if err := json.Unmarshal(plaintext, token); err != nil || len(token.UserKey) != USER_KEY_LENGTH || token.ID == "" || token.Issued == 0 {
+		return nil, errInvalidSession
+	}
+	if now.Unix() >= token.Expires || time.UnixMilli(token.Issued).After(now.Add(SESSION_CLOCK_SKEW)) {
+		return nil, errInvalidSession
+	}
+	return token, nil
+}
+
+func (token *SessionToken) isFor(username Username) bool {
+	return subtle.ConstantTimeCompare([]byte(token.Username), []byte(username)) == 1
+}
+
+// canBeListed tells pending sessions, which are listed with the first use of their cookie
+func (token *SessionToken) canBeListed(now time.Time) bool {
+	return token.Pending && now.Before(time.UnixMilli(token.Issued).Add(SESSION_PENDING_LIFETIME))
+}
+
+// auth restores the credentials of the login which issued the token
+func (token *SessionToken) auth(app *AppData) *AuthData {
+	return &AuthData{username: token.Username, userKey: token.UserKey, userSalt: makeUserSalt(app.appKey, token.Username)}
+}
+
+func (drive *CryDrive) readSessions() ([]Session, error) {
+	sessions := []Session{}
+	err := readLinkRecord(drive.locate(SESSION_LIST_CRYPATH), drive.key, &sessions)
+	if errors.Is(err, os.ErrNotExist) {
+		return []Session{}, nil
+	}
+	return sessions, err
+}
+
+// readRevoked returns the time of the last "revoke all", zero if there was none
+func (drive *CryDrive) readRevoked() (time.Time, error) {
+	var revoked time.Time
+	err := readLinkRecord(drive.locate(SESSION_REVOKED_CRYPATH), drive.key, &revoked)
+	if errors.Is(err, os.ErrNotExist) {
+		return time.Time{}, nil
+	}
+	return revoked, err
+}
+
+// updateSessions drops expired sessions and the least recently used ones above SESSION_MAX_COUNT
+func (drive *CryDrive) updateSessions(modify func(sessions []Session) []Session) error {
+	fsPath := drive.locate(SESSION_LIST_CRYPATH)
+	defer lockMetadata(fsPath)()
+	sessions, err := drive.readSessions()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	sessions = slices.DeleteFunc(modify(sessions), func(session Session) bool { return !session.Expires.After(now) })
+	if len(sessions) > SESSION_MAX_COUNT {
+		slices.SortStableFunc(sessions, func(a, b Session) int { return b.LastUsed.Compare(a.LastUsed) })
+		sessions = sessions[:SESSION_MAX_COUNT]
+	}
+	return writeLinkRecord(fsPath, sessions, drive.key)
+}
+
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// startSession hands the token of a new session to the client. sessions of the login form are listed right away,
+// those of basic auth once their cookie comes back
+func (app *AppData) startSession(w http.ResponseWriter, r *http.Request, auth *AuthData, listed bool) error {
+	value := make([]byte, SESSION_ID_LENGTH)
+	if _, err := rand.Read(value); err != nil {
+		return err
+	}
+	return app.setSession(w, r, auth, strEncode(value), listed, nil)
+}
+
+// setSession issues the token of a session and lists the session if requested. a pending token which gets listed is
+// rejected if all sessions were revoked after it was issued. the check runs under the lock of the session list,
+// so a concurrent "revoke all" can't miss the session
+func (app *AppData) setSession(w http.ResponseWriter, r *http.Request, auth *AuthData, id string, listed bool, pending *SessionToken) error {
+	now := time.Now()
+	session := Session{ID: id, Created: now.UTC(), LastUsed: now.UTC(), Expires: now.Add(app.cookieLifetime).UTC(),
+		IP: clientIP(r), UserAgent: r.UserAgent()}
+	if listed {
+		drive := app.userDrive(auth)
+		var checkErr error
+		err := drive.updateSessions(func(sessions []Session) []Session {
+			if pending != nil {
+				revoked, err := drive.readRevoked()
+				if err == nil && !time.UnixMilli(pending.Issued).After(revoked) {
+					err = errInvalidSession
+				}
+				if checkErr = err; err != nil {
+					return sessions
+				}
+			}
+			if slices.ContainsFunc(sessions, func(s Session) bool { return s.ID == id }) {
+				return sessions // listed by a concurrent request with the same cookie
+			}
+			return append(sessions, session)
+		})
+		if err = errors.Join(checkErr, err); err != nil {
+			return err
+		}
+	}
+	token, err := app.issueSession(auth, id, now, !listed)
+	if err != nil {
+		return err
+	}
+	auth.sessionID = id
+	http.SetCookie(w, &http.Cookie{
+		Name:     COOKIE_NAME,
+		Value:    token,
+		Expires:  session.Expires,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// checkSession looks up the session of a valid token, so revoked sessions end immediately. the last use is recorded on the way.
+// a pending session is listed with the first use of its cookie, which gets replaced by a listed one
+func (app *AppData) checkSession(w http.ResponseWriter, r *http.Request, auth *AuthData, token *SessionToken) error {
+	drive := app.userDrive(auth)
+	sessions, err := drive.readSessions()
+	if err != nil {
+		return err
+	}
+	index := slices.IndexFunc(sessions, func(session Session) bool { return session.ID == token.ID })
+	if index < 0 && token.canBeListed(time.Now()) {
+		return app.setSession(w, r, auth, token.ID, true, token)
+	} else if index < 0 {
+		return errInvalidSession
+	}
+	auth.sessionID = token.ID
+	session := sessions[index]
+	if time.Since(session.LastUsed) < SESSION_TOUCH_INTERVAL && session.IP == clientIP(r) {
+		return nil
+	}
+	return drive.updateSessions(func(sessions []Session) []Session {
+		for i := range sessions {
+			if sessions[i].ID == token.ID {
+				sessions[i].LastUsed = time.Now().UTC()
+				sessions[i].IP = clientIP(r)
+				sessions[i].UserAgent = r.UserAgent()
+			}
+		}
+		return sessions
+	})
+}
+
+// handleSessions lists (GET) and revokes (DELETE) the sessions of a user. DELETE without id revokes all of them
+func (app *AppData) handleSessions(w http.ResponseWriter, r *http.Request) {
+	auth := app.handleAuth(w, r)
+	if auth == nil {
+		// handleAuth has already set the http response
+		return
+	}
+	drive := app.userDrive(auth)
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, SESSIONS_PREFIX), "/")
+
+	switch {
+	case r.Method == "GET" && id == "":
+		sessions, err := drive.readSessions()
+		if err != nil {
+			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+			return
+		}
+		for i := range sessions {
+			sessions[i].Current = sessions[i].ID == auth.sessionID
+		}
+		writeJSON(w, http.StatusOK, sessions)
+
+	case r.Method == "DELETE":
+		found := false
+		var revokeErr error
+		err := drive.updateSessions(func(sessions []Session) []Session {
+			if id == "" {
+				// pending tokens aren't listed yet, so they are rejected by their issue time
+				revokeErr = writeLinkRecord(drive.locate(SESSION_REVOKED_CRYPATH), time.Now().UTC(), drive.key)
+			}
+			return slices.DeleteFunc(sessions, func(session Session) bool {
+				revoked := id == "" || session.ID == id
+				found = found || revoked
+				return revoked
+			})
+		})
+		if err = errors.Join(revokeErr, err); err != nil {
+			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+			return
+		} else if !found && id != "" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if id == "" || id == auth.sessionID {
+			http.SetCookie(w, deleteCookie)
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
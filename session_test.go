@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionCookie(t *testing.T) {
+
+	t.Setenv("SECRET_KEY", "q38rcNPrHkxBonj16HTKG95zbq0bzmJ189C9A-EgTxg")
+	t.Setenv("OPEN_REGISTRATION", "true")
+	app := makeAppData()
+
+	app.webBaseDir = "./www-test"
+	defer CheckFunc(func() error { return os.RemoveAll(app.webBaseDir) })
+	Check(os.MkdirAll(app.webBaseDir, 0700))
+
+	auth := &AuthData{username: "user1", userSalt: makeUserSalt(app.appKey, "user1")}
+	auth.userKey = Password("passwordpassword").hash(auth.userSalt)
+	now := time.Now()
+	value := Try(app.issueSession(auth, "id", now, false))
+
+	t.Run("it should never contain the user key in the clear", func(t0 *testing.T) {
+		if strings.Contains(value, strEncode(auth.userKey)) {
+			t0.Errorf("the cookie contains the user key")
+		}
+		if session, err := app.openSession(value, now); err != nil || string(session.UserKey) != string(auth.userKey) {
+			t0.Errorf("expected a valid session, got %v", err)
+		}
+	})
+
+	t.Run("it should reject tampered and expired sessions", func(t0 *testing.T) {
+		tampered := []byte(value)
+		tampered[20] ^= 1
+		for name, check := range map[string]func() error{
+			"tampered": func() error { _, err := app.openSession(string(tampered), now); return err },
+			"expired":  func() error { _, err := app.openSession(value, now.Add(app.cookieLifetime)); return err },
+			"future":   func() error { _, err := app.openSession(value, now.Add(-time.Hour)); return err },
+			"raw key":  func() error { _, err := app.openSession(strEncode(auth.userKey), now); return err },
+		} {
+			if err := check(); err != errInvalidSession {
+				t0.Errorf("expected the %s session to be invalid, got %v", name, err)
+			}
+		}
+	})
+
+	t.Run("it should replace invalid sessions via the password", func(t0 *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(&http.Cookie{Name: COOKIE_NAME, Value: strEncode(auth.userKey)})
+		r.SetBasicAuth("user1", "passwordpassword")
+		w := httptest.NewRecorder()
+		if result := app.handleAuth(w, r); result == nil || string(result.userKey) != string(auth.userKey) {
+			t0.Fatalf("expected a login via the password, got %v", w.Code)
+		}
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 || Try(app.openSession(cookies[0].Value, time.Now())) == nil {
+			t0.Errorf("expected a new session cookie, got %v", cookies)
+		}
+	})
+}
+
+func TestSessions(t *testing.T) {
+
+	t.Setenv("SECRET_KEY", "q38rcNPrHkxBonj16HTKG95zbq0bzmJ189C9A-EgTxg")
+	t.Setenv("OPEN_REGISTRATION", "true")
+	app := makeAppData()
+
+	app.webBaseDir = "./www-test"
+	defer CheckFunc(func() error { return os.RemoveAll(app.webBaseDir) })
+	Check(os.MkdirAll(app.webBaseDir, 0700))
+
+	send := func(method string, target string, cookie *http.Cookie, userAgent string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		r.SetBasicAuth("user1", "passwordpassword")
+		r.Header.Set("User-Agent", userAgent)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		app.handleSessions(w, r)
+		return w
+	}
+	// the session of a basic auth login is listed when the cookie comes back, which replaces the cookie
+	login := func(userAgent string) *http.Cookie {
+		pending := send(http.MethodGet, SESSIONS_PREFIX, nil, userAgent).Result().Cookies()[0]
+		return send(http.MethodGet, SESSIONS_PREFIX, pending, userAgent).Result().Cookies()[0]
+	}
+	laptop, phone := login("laptop"), login("phone")
+
+	t.Run("it should list the sessions of the user", func(t0 *testing.T) {
+		w := send(http.MethodGet, SESSIONS_PREFIX, laptop, "laptop")
+		var sessions []Session
+		Check(json.Unmarshal(w.Body.Bytes(), &sessions))
+		if len(sessions) != 2 || !sessions[0].Current || sessions[1].Current || sessions[1].UserAgent != "phone" || sessions[0].IP != "192.0.2.1" {
+			t0.Errorf("unexpected sessions: %+v", sessions)
+		}
+		if len(w.Result().Cookies()) != 0 {
+			t0.Errorf("expected the session to be used without a new cookie")
+		}
+	})
+
+	t.Run("it should end revoked sessions immediately", func(t0 *testing.T) {
+		var sessions []Session
+		Check(json.Unmarshal(send(http.MethodGet, SESSIONS_PREFIX, phone, "phone").Body.Bytes(), &sessions))
+		if w := send(http.MethodDelete, SESSIONS_PREFIX+"/"+sessions[0].ID, phone, "phone"); w.Code != http.StatusNoContent {
+			t0.Fatalf("expected 204, got %v", w.Code)
+		}
+		if w := send(http.MethodDelete, SESSIONS_PREFIX+"/unknown", phone, "phone"); w.Code != http.StatusNotFound {
+			t0.Errorf("expected 404, got %v", w.Code)
+		}
+		// the revoked cookie is replaced via the password
+		if cookies := send(http.MethodGet, SESSIONS_PREFIX, laptop, "laptop").Result().Cookies(); len(cookies) != 1 || cookies[0].Value == laptop.Value {
+			t0.Errorf("expected a new session, got %v", cookies)
+		}
+	})
+
+	t.Run("it should revoke all sessions", func(t0 *testing.T) {
+		pending := send(http.MethodGet, SESSIONS_PREFIX, nil, "tablet").Result().Cookies()[0] // not listed yet
+		w := send(http.MethodDelete, SESSIONS_PREFIX, phone, "phone")
+		if w.Code != http.StatusNoContent || w.Result().Cookies()[0].Value != "" {
+			t0.Errorf("expected 204 and the cookie to be deleted, got %v", w.Code)
+		}
+		auth := &AuthData{username: "user1", userSalt: makeUserSalt(app.appKey, "user1")}
+		auth.userKey = Password("passwordpassword").hash(auth.userSalt)
+		if sessions := Try(app.userDrive(auth).readSessions()); len(sessions) != 0 {
+			t0.Errorf("unexpected sessions: %+v", sessions)
+		}
+		r := httptest.NewRequest(http.MethodGet, SESSIONS_PREFIX, nil)
+		r.AddCookie(pending)
+		if app.handleAuth(httptest.NewRecorder(), r) != nil {
+			t0.Errorf("expected the pending session to be revoked as well")
+		}
+	})
+
+	t.Run("it should not list sessions of clients without cookies", func(t0 *testing.T) {
+		browser := login("browser")
+		for range SESSION_MAX_COUNT + 1 {
+			send(http.MethodGet, SESSIONS_PREFIX, nil, "curl")
+		}
+		w := send(http.MethodGet, SESSIONS_PREFIX, browser, "browser")
+		var sessions []Session
+		Check(json.Unmarshal(w.Body.Bytes(), &sessions))
+		if len(sessions) != 1 || !sessions[0].Current || len(w.Result().Cookies()) != 0 {
+			t0.Errorf("expected only the browser session, got %+v", sessions)
+		}
+	})
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const SHARE_PREFIX = SYSTEM_PATH_PREFIX + "/share"
+const SHARE_RECORD_PREFIX = "share:"
+const SHARE_CONTENT_PREFIX = "share-content:"
+const SHARE_LIST_CRYPATH = "shares:" // tokens of all shares of a user, stored in the drive of the user
+const LINK_ID_LENGTH = 16            // bytes
+const LINK_KEY_LENGTH = 32           // bytes
+const SHARE_DEFAULT_LIFETIME = 7 * 24 * time.Hour
+
+// shared files of these types could run scripts on the origin of the app, so they are only offered for download
+var activeContentExtensions = []string{".htm", ".html", ".shtml", ".xhtml", ".svg", ".svgz", ".xml", ".xsl", ".xslt", ".js", ".mjs"}
+
+// ShareRecord holds everything needed to serve a shared file. it is encrypted with the link key, which is only part of the token.
+// the file is served from a copy encrypted with the link key as well, so neither the token nor the storage reveal the drive of the owner
+type ShareRecord struct {
+	Username     Username        `json:"username"`
+	Owner        UserFingerprint `json:"owner"` // tells the owner and whether they may still login
+	Path         string          `json:"path"`
+	Created      time.Time       `json:"created"`
+	Expires      time.Time       `json:"expires"`
+	PasswordHash []byte          `json:"passwordHash,omitempty"` // argon2 with the link id as salt
+	MaxDownloads int             `json:"maxDownloads,omitempty"` // 0 is unlimited
+	Downloads    int             `json:"downloads"`
+}
+
+// ShareInfo is the view of a share for its owner
+type ShareInfo struct {
+	Link         string    `json:"link"`
+	Path         string    `json:"path"`
+	Created      time.Time `json:"created"`
+	Expires      time.Time `json:"expires"`
+	Password     bool      `json:"password"`
+	MaxDownloads int       `json:"maxDownloads,omitempty"`
+	Downloads    int       `json:"downloads"`
+}
+
+type ShareOptions struct {
+	expires      time.Time
+	password     string
+	maxDownloads int
+}
+
+func (record *ShareRecord) info(token string) ShareInfo {
+	return ShareInfo{
+		Link:         SHARE_PREFIX + "/" + token,
+		Path:         record.Path,
+		Created:      record.Created,
+		Expires:      record.Expires,
+		Password:     record.PasswordHash != nil,
+		MaxDownloads: record.MaxDownloads,
+		Downloads:    record.Downloads,
+	}
+}
+
+func (record *ShareRecord) isOwner(auth *AuthData) bool {
+	return record.Username == auth.username && subtle.ConstantTimeCompare(record.Owner, auth.userKey.hash(auth.userSalt)) == 1
+}
+
+func (record *ShareRecord) checkPassword(ctx context.Context, limiter *Argon2Limiter, id []byte, password string) (bool, error) {
+	if record.PasswordHash == nil {
+		return true, nil
+	}
+	passwordHash, err := limiter.hash(ctx, Password(password), id)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(passwordHash, record.PasswordHash) == 1, nil
+}
+
+// shareRecordFilepath hides the id of a link in the storage, so the record can't be found without the token
+func (app *AppData) shareRecordFilepath(id []byte) FsFilepath {
+	locations := &CryDrive{baseDir: app.webBaseDir, key: app.appKey.deriveKey("share-links")}
+	return locations.locate(CryPath(SHARE_RECORD_PREFIX + strEncode(id)))
+}
+
+// shareContentFilepath locates the copy of the shared file
+func (app *AppData) shareContentFilepath(id []byte) FsFilepath {
+	locations := &CryDrive{baseDir: app.webBaseDir, key: app.appKey.deriveKey("share-links")}
+	return locations.locate(CryPath(SHARE_CONTENT_PREFIX + strEncode(id)))
+}
+
+// links consist of a random id, which locates the record, and the key of the record
+func newLinkToken() (token string, id []byte, linkKey UserKey, err error) {
+	value := make([]byte, LINK_ID_LENGTH+LINK_KEY_LENGTH)
+	if _, err := rand.Read(value); err != nil {
+		return "", nil, nil, err
+	}
+	return strEncode(value), value[:LINK_ID_LENGTH], value[LINK_ID_LENGTH:], nil
+}
+
+func parseLinkToken(token string) (id []byte, linkKey UserKey, err error) {
+	value, err := strDecode(token)
+	if err != nil || len(value) != LINK_ID_LENGTH+LINK_KEY_LENGTH {
+		return nil, nil, os.ErrNotExist
+	}
+	return value[:LINK_ID_LENGTH], value[LINK_ID_LENGTH:], nil
+}
+
+func writeLinkRecord(fsPath FsFilepath, record any, linkKey UserKey) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return WriteCryFile(fsPath, bytes.NewReader(data), int64(len(data)), linkKey)
+}
+
+// readLinkRecord decrypts the record of a link. a wrong link key is reported as not existing record
+func readLinkRecord(fsPath FsFilepath, linkKey UserKey, record any) error {
+	lock := fsPath.ReadLock()
+	file, err := NewCryFileReader(fsPath, linkKey)
+	fsPath.ReadUnlock(lock)
+	if err != nil {
+		return os.ErrNotExist // a wrong link key fails the authentication
+	}
+	defer IgnoreErrFunc(file.Close)
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, record)
+}
+
+func (app *AppData) createShare(ctx context.Context, auth *AuthData, urlPath string, options ShareOptions) (token string, record *ShareRecord, err error) {
+	token, id, linkKey, err := newLinkToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	record = &ShareRecord{
+		Username:     auth.username,
+		Owner:        auth.userKey.hash(auth.userSalt),
+		Path:         urlPath,
+		Created:      time.Now().UTC().Truncate(time.Second),
+		Expires:      options.expires.UTC().Truncate(time.Second),
+		MaxDownloads: options.maxDownloads,
+	}
+	if options.password != "" {
+		if record.PasswordHash, err = app.argon2Limiter.hash(ctx, Password(options.password), id); err != nil {
+			return "", nil, err
+		}
+	}
+
+	// the link gets a copy of the file with its own key instead of the key of the drive
+	drive := app.userDrive(auth)
+	fsPath := drive.locate(CryPath(urlPath))
+	lock := fsPath.ReadLock()
+	file, err := NewCryFileReader(fsPath, drive.key)
+	fsPath.ReadUnlock(lock) // files are replaced atomically, so the open file stays valid
+	if err != nil {
+		return "", nil, err
+	}
+	defer IgnoreErrFunc(file.Close)
+	if err := WriteCryFile(app.shareContentFilepath(id), file, file.datasize, linkKey); err != nil {
+		return "", nil, err
+	}
+	if err := writeLinkRecord(app.shareRecordFilepath(id), record, linkKey); err != nil {
+		return "", nil, errors.Join(err, app.removeShare(id))
+	}
+	return token, record, app.userDrive(auth).updateShareList(func(tokens []string) []string { return append(tokens, token) })
+}
+
+// readShare decrypts the record of a token. unknown, invalid, expired and used up tokens are reported as not existing
+func (app *AppData) readShare(token string) (*ShareRecord, error) {
+	id, linkKey, err := parseLinkToken(token)
+	if err != nil {
+		return nil, err
+	}
+	record := new(ShareRecord)
+	if err := readLinkRecord(app.shareRecordFilepath(id), linkKey, record); err != nil {
+		return nil, err
+	}
+	if time.Now().After(record.Expires) || (record.MaxDownloads > 0 && record.Downloads >= record.MaxDownloads) {
+		IgnoreErrFunc(func() error { return app.removeShare(id) })
+		return nil, os.ErrNotExist
+	}
+	return record, nil
+}
+
+// countShareDownload increments the download counter atomically. the record is removed with the last allowed download
+func (app *AppData) countShareDownload(token string) error {
+	id, linkKey, err := parseLinkToken(token)
+	if err != nil {
+		return err
+	}
+	fsPath := app.shareRecordFilepath(id)
+	defer lockMetadata(fsPath)()
+
+	record, err := app.readShare(token)
+	if err != nil {
+		return err
+	}
+	if record.MaxDownloads == 0 {
+		return nil
+	}
+	record.Downloads++
+	if record.Downloads >= record.MaxDownloads {
+		return app.removeShare(id)
+	}
+	return writeLinkRecord(fsPath, record, linkKey)
+}
+
+var errDownloadRejected = errors.New("download rejected")
+
+// downloadCounter counts a download when the response sends the beginning of the file, before any content is sent,
+// so concurrent requests can't exceed the limit. other ranges and answers to conditional requests (304, 412) are free,
+// so a player which requests a file in parts uses up a single download
+type downloadCounter struct {
+	http.ResponseWriter
+	count       func() error
+	wroteHeader bool
+	failed      bool
+}
+
+func (w *downloadCounter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	// multipart ranges have no Content-Range header and always count
+	contentRange := w.Header().Get("Content-Range")
+	if code == http.StatusOK || (code == http.StatusPartialContent && (contentRange == "" || strings.HasPrefix(contentRange, "bytes 0-"))) {
+		if err := w.count(); err != nil {
+			w.failed = true
+			for _, key := range []string{"Content-Disposition", "Content-Range", "Accept-Ranges", "Last-Modified"} {
+				w.Header().Del(key)
+			}
+			if errors.Is(err, os.ErrNotExist) {
+				http.Error(w.ResponseWriter, "not found", http.StatusNotFound)
+			} else {
+				http.Error(w.ResponseWriter, sanitizeError(err), http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *downloadCounter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.failed {
+		return 0, errDownloadRejected
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (app *AppData) removeShare(id []byte) error {
+	contentFsPath := app.shareContentFilepath(id)
+	lock := contentFsPath.WriteLock()
+	err := IgnoreNotExist(os.Remove(string(contentFsPath)))
+	contentFsPath.WriteUnlock(lock)
+	if err != nil {
+		return err
+	}
+
+	fsPath := app.shareRecordFilepath(id)
+	lock = fsPath.WriteLock()
+	defer fsPath.WriteUnlock(lock)
+	return os.Remove(string(fsPath))
+}
+
+func (drive *CryDrive) readShareList() ([]string, error) {
+	fsPath := drive.locate(SHARE_LIST_CRYPATH)
+	lock := fsPath.ReadLock()
+	defer fsPath.ReadUnlock(lock)
+
+	file, err := NewCryFileReader(fsPath, drive.key)
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer IgnoreErrFunc(file.Close)
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []string
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (drive *CryDrive) updateShareList(modify func(tokens []string) []string) error {
+	fsPath := drive.locate(SHARE_LIST_CRYPATH)
+	defer lockMetadata(fsPath)()
+
+	tokens, err := drive.readShareList()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(modify(tokens))
+	if err != nil {
+		return err
+	}
+	return WriteCryFile(fsPath, bytes.NewReader(data), int64(len(data)), drive.key)
+}
+
+// listShares returns all active shares of a user. ended shares are dropped from the list
+func (app *AppData) listShares(auth *AuthData) ([]ShareInfo, error) {
+	drive := app.userDrive(auth)
+	tokens, err := drive.readShareList()
+	if err != nil {
+		return nil, err
+	}
+	shares := []ShareInfo{}
+	ended := map[string]bool{}
+	for _, token := range tokens {
+		record, err := app.readShare(token)
+		if errors.Is(err, os.ErrNotExist) {
+			ended[token] = true
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		shares = append(shares, record.info(token))
+	}
+	if len(ended) > 0 {
+		err = drive.updateShareList(func(tokens []string) []string {
+			return slices.DeleteFunc(tokens, func(token string) bool { return ended[token] })
+		})
+	}
+	return shares, err
+}
+
+func parseShareOptions(r *http.Request) (options ShareOptions, err error) {
+	options.expires = time.Now().Add(SHARE_DEFAULT_LIFETIME)
+	if value := r.FormValue("expires"); value != "" {
+		if lifetime, err := time.ParseDuration(value); err == nil && lifetime > 0 {
+			options.expires = time.Now().Add(lifetime)
+		} else if options.expires, err = time.Parse(time.RFC3339, value); err != nil {
+			return options, errors.New("invalid expires, use a duration like 48h or a date like 2006-01-02T15:04:05Z")
+		} else if options.expires.Before(time.Now()) {
+			return options, errors.New("invalid expires, the date is in the past")
+		}
+	}
+	if value := r.FormValue("downloads"); value != "" {
+		if options.maxDownloads, err = strconv.Atoi(value); err != nil || options.maxDownloads < 1 {
+			return options, errors.New("invalid downloads, use a positive number")
+		}
+	}
+	options.password = r.FormValue("password")
+	return options, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	data, err := json.Marshal(value)
+	Check(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_, _ = w.Write(data)
+}
+
+// handleShare manages the share links of the owner (POST, GET list and info, DELETE) and serves shared files to everyone with the link (GET, HEAD)
+func (app *AppData) handleShare(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, SHARE_PREFIX), "/")
+
+	switch {
+	case r.Method == "POST" && token == "":
+		auth := app.handleAuth(w, r)
+		if auth == nil {
+			// handleAuth has already set the http response
+			return
+		}
+		urlPath := path.Clean("/" + r.FormValue("path"))
+		options, err := parseShareOptions(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if ok, err := app.userDrive(auth).isFile(urlPath); err != nil {
+			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+			return
+		} else if !ok || isReservedPath(urlPath) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		token, record, err := app.createShare(r.Context(), auth, urlPath, options)
+		if isArgon2Error(err) {
+			writeArgon2Error(w, err)
+			return
+		} else if err != nil {
+			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Location", SHARE_PREFIX+"/"+token)
+		writeJSON(w, http.StatusCreated, record.info(token))
+
+	case r.Method == "GET" && token == "":
+		auth := app.handleAuth(w, r)
+		if auth == nil {
+			// handleAuth has already set the http response
+			return
+		}
+		shares, err := app.listShares(auth)
+		if err != nil {
+			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, shares)
+
+	case r.Method == "GET" && r.URL.Query().Has("info"):
+		auth := app.handleAuth(w, r)
+		if auth == nil {
+			// handleAuth has already set the http response
+			return
+		}
+		record, err := app.readShare(token)
+		if errors.Is(err, os.ErrNotExist) || (err == nil && !record.isOwner(auth)) {
+			http.Error(w, "not found", http.StatusNotFound) // only the owner may inspect a link
+			return
+		} else if err != nil {
+			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, record.info(token))
+
+	case r.Method == "GET" || r.Method == "HEAD":
+		record, err := app.readShare(token)
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+			return
+		}
+		if !app.openRegistration && !app.usersAllowlist.Contains(record.Owner) {
+			http.Error(w, "not found", http.StatusNotFound) // the owner has lost access
+			return
+		}
+		id, linkKey, _ := parseLinkToken(token)
+		_, password, hasPassword := r.BasicAuth()
+		if record.PasswordHash != nil {
+			if wait := app.loginLimiter.check(shareLoginKeys(r, id)...); wait > 0 {
+				writeLoginLockout(w, wait)
+				return
+			}
+		}
+		if ok, err := record.checkPassword(r.Context(), app.argon2Limiter, id, password); err != nil {
+			writeArgon2Error(w, err)
+			return
+		} else if !ok {
+			if hasPassword { // browsers ask for the password only after a first request without one
+				app.recordFailedGuess(shareLoginKeys(r, id)...)
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="password protected share", charset="UTF-8"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		fsPath := app.shareContentFilepath(id)
+		lock := fsPath.ReadLock()
+		file, err := NewCryFileReader(fsPath, linkKey)
+		fsPath.ReadUnlock(lock)
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+			return
+		}
+		defer CheckFunc(file.Close)
+
+		if r.Method == "GET" {
+			w = &downloadCounter{ResponseWriter: w, count: func() error { return app.countShareDownload(token) }}
+		}
+		disposition := "inline"
+		if slices.Contains(activeContentExtensions, strings.ToLower(path.Ext(record.Path))) {
+			disposition = "attachment"
+		}
+		w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": path.Base(record.Path)}))
+		w.Header().Set("Content-Security-Policy", "sandbox") // also covers types sniffed from the content
+		w.Header().Set("X-Robots-Tag", "noindex")
+		w.Header().Set("Cache-Control", "no-store")
+		file.enableSharedBlocks(app.sharedBlocks)
+		file.enableReadAhead(r.Context(), app.readAheadBlocks)
+		http.ServeContent(w, r, record.Path, file.modTime, file) // path for mime type detection by extension
+
+	case r.Method == "DELETE" && token != "":
+		auth := app.handleAuth(w, r)
+		if auth == nil {
+			// handleAuth has already set the http response
+			return
+		}
+		record, err := app.readShare(token)
+		if errors.Is(err, os.ErrNotExist) || (err == nil && !record.isOwner(auth)) {
+			http.Error(w, "not found", http.StatusNotFound) // only the owner may revoke a link
+			return
+		} else if err != nil {
+			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+			return
+		}
+		id, _, _ := parseLinkToken(token)
+		if err := IgnoreNotExist(app.removeShare(id)); err != nil {
+			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+			return
+		}
+		err = app.userDrive(auth).updateShareList(func(tokens []string) []string {
+			return slices.DeleteFunc(tokens, func(t string) bool { return t == token })
+		})
+		if err != nil {
+			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
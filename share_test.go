@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sendShareRequest(app *AppData, method string, target string, form url.Values, user string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if user != "" {
+		r.SetBasicAuth(user, "passwordpassword")
+	}
+	w := httptest.NewRecorder()
+	app.handleShare(w, r)
+	return w
+}
+
+func TestShareLinks(t *testing.T) {
+
+	t.Setenv("SECRET_KEY", "q38rcNPrHkxBonj16HTKG95zbq0bzmJ189C9A-EgTxg")
+	t.Setenv("OPEN_REGISTRATION", "true")
+	app := makeAppData()
+
+	app.webBaseDir = "./www-test"
+	defer CheckFunc(func() error { return os.RemoveAll(app.webBaseDir) })
+	Check(os.MkdirAll(app.webBaseDir, 0700))
+
+	uploadFile(&app, http.MethodPost, "/docs/report.txt", "0123456789")
+	createLink := func(form url.Values) ShareInfo {
+		w := sendShareRequest(&app, http.MethodPost, SHARE_PREFIX, form, "user1")
+		if w.Code != http.StatusCreated {
+			t.Fatalf("expected 201, got %v %s", w.Code, w.Body.String())
+		}
+		var link ShareInfo
+		Check(json.Unmarshal(w.Body.Bytes(), &link))
+		return link
+	}
+
+	t.Run("it should serve a shared file without login", func(t0 *testing.T) {
+		link := createLink(url.Values{"path": {"/docs/report.txt"}})
+		w := sendShareRequest(&app, http.MethodGet, link.Link, nil, "")
+		if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+			t0.Errorf("unexpected response: %v %q", w.Code, w.Body.String())
+		}
+		r := httptest.NewRequest(http.MethodGet, link.Link, nil)
+		r.Header.Set("Range", "bytes=2-4")
+		w = httptest.NewRecorder()
+		app.handleShare(w, r)
+		if w.Code != http.StatusPartialContent || w.Body.String() != "234" {
+			t0.Errorf("unexpected range response: %v %q", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("it should reject tampered tokens", func(t0 *testing.T) {
+		link := createLink(url.Values{"path": {"/docs/report.txt"}})
+		token := []byte(strings.TrimPrefix(link.Link, SHARE_PREFIX+"/"))
+		token[len(token)-2] ^= 1
+		if w := sendShareRequest(&app, http.MethodGet, SHARE_PREFIX+"/"+string(token), nil, ""); w.Code != http.StatusNotFound {
+			t0.Errorf("expected 404, got %v", w.Code)
+		}
+	})
+
+	t.Run("it should only share existing files", func(t0 *testing.T) {
+		for _, p := range []string{"/docs", "/missing.txt"} {
+			if w := sendShareRequest(&app, http.MethodPost, SHARE_PREFIX, url.Values{"path": {p}}, "user1"); w.Code != http.StatusNotFound {
+				t0.Errorf("expected 404 for %s, got %v", p, w.Code)
+			}
+		}
+	})
+
+	t.Run("it should let only the owner revoke a link", func(t0 *testing.T) {
+		link := createLink(url.Values{"path": {"/docs/report.txt"}})
+		if w := sendShareRequest(&app, http.MethodDelete, link.Link, nil, "user2"); w.Code != http.StatusNotFound {
+			t0.Errorf("expected 404, got %v", w.Code)
+		}
+		if w := sendShareRequest(&app, http.MethodDelete, link.Link, nil, "user1"); w.Code != http.StatusNoContent {
+			t0.Errorf("expected 204, got %v", w.Code)
+		}
+		id, _, _ := parseLinkToken(strings.TrimPrefix(link.Link, SHARE_PREFIX+"/"))
+		if _, err := os.Stat(string(app.shareContentFilepath(id))); !os.IsNotExist(err) {
+			t0.Errorf("expected the copy of the file to be removed, got %v", err)
+		}
+		if w := sendShareRequest(&app, http.MethodGet, link.Link, nil, ""); w.Code != http.StatusNotFound {
+			t0.Errorf("expected 404, got %v", w.Code)
+		}
+	})
+
+	t.Run("it should expire links", func(t0 *testing.T) {
+		link := createLink(url.Values{"path": {"/docs/report.txt"}, "expires": {"1ns"}})
+		if w := sendShareRequest(&app, http.MethodGet, link.Link, nil, ""); w.Code != http.StatusNotFound {
+			t0.Errorf("expected 404, got %v", w.Code)
+		}
+	})
+
+	t.Run("it should require the share password", func(t0 *testing.T) {
+		link := createLink(url.Values{"path": {"/docs/report.txt"}, "password": {"secret"}})
+		if w := sendShareRequest(&app, http.MethodGet, link.Link, nil, ""); w.Code != http.StatusUnauthorized {
+			t0.Errorf("expected 401, got %v", w.Code)
+		}
+		r := httptest.NewRequest(http.MethodGet, link.Link, nil)
+		r.SetBasicAuth("", "secret")
+		w := httptest.NewRecorder()
+		app.handleShare(w, r)
+		if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+			t0.Errorf("unexpected response: %v %q", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("it should lock out guessing of the share password", func(t0 *testing.T) {
+		defer func(limiter *LoginLimiter) { app.loginLimiter = limiter }(app.loginLimiter)
+		app.loginLimiter = newLoginLimiter(2, 1, time.Minute, time.Hour)
+		link := createLink(url.Values{"path": {"/docs/report.txt"}, "password": {"secret"}})
+		openLink := createLink(url.Values{"path": {"/docs/report.txt"}})
+		sendWithPassword := func(password string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(http.MethodGet, link.Link, nil)
+			r.SetBasicAuth("", password)
+			w := httptest.NewRecorder()
+			app.handleShare(w, r)
+			return w
+		}
+		for i := 0; i < 2; i++ {
+			if w := sendWithPassword("wrong"); w.Code != http.StatusUnauthorized {
+				t0.Errorf("expected 401, got %v", w.Code)
+			}
+		}
+		w := sendWithPassword("secret")
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+			t0.Errorf("expected 429 with Retry-After, got %v %v", w.Code, w.Header())
+		}
+		if w := sendShareRequest(&app, http.MethodGet, openLink.Link, nil, ""); w.Code != http.StatusOK {
+			t0.Errorf("expected links without password to stay available, got %v", w.Code)
+		}
+	})
+
+	t.Run("it should limit the downloads", func(t0 *testing.T) {
+		link := createLink(url.Values{"path": {"/docs/report.txt"}, "downloads": {"2"}})
+		for i, expected := range []int{http.StatusOK, http.StatusOK, http.StatusNotFound} {
+			if w := sendShareRequest(&app, http.MethodGet, link.Link, nil, ""); w.Code != expected {
+				t0.Errorf("download %d: expected %v, got %v", i, expected, w.Code)
+			}
+		}
+	})
+
+	t.Run("it should only count downloads from the beginning of the file", func(t0 *testing.T) {
+		link := createLink(url.Values{"path": {"/docs/report.txt"}, "downloads": {"1"}})
+		send := func(header string, value string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(http.MethodGet, link.Link, nil)
+			r.Header.Set(header, value)
+			w := httptest.NewRecorder()
+			app.handleShare(w, r)
+			return w
+		}
+		for i := range 2 {
+			if w := send("Range", "bytes=5-"); w.Code != http.StatusPartialContent || w.Body.String() != "56789" {
+				t0.Errorf("range %d: unexpected response: %v %q", i, w.Code, w.Body.String())
+			}
+			if w := send("If-Modified-Since", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)); w.Code != http.StatusNotModified {
+				t0.Errorf("conditional %d: expected 304, got %v", i, w.Code)
+			}
+		}
+		if w := send("Range", "bytes=0-4"); w.Code != http.StatusPartialContent || w.Body.String() != "01234" {
+			t0.Errorf("unexpected response: %v %q", w.Code, w.Body.String())
+		}
+		if w := send("Range", "bytes=0-4"); w.Code != http.StatusNotFound || w.Header().Get("Content-Range") != "" {
+			t0.Errorf("expected the link to be used up, got %v %v", w.Code, w.Header())
+		}
+	})
+
+	t.Run("it should list and inspect the shares of the owner", func(t0 *testing.T) {
+		link := createLink(url.Values{"path": {"/docs/report.txt"}, "expires": {"2100-01-01T00:00:00Z"}, "downloads": {"5"}})
+		sendShareRequest(&app, http.MethodGet, link.Link, nil, "")
+
+		var shares []ShareInfo
+		Check(json.Unmarshal(sendShareRequest(&app, http.MethodGet, SHARE_PREFIX, nil, "user1").Body.Bytes(), &shares))
+		links := []string{}
+		for _, share := range shares {
+			links = append(links, share.Link)
+		}
+		if !slices.Contains(links, link.Link) || len(shares) != 6 { // revoked, expired and used up links are gone
+			t0.Errorf("unexpected shares: %v", shares)
+		}
+		if w := sendShareRequest(&app, http.MethodGet, SHARE_PREFIX, nil, "user2"); w.Body.String() != "[]" {
+			t0.Errorf("unexpected shares of other user: %s", w.Body.String())
+		}
+
+		var info ShareInfo
+		Check(json.Unmarshal(sendShareRequest(&app, http.MethodGet, link.Link+"?info", nil, "user1").Body.Bytes(), &info))
+		if info.Downloads != 1 || info.MaxDownloads != 5 || info.Expires.Year() != 2100 {
+			t0.Errorf("unexpected info: %+v", info)
+		}
+		if w := sendShareRequest(&app, http.MethodGet, link.Link+"?info", nil, "user2"); w.Code != http.StatusNotFound {
+			t0.Errorf("expected 404, got %v", w.Code)
+		}
+	})
+
+	t.Run("it should not run scripts of shared files", func(t0 *testing.T) {
+		uploadFile(&app, http.MethodPost, "/docs/page.html", "<script>alert(1)</script>")
+		link := createLink(url.Values{"path": {"/docs/page.html"}})
+		w := sendShareRequest(&app, http.MethodGet, link.Link, nil, "")
+		if w.Header().Get("Content-Security-Policy") != "sandbox" || !strings.HasPrefix(w.Header().Get("Content-Disposition"), "attachment") {
+			t0.Errorf("unexpected headers: %v", w.Header())
+		}
+		w = sendShareRequest(&app, http.MethodGet, createLink(url.Values{"path": {"/docs/report.txt"}}).Link, nil, "")
+		if w.Header().Get("Content-Security-Policy") != "sandbox" || !strings.HasPrefix(w.Header().Get("Content-Disposition"), "inline") {
+			t0.Errorf("unexpected headers: %v", w.Header())
+		}
+	})
+
+	t.Run("it should not reveal the user key to the link holder", func(t0 *testing.T) {
+		link := createLink(url.Values{"path": {"/docs/report.txt"}})
+		id, linkKey, _ := parseLinkToken(strings.TrimPrefix(link.Link, SHARE_PREFIX+"/"))
+		var record json.RawMessage
+		Check(readLinkRecord(app.shareRecordFilepath(id), linkKey, &record))
+		auth := &AuthData{userSalt: makeUserSalt(app.appKey, "user1")}
+		auth.userKey = Password("passwordpassword").hash(auth.userSalt)
+		if strings.Contains(string(record), strEncode(auth.userKey)) || strings.Contains(string(record), base64.StdEncoding.EncodeToString(auth.userKey)) {
+			t0.Errorf("the record contains the user key: %s", record)
+		}
+
+		uploadFile(&app, http.MethodPost, "/docs/draft.txt", "first")
+		link = createLink(url.Values{"path": {"/docs/draft.txt"}})
+		uploadFile(&app, http.MethodPut, "/docs/draft.txt", "second")
+		if w := sendShareRequest(&app, http.MethodGet, link.Link, nil, ""); w.Body.String() != "first" {
+			t0.Errorf("expected the file as it was shared, got %q", w.Body.String())
+		}
+	})
+}
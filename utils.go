@@ -21,6 +21,13 @@ func IgnoreErrFunc(f func() error) {
 	_ = f()
 }
 
+func IgnoreNotExist(err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
 func Try[T any](result T, err error) T {
 	Check(err)
 	return result
@@ -0,0 +1,855 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// url paths below this prefix are reserved for the server itself and can't be used for files
+const SYSTEM_PATH_PREFIX = "/.crydrv"
+
+const WEBDAV_PREFIX = SYSTEM_PATH_PREFIX + "/dav"
+
+// dead properties set via PROPPATCH are stored in an encrypted sidecar file
+const PROPS_PREFIX = "props:"
+
+const DAV_LOCK_MAX_TIMEOUT = time.Hour
+
+func isReservedPath(urlPath string) bool {
+	return urlPath == SYSTEM_PATH_PREFIX || strings.HasPrefix(urlPath, SYSTEM_PATH_PREFIX+"/") || isMountPath(urlPath)
+}
+
+// handleWebdav serves the drive of the authenticated user via WebDAV class 1 and 2 (RFC 4918)
+func (app *AppData) handleWebdav(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, WEBDAV_PREFIX)
+	if rest == r.URL.Path || (rest != "" && !strings.HasPrefix(rest, "/")) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	davPath := path.Clean("/" + rest)
+
+	if r.Method == "OPTIONS" {
+		w.Header().Set("DAV", "1, 2")
+		w.Header().Set("MS-Author-Via", "DAV")
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, MKCOL, MOVE, COPY, PROPFIND, PROPPATCH, LOCK, UNLOCK")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	auth := app.handleAuth(w, r)
+	if auth == nil {
+		// handleAuth has already set the http response
+		return
+	}
+	drive := app.userDrive(auth)
+
+	switch r.Method {
+	case "GET", "HEAD":
+		app.davGet(w, r, drive, davPath)
+	case "PUT":
+		app.davPut(w, r, drive, davPath)
+	case "DELETE":
+		app.davDelete(w, r, drive, davPath)
+	case "MKCOL":
+		app.davMkcol(w, r, drive, davPath)
+	case "MOVE", "COPY":
+		if dstPath, err := parseDestination(r, WEBDAV_PREFIX); err == nil {
+			if !davLocks.allowed(drive, r, dstPath, true) || (r.Method == "MOVE" && !davLocks.allowed(drive, r, davPath, true)) {
+				http.Error(w, "locked", http.StatusLocked)
+				return
+			}
+		}
+		app.handleMoveCopy(w, r, drive, davPath, WEBDAV_PREFIX)
+		if exists, err := drive.exists(davPath); err == nil && !exists {
+			davLocks.releaseAll(drive, davPath)
+		}
+	case "PROPFIND":
+		app.davPropfind(w, r, drive, davPath)
+	case "PROPPATCH":
+		app.davProppatch(w, r, drive, davPath)
+	case "LOCK":
+		app.davLock(w, r, drive, davPath)
+	case "UNLOCK":
+		app.davUnlock(w, r, drive, davPath)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (app *AppData) davGet(w http.ResponseWriter, r *http.Request, drive *CryDrive, davPath string) {
+	fsPath := drive.locate(CryPath(davPath))
+	lock := fsPath.ReadLock()
+	defer fsPath.ReadUnlock(lock)
+	if file, err := NewCryFileReader(fsPath, drive.key); err == nil {
+		defer CheckFunc(file.Close)
+		w.Header().Set("ETag", file.etag)
+		if digest := file.reprDigest(); digest != "" {
+			w.Header().Set("Repr-Digest", digest)
+		}
+		file.enableSharedBlocks(app.sharedBlocks)
+		file.enableReadAhead(r.Context(), app.readAheadBlocks)
+		http.ServeContent(w, r, davPath, file.modTime, file)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		http.Error(w, sanitizeError(err), http.StatusBadRequest)
+	} else if ok, err := drive.isDir(davPath); err == nil && ok {
+		http.Error(w, "method not allowed on collections", http.StatusMethodNotAllowed)
+	} else {
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// davParentExists checks the precondition of PUT, MKCOL and LOCK: intermediate collections are never created implicitly
+func davParentExists(w http.ResponseWriter, drive *CryDrive, davPath string) bool {
+	if ok, err := drive.isDir(path.Dir(davPath)); err != nil {
+		http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+		return false
+	} else if !ok {
+		http.Error(w, "parent collection does not exist", http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+func (app *AppData) davPut(w http.ResponseWriter, r *http.Request, drive *CryDrive, davPath string) {
+	if !davLocks.allowed(drive, r, davPath, false) {
+		http.Error(w, "locked", http.StatusLocked)
+		return
+	}
+	if !davParentExists(w, drive, davPath) {
+		return
+	}
+	if ok, err := drive.isDir(davPath); err != nil {
+		http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+		return
+	} else if ok {
+		http.Error(w, "cannot overwrite a collection", http.StatusMethodNotAllowed)
+		return
+	}
+	fsPath := drive.locate(CryPath(davPath))
+	unlock, ok := handlePreconditions(w, r, fsPath, drive.key)
+	if !ok {
+		return
+	}
+	defer unlock()
+	existed, err := drive.isFile(davPath)
+	if err != nil {
+		http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+		return
+	}
+
+	content, err := verifyingReader(r.Body, r.Header, "Content-Digest", "Repr-Digest", "Content-MD5")
+	if err != nil {
+		http.Error(w, sanitizeError(err), http.StatusBadRequest)
+		return
+	}
+	if err := WriteCryFile(fsPath, content, r.ContentLength, drive.key); isDigestError(err) {
+		http.Error(w, sanitizeError(err), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+		return
+	}
+	if err := drive.link(davPath, false); err != nil {
+		http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+		return
+	}
+	setETag(w, fsPath, drive.key)
+
+	if existed {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func (app *AppData) davDelete(w http.ResponseWriter, r *http.Request, drive *CryDrive, davPath string) {
+	if davPath == "/" {
+		http.Error(w, "cannot delete the root collection", http.StatusForbidden)
+		return
+	}
+	if !davLocks.allowed(drive, r, davPath, true) {
+		http.Error(w, "locked", http.StatusLocked)
+		return
+	}
+	unlock, ok := handlePreconditions(w, r, drive.locate(CryPath(davPath)), drive.key)
+	if !ok {
+		return
+	}
+	defer unlock()
+	if err := drive.remove(davPath); errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+		return
+	}
+	davLocks.releaseAll(drive, davPath)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *AppData) davMkcol(w http.ResponseWriter, r *http.Request, drive *CryDrive, davPath string) {
+	if r.ContentLength > 0 {
+		http.Error(w, "request body is not supported", http.StatusUnsupportedMediaType)
+		return
+	}
+	if !davLocks.allowed(drive, r, davPath, false) {
+		http.Error(w, "locked", http.StatusLocked)
+		return
+	}
+	if ok, err := drive.exists(davPath); err != nil {
+		http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+		return
+	} else if ok {
+		http.Error(w, "resource already exists", http.StatusMethodNotAllowed)
+		return
+	}
+	if !davParentExists(w, drive, davPath) {
+		return
+	}
+	if err := drive.mkdir(davPath); err != nil {
+		http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// ---------- properties ----------
+
+type DavInfo struct {
+	isDir   bool
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+type DavDeadProp struct {
+	Space string
+	Local string
+	Inner string
+}
+
+// xmlAny captures an arbitrary xml element
+type xmlAny struct {
+	XMLName xml.Name
+	Inner   string `xml:",innerxml"`
+}
+
+type davPropfindRequest struct {
+	XMLName  xml.Name  `xml:"propfind"`
+	AllProp  *struct{} `xml:"allprop"`
+	PropName *struct{} `xml:"propname"`
+	Prop     *struct {
+		Props []xmlAny `xml:",any"`
+	} `xml:"prop"`
+}
+
+type davProppatchRequest struct {
+	XMLName    xml.Name `xml:"propertyupdate"`
+	Operations []struct {
+		XMLName xml.Name
+		Prop    struct {
+			Props []xmlAny `xml:",any"`
+		} `xml:"prop"`
+	} `xml:",any"`
+}
+
+var davLiveProps = []string{"displayname", "resourcetype", "getcontentlength", "getcontenttype", "getlastmodified", "getetag", "supportedlock", "lockdiscovery"}
+
+func (drive *CryDrive) davStat(davPath string) (*DavInfo, error) {
+	fsPath := drive.locate(CryPath(davPath))
+	lock := fsPath.ReadLock()
+	file, err := NewCryFileReader(fsPath, drive.key)
+	fsPath.ReadUnlock(lock)
+	if err == nil {
+		defer IgnoreErrFunc(file.Close)
+		return &DavInfo{size: file.datasize, modTime: file.modTime, etag: file.etag}, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	if stat, err := os.Stat(string(drive.dirIndexFilepath(davPath))); err == nil {
+		return &DavInfo{isDir: true, modTime: stat.ModTime()}, nil
+	} else if davPath == "/" && errors.Is(err, os.ErrNotExist) {
+		return &DavInfo{isDir: true}, nil
+	} else {
+		return nil, err
+	}
+}
+
+func (drive *CryDrive) readProps(davPath string) ([]DavDeadProp, error) {
+	fsPath := drive.locate(CryPath(PROPS_PREFIX + davPath))
+	lock := fsPath.ReadLock()
+	defer fsPath.ReadUnlock(lock)
+
+	file, err := NewCryFileReader(fsPath, drive.key)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer IgnoreErrFunc(file.Close)
+
+	var props []DavDeadProp
+	if err := json.NewDecoder(file).Decode(&props); err != nil {
+		return nil, err
+	}
+	return props, nil
+}
+
+func (drive *CryDrive) writeProps(davPath string, props []DavDeadProp) error {
+	if len(props) == 0 {
+		return IgnoreNotExist(drive.removeFile(CryPath(PROPS_PREFIX + davPath)))
+	}
+	data, err := json.Marshal(props)
+	if err != nil {
+		return err
+	}
+	return WriteCryFile(drive.locate(CryPath(PROPS_PREFIX+davPath)), bytes.NewReader(data), int64(len(data)), drive.key)
+}
+
+// davPropXML renders a property element of an arbitrary namespace
+func davPropXML(name xml.Name, inner string) string {
+	xmlns := `xmlns=""`
+	if name.Space != "" {
+		xmlns = `xmlns:x="` + xmlEscape(name.Space) + `"`
+		name.Local = "x:" + name.Local
+	}
+	if inner == "" {
+		return fmt.Sprintf("<%s %s/>", name.Local, xmlns)
+	}
+	return fmt.Sprintf("<%s %s>%s</%s>", name.Local, xmlns, inner, name.Local)
+}
+
+func xmlEscape(value string) string {
+	var buf strings.Builder
+	Check(xml.EscapeText(&buf, []byte(value)))
+	return buf.String()
+}
+
+func davHref(davPath string, isDir bool) string {
+	href := (&url.URL{Path: WEBDAV_PREFIX + davPath}).EscapedPath()
+	if isDir && !strings.HasSuffix(href, "/") {
+		href += "/"
+	}
+	return xmlEscape(href)
+}
+
+// davLiveProp renders the value of a live property, ok is false for unknown or inapplicable properties
+func (drive *CryDrive) davLiveProp(name string, davPath string, info *DavInfo) (value string, ok bool) {
+	switch name {
+	case "displayname":
+		return xmlEscape(path.Base(davPath)), true
+	case "resourcetype":
+		if info.isDir {
+			return "<D:collection/>", true
+		}
+		return "", true
+	case "getcontentlength":
+		return strconv.FormatInt(info.size, 10), !info.isDir
+	case "getcontenttype":
+		contentType := mime.TypeByExtension(path.Ext(davPath))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		return xmlEscape(contentType), !info.isDir
+	case "getlastmodified":
+		return info.modTime.UTC().Format(http.TimeFormat), !info.modTime.IsZero()
+	case "getetag":
+		return xmlEscape(info.etag), !info.isDir
+	case "supportedlock":
+		return "<D:lockentry><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>" +
+			"<D:lockentry><D:lockscope><D:shared/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>", true
+	case "lockdiscovery":
+		var buf strings.Builder
+		for _, lock := range davLocks.covering(drive, davPath) {
+			buf.WriteString(lock.activeLockXML())
+		}
+		return buf.String(), true
+	}
+	return "", false
+}
+
+func (drive *CryDrive) davPropResponse(davPath string, info *DavInfo, request *davPropfindRequest) (string, error) {
+	deadProps, err := drive.readProps(davPath)
+	if err != nil {
+		return "", err
+	}
+
+	var found, missing strings.Builder
+	if request.Prop == nil {
+		names := request.PropName != nil
+		for _, name := range davLiveProps {
+			if value, ok := drive.davLiveProp(name, davPath, info); ok {
+				if names {
+					value = ""
+				}
+				fmt.Fprintf(&found, "<D:%s>%s</D:%s>", name, value, name)
+			}
+		}
+		for _, prop := range deadProps {
+			if names {
+				found.WriteString(davPropXML(xml.Name{Space: prop.Space, Local: prop.Local}, ""))
+			} else {
+				found.WriteString(davPropXML(xml.Name{Space: prop.Space, Local: prop.Local}, prop.Inner))
+			}
+		}
+	} else {
+	nextProp:
+		for _, requested := range request.Prop.Props {
+			if requested.XMLName.Space == "DAV:" {
+				if value, ok := drive.davLiveProp(requested.XMLName.Local, davPath, info); ok {
+					fmt.Fprintf(&found, "<D:%s>%s</D:%s>", requested.XMLName.Local, value, requested.XMLName.Local)
+					continue
+				}
+			}
+			for _, prop := range deadProps {
+				if prop.Space == requested.XMLName.Space && prop.Local == requested.XMLName.Local {
+					found.WriteString(davPropXML(requested.XMLName, prop.Inner))
+					continue nextProp
+				}
+			}
+			missing.WriteString(davPropXML(requested.XMLName, ""))
+		}
+	}
+
+	var response strings.Builder
+	fmt.Fprintf(&response, "<D:response><D:href>%s</D:href>", davHref(davPath, info.isDir))
+	if found.Len() > 0 || missing.Len() == 0 {
+		fmt.Fprintf(&response, "<D:propstat><D:prop>%s</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat>", found.String())
+	}
+	if missing.Len() > 0 {
+		fmt.Fprintf(&response, "<D:propstat><D:prop>%s</D:prop><D:status>HTTP/1.1 404 Not Found</D:status></D:propstat>", missing.String())
+	}
+	response.WriteString("</D:response>")
+	return response.String(), nil
+}
+
+func writeMultistatus(w http.ResponseWriter, responses []string) {
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusMultiStatus)
+	_, _ = io.WriteString(w, `<?xml version="1.0" encoding="utf-8"?><D:multistatus xmlns:D="DAV:">`+strings.Join(responses, "")+`</D:multistatus>`)
+}
+
+func (app *AppData) davPropfind(w http.ResponseWriter, r *http.Request, drive *CryDrive, davPath string) {
+	// clients like Finder or davfs2 often send no depth, which is served as 1 instead of infinity (RFC 4918, section 9.1)
+	depth := r.Header.Get("Depth")
+	switch depth {
+	case "":
+		depth = "1"
+	case "0", "1":
+	case "infinity":
+		w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = io.WriteString(w, `<?xml version="1.0" encoding="utf-8"?><D:error xmlns:D="DAV:"><D:propfind-finite-depth/></D:error>`)
+		return
+	default:
+		http.Error(w, "invalid depth header", http.StatusBadRequest)
+		return
+	}
+
+	request := new(davPropfindRequest)
+	if body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20)); err != nil {
+		http.Error(w, sanitizeError(err), http.StatusBadRequest)
+		return
+	} else if len(bytes.TrimSpace(body)) > 0 {
+		if err := xml.Unmarshal(body, request); err != nil {
+			http.Error(w, sanitizeError(err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	info, err := drive.davStat(davPath)
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+		return
+	}
+
+	response, err := drive.davPropResponse(davPath, info, request)
+	if err != nil {
+		http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+		return
+	}
+	responses := []string{response}
+
+	if info.isDir && depth == "1" {
+		entries, err := drive.readDir(davPath)
+		if err != nil {
+			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+			return
+		}
+		for _, entry := range entries {
+			childPath := path.Join(davPath, entry.name)
+			childInfo, err := drive.davStat(childPath)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			} else if err != nil {
+				http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+				return
+			}
+			response, err := drive.davPropResponse(childPath, childInfo, request)
+			if err != nil {
+				http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+				return
+			}
+			responses = append(responses, response)
+		}
+	}
+
+	writeMultistatus(w, responses)
+}
+
+func (app *AppData) davProppatch(w http.ResponseWriter, r *http.Request, drive *CryDrive, davPath string) {
+	if !davLocks.allowed(drive, r, davPath, false) {
+		http.Error(w, "locked", http.StatusLocked)
+		return
+	}
+	info, err := drive.davStat(davPath)
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+		return
+	}
+
+	request := new(davProppatchRequest)
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(request); err != nil {
+		http.Error(w, sanitizeError(err), http.StatusBadRequest)
+		return
+	}
+
+	defer lockMetadata(drive.locate(CryPath(PROPS_PREFIX + davPath)))()
+	props, err := drive.readProps(davPath)
+	if err != nil {
+		http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+		return
+	}
+
+	var names, forbidden []string
+	for _, operation := range request.Operations {
+		for _, prop := range operation.Prop.Props {
+			name := davPropXML(prop.XMLName, "")
+			if prop.XMLName.Space == "DAV:" {
+				forbidden = append(forbidden, name) // live properties are protected
+				continue
+			}
+			names = append(names, name)
+
+			index := -1
+			for i := range props {
+				if props[i].Space == prop.XMLName.Space && props[i].Local == prop.XMLName.Local {
+					index = i
+				}
+			}
+			switch {
+			case operation.XMLName.Local == "set" && index >= 0:
+				props[index].Inner = prop.Inner
+			case operation.XMLName.Local == "set":
+				props = append(props, DavDeadProp{Space: prop.XMLName.Space, Local: prop.XMLName.Local, Inner: prop.Inner})
+			case operation.XMLName.Local == "remove" && index >= 0:
+				props = append(props[:index], props[index+1:]...)
+			}
+		}
+	}
+
+	var response strings.Builder
+	fmt.Fprintf(&response, "<D:response><D:href>%s</D:href>", davHref(davPath, info.isDir))
+	if len(forbidden) > 0 {
+		// the update is atomic: nothing is changed if a single property can't be modified
+		fmt.Fprintf(&response, "<D:propstat><D:prop>%s</D:prop><D:status>HTTP/1.1 403 Forbidden</D:status></D:propstat>", strings.Join(forbidden, ""))
+		if len(names) > 0 {
+			fmt.Fprintf(&response, "<D:propstat><D:prop>%s</D:prop><D:status>HTTP/1.1 424 Failed Dependency</D:status></D:propstat>", strings.Join(names, ""))
+		}
+	} else {
+		if err := drive.writeProps(davPath, props); err != nil {
+			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(&response, "<D:propstat><D:prop>%s</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat>", strings.Join(names, ""))
+	}
+	response.WriteString("</D:response>")
+	writeMultistatus(w, []string{response.String()})
+}
+
+// ---------- locks ----------
+
+type DavLock struct {
+	token    string
+	drive    FsFilepath // identifies the drive the lock belongs to
+	root     string
+	infinite bool
+	shared   bool
+	owner    string
+	timeout  time.Duration
+	expires  time.Time
+}
+
+type DavLockManager struct {
+	sync.Mutex
+	locks map[string]*DavLock
+}
+
+// locks are kept in memory only and are gone after a restart
+var davLocks = &DavLockManager{
+	locks: make(map[string]*DavLock),
+}
+
+var lockTokenPattern = regexp.MustCompile(`<(opaquelocktoken:[^>]+)>`)
+
+func driveID(drive *CryDrive) FsFilepath {
+	return drive.locate("")
+}
+
+func isBelow(urlPath string, dir string) bool {
+	return urlPath != dir && (dir == "/" || strings.HasPrefix(urlPath, dir+"/"))
+}
+
+func (lock *DavLock) covers(urlPath string) bool {
+	return lock.root == urlPath || (lock.infinite && isBelow(urlPath, lock.root))
+}
+
+func (lock *DavLock) activeLockXML() string {
+	scope, depth, timeout := "exclusive", "0", "Second-"+strconv.FormatInt(int64(lock.timeout.Seconds()), 10)
+	if lock.shared {
+		scope = "shared"
+	}
+	if lock.infinite {
+		depth = "infinity"
+	}
+	return fmt.Sprintf("<D:activelock><D:locktype><D:write/></D:locktype><D:lockscope><D:%s/></D:lockscope><D:depth>%s</D:depth>"+
+		"<D:owner>%s</D:owner><D:timeout>%s</D:timeout><D:locktoken><D:href>%s</D:href></D:locktoken>"+
+		"<D:lockroot><D:href>%s</D:href></D:lockroot></D:activelock>",
+		scope, depth, lock.owner, timeout, lock.token, davHref(lock.root, false))
+}
+
+// active returns all unexpired locks of a drive. the caller must hold the mutex
+func (manager *DavLockManager) active(drive *CryDrive) []*DavLock {
+	id := driveID(drive)
+	var locks []*DavLock
+	for token, lock := range manager.locks {
+		if time.Now().After(lock.expires) {
+			delete(manager.locks, token)
+		} else if lock.drive == id {
+			locks = append(locks, lock)
+		}
+	}
+	return locks
+}
+
+func (manager *DavLockManager) covering(drive *CryDrive, urlPath string) []*DavLock {
+	manager.Lock()
+	defer manager.Unlock()
+	var locks []*DavLock
+	for _, lock := range manager.active(drive) {
+		if lock.covers(urlPath) {
+			locks = append(locks, lock)
+		}
+	}
+	return locks
+}
+
+// allowed checks whether the request submits the tokens of all locks protecting the path (and its descendants)
+func (manager *DavLockManager) allowed(drive *CryDrive, r *http.Request, urlPath string, descendants bool) bool {
+	tokens := make(map[string]bool)
+	for _, match := range lockTokenPattern.FindAllStringSubmatch(r.Header.Get("If"), -1) {
+		tokens[match[1]] = true
+	}
+
+	manager.Lock()
+	defer manager.Unlock()
+	protected, submitted := false, false
+	for _, lock := range manager.active(drive) {
+		if lock.covers(urlPath) || (descendants && isBelow(lock.root, urlPath)) {
+			protected = true
+			if tokens[lock.token] {
+				submitted = true
+			} else if !lock.shared {
+				return false
+			}
+		}
+	}
+	return !protected || submitted
+}
+
+func (manager *DavLockManager) create(drive *CryDrive, lock *DavLock) bool {
+	manager.Lock()
+	defer manager.Unlock()
+	for _, other := range manager.active(drive) {
+		overlaps := other.covers(lock.root) || (lock.infinite && isBelow(other.root, lock.root))
+		if overlaps && (!other.shared || !lock.shared) {
+			return false
+		}
+	}
+	lock.drive = driveID(drive)
+	lock.token = "opaquelocktoken:" + makeUUID()
+	lock.expires = time.Now().Add(lock.timeout)
+	manager.locks[lock.token] = lock
+	return true
+}
+
+func (manager *DavLockManager) refresh(drive *CryDrive, urlPath string, r *http.Request, timeout time.Duration) *DavLock {
+	manager.Lock()
+	defer manager.Unlock()
+	for _, match := range lockTokenPattern.FindAllStringSubmatch(r.Header.Get("If"), -1) {
+		if lock := manager.locks[match[1]]; lock != nil && lock.drive == driveID(drive) && lock.covers(urlPath) {
+			lock.timeout = timeout
+			lock.expires = time.Now().Add(timeout)
+			return lock
+		}
+	}
+	return nil
+}
+
+func (manager *DavLockManager) remove(drive *CryDrive, urlPath string, token string) bool {
+	manager.Lock()
+	defer manager.Unlock()
+	if lock := manager.locks[token]; lock != nil && lock.drive == driveID(drive) && lock.covers(urlPath) {
+		delete(manager.locks, token)
+		return true
+	}
+	return false
+}
+
+// releaseAll drops the locks of resources which have been deleted or moved away
+func (manager *DavLockManager) releaseAll(drive *CryDrive, urlPath string) {
+	manager.Lock()
+	defer manager.Unlock()
+	for _, lock := range manager.active(drive) {
+		if lock.root == urlPath || isBelow(lock.root, urlPath) {
+			delete(manager.locks, lock.token)
+		}
+	}
+}
+
+func makeUUID() string {
+	b := make([]byte, 16)
+	Try(rand.Read(b))
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // variant 10
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func parseLockTimeout(header string) time.Duration {
+	for _, value := range strings.Split(header, ",") {
+		value = strings.TrimSpace(value)
+		if seconds, err := strconv.ParseUint(strings.TrimPrefix(value, "Second-"), 10, 32); err == nil && strings.HasPrefix(value, "Second-") {
+			return Clamp(time.Second, time.Duration(seconds)*time.Second, DAV_LOCK_MAX_TIMEOUT)
+		}
+	}
+	return DAV_LOCK_MAX_TIMEOUT
+}
+
+type davLockInfo struct {
+	XMLName   xml.Name  `xml:"lockinfo"`
+	Exclusive *struct{} `xml:"lockscope>exclusive"`
+	Shared    *struct{} `xml:"lockscope>shared"`
+	Write     *struct{} `xml:"locktype>write"`
+	Owner     struct {
+		Inner string `xml:",innerxml"`
+	} `xml:"owner"`
+}
+
+func writeLockDiscovery(w http.ResponseWriter, lock *DavLock, status int) {
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(status)
+	_, _ = io.WriteString(w, `<?xml version="1.0" encoding="utf-8"?><D:prop xmlns:D="DAV:"><D:lockdiscovery>`+lock.activeLockXML()+`</D:lockdiscovery></D:prop>`)
+}
+
+func (app *AppData) davLock(w http.ResponseWriter, r *http.Request, drive *CryDrive, davPath string) {
+	timeout := parseLockTimeout(r.Header.Get("Timeout"))
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, sanitizeError(err), http.StatusBadRequest)
+		return
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		if lock := davLocks.refresh(drive, davPath, r, timeout); lock != nil {
+			writeLockDiscovery(w, lock, http.StatusOK)
+		} else {
+			http.Error(w, "no matching lock to refresh", http.StatusPreconditionFailed)
+		}
+		return
+	}
+
+	info := new(davLockInfo)
+	if err := xml.Unmarshal(body, info); err != nil {
+		http.Error(w, sanitizeError(err), http.StatusBadRequest)
+		return
+	}
+	if info.Write == nil || (info.Exclusive == nil) == (info.Shared == nil) {
+		http.Error(w, "only exclusive or shared write locks are supported", http.StatusBadRequest)
+		return
+	}
+	lock := &DavLock{
+		root:    davPath,
+		shared:  info.Shared != nil,
+		owner:   info.Owner.Inner,
+		timeout: timeout,
+	}
+	switch r.Header.Get("Depth") {
+	case "", "infinity":
+		lock.infinite = true
+	case "0":
+	default:
+		http.Error(w, "invalid depth header", http.StatusBadRequest)
+		return
+	}
+
+	exists, err := drive.exists(davPath)
+	if err != nil {
+		http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+		return
+	}
+	if !exists && !davParentExists(w, drive, davPath) {
+		return
+	}
+	if !davLocks.create(drive, lock) {
+		http.Error(w, "locked", http.StatusLocked)
+		return
+	}
+
+	status := http.StatusOK
+	if !exists {
+		// locking an unmapped url creates an empty resource
+		if err := WriteCryFile(drive.locate(CryPath(davPath)), strings.NewReader(""), 0, drive.key); err != nil {
+			davLocks.remove(drive, davPath, lock.token)
+			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+			return
+		}
+		if err := drive.link(davPath, false); err != nil {
+			http.Error(w, sanitizeError(err), http.StatusInternalServerError)
+			return
+		}
+		status = http.StatusCreated
+	}
+	w.Header().Set("Lock-Token", "<"+lock.token+">")
+	writeLockDiscovery(w, lock, status)
+}
+
+func (app *AppData) davUnlock(w http.ResponseWriter, r *http.Request, drive *CryDrive, davPath string) {
+	token := strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(r.Header.Get("Lock-Token")), "<"), ">")
+	if davLocks.remove(drive, davPath, token) {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		http.Error(w, "lock token does not match", http.StatusConflict)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func sendDavRequest(app *AppData, method string, urlPath string, body string, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, WEBDAV_PREFIX+urlPath, strings.NewReader(body))
+	for key, value := range headers {
+		r.Header.Set(key, value)
+	}
+	r.SetBasicAuth("user1", "passwordpassword")
+	w := httptest.NewRecorder()
+	app.handleWebdav(w, r)
+	return w
+}
+
+func TestWebdav(t *testing.T) {
+
+	t.Setenv("SECRET_KEY", "q38rcNPrHkxBonj16HTKG95zbq0bzmJ189C9A-EgTxg")
+	t.Setenv("OPEN_REGISTRATION", "true")
+	app := makeAppData()
+
+	app.webBaseDir = "./www-test"
+	defer CheckFunc(func() error { return os.RemoveAll(app.webBaseDir) })
+	Check(os.MkdirAll(app.webBaseDir, 0700))
+
+	t.Run("it should announce webdav support", func(t0 *testing.T) {
+		w := sendDavRequest(&app, http.MethodOptions, "/", "", nil)
+		if w.Header().Get("DAV") != "1, 2" {
+			t0.Errorf("unexpected DAV header: %v", w.Header().Get("DAV"))
+		}
+	})
+
+	t.Run("it should create collections and files", func(t0 *testing.T) {
+		if w := sendDavRequest(&app, http.MethodPut, "/docs/a.txt", "content", nil); w.Code != http.StatusConflict {
+			t0.Errorf("expected 409 for missing parent, got %v", w.Code)
+		}
+		if w := sendDavRequest(&app, "MKCOL", "/docs", "", nil); w.Code != http.StatusCreated {
+			t0.Errorf("expected 201, got %v", w.Code)
+		}
+		if w := sendDavRequest(&app, "MKCOL", "/docs", "", nil); w.Code != http.StatusMethodNotAllowed {
+			t0.Errorf("expected 405, got %v", w.Code)
+		}
+		if w := sendDavRequest(&app, http.MethodPut, "/docs/a.txt", "content", nil); w.Code != http.StatusCreated {
+			t0.Errorf("expected 201, got %v", w.Code)
+		}
+		if w := sendDavRequest(&app, http.MethodGet, "/docs/a.txt", "", nil); w.Body.String() != "content" {
+			t0.Errorf("unexpected content: %q", w.Body.String())
+		}
+	})
+
+	t.Run("it should list collections", func(t0 *testing.T) {
+		w := sendDavRequest(&app, "PROPFIND", "/docs", "", map[string]string{"Depth": "1"})
+		if w.Code != http.StatusMultiStatus {
+			t0.Fatalf("expected 207, got %v", w.Code)
+		}
+		body := w.Body.String()
+		if !strings.Contains(body, "<D:href>/.crydrv/dav/docs/</D:href>") || !strings.Contains(body, "<D:collection/>") ||
+			!strings.Contains(body, "<D:href>/.crydrv/dav/docs/a.txt</D:href>") || !strings.Contains(body, "<D:getcontentlength>7</D:getcontentlength>") {
+			t0.Errorf("unexpected propfind response: %s", body)
+		}
+	})
+
+	t.Run("it should list collections without depth and refuse infinite depth", func(t0 *testing.T) {
+		if w := sendDavRequest(&app, "PROPFIND", "/docs", "", nil); w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "/docs/a.txt</D:href>") {
+			t0.Errorf("expected the children, got %v %s", w.Code, w.Body.String())
+		}
+		w := sendDavRequest(&app, "PROPFIND", "/docs", "", map[string]string{"Depth": "infinity"})
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "<D:propfind-finite-depth/>") {
+			t0.Errorf("expected 403 with a precondition, got %v %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("it should store dead properties", func(t0 *testing.T) {
+		w := sendDavRequest(&app, "PROPPATCH", "/docs/a.txt", `<?xml version="1.0"?>
+			<D:propertyupdate xmlns:D="DAV:" xmlns:Z="urn:example"><D:set><D:prop><Z:color>red</Z:color></D:prop></D:set></D:propertyupdate>`, nil)
+		if w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "200 OK") {
+			t0.Fatalf("expected 207, got %v %s", w.Code, w.Body.String())
+		}
+		if w := sendDavRequest(&app, "COPY", "/docs/a.txt", "", map[string]string{"Destination": WEBDAV_PREFIX + "/docs/b.txt"}); w.Code != http.StatusCreated {
+			t0.Fatalf("expected 201, got %v", w.Code)
+		}
+		w = sendDavRequest(&app, "PROPFIND", "/docs/b.txt", `<?xml version="1.0"?>
+			<D:propfind xmlns:D="DAV:"><D:prop><color xmlns="urn:example"/><D:missing/></D:prop></D:propfind>`, map[string]string{"Depth": "0"})
+		if !strings.Contains(w.Body.String(), `<x:color xmlns:x="urn:example">red</x:color>`) || !strings.Contains(w.Body.String(), "404 Not Found") {
+			t0.Errorf("unexpected propfind response: %s", w.Body.String())
+		}
+	})
+
+	t.Run("it should enforce locks", func(t0 *testing.T) {
+		w := sendDavRequest(&app, "LOCK", "/docs", `<?xml version="1.0"?>
+			<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype><D:owner>me</D:owner></D:lockinfo>`, nil)
+		if w.Code != http.StatusOK {
+			t0.Fatalf("expected 200, got %v %s", w.Code, w.Body.String())
+		}
+		token := w.Header().Get("Lock-Token")
+
+		if w := sendDavRequest(&app, http.MethodPut, "/docs/a.txt", "changed", nil); w.Code != http.StatusLocked {
+			t0.Errorf("expected 423, got %v", w.Code)
+		}
+		if w := sendDavRequest(&app, http.MethodDelete, "/docs", "", nil); w.Code != http.StatusLocked {
+			t0.Errorf("expected 423, got %v", w.Code)
+		}
+		if w := sendDavRequest(&app, http.MethodPut, "/docs/a.txt", "changed", map[string]string{"If": "(" + token + ")"}); w.Code != http.StatusNoContent {
+			t0.Errorf("expected 204, got %v", w.Code)
+		}
+		if w := sendDavRequest(&app, "UNLOCK", "/docs/a.txt", "", map[string]string{"Lock-Token": token}); w.Code != http.StatusNoContent {
+			t0.Errorf("expected 204, got %v", w.Code)
+		}
+		if w := sendDavRequest(&app, http.MethodDelete, "/docs", "", nil); w.Code != http.StatusNoContent {
+			t0.Errorf("expected 204, got %v", w.Code)
+		}
+		if w := sendDavRequest(&app, "PROPFIND", "/docs/b.txt", "", map[string]string{"Depth": "0"}); w.Code != http.StatusNotFound {
+			t0.Errorf("expected 404, got %v", w.Code)
+		}
+	})
+}